@@ -0,0 +1,73 @@
+package backend
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+)
+
+const (
+  ProtoWireGuard = "wireguard"
+  ProtoOpenVPN   = "openvpn"
+  ProtoIPsec     = "ipsec"
+)
+
+var ErrProtocolMismatch = errors.New("protocol mismatch")
+
+// Capabilities tells what a backend supports. Protocol names the wire
+// protocol, backends speaking the same protocol can be attached to each
+// other, e.g. wireguard and wireguard-userspace.
+type Capabilities struct {
+  Protocol string
+  // IPv6 addresses for the interface and peers
+  IPv6 bool
+  // PresharedKey adds a symmetric key on top of the key exchange
+  PresharedKey bool
+  // LivePeerUpdate means peers are added and removed without dropping the
+  // sessions of the other peers
+  LivePeerUpdate bool
+  // L2 bridges ethernet frames instead of routing ip packets
+  L2 bool
+  // Userspace means the tunnel always runs in a process and no kernel
+  // module besides tun may take it over
+  Userspace bool
+}
+
+func (c Capabilities) String() string {
+  features := []string{}
+  if c.IPv6 {
+    features = append(features, "ipv6")
+  }
+  if c.PresharedKey {
+    features = append(features, "preshared-key")
+  }
+  if c.LivePeerUpdate {
+    features = append(features, "live-peer-update")
+  }
+  if c.L2 {
+    features = append(features, "l2")
+  }
+  if c.Userspace {
+    features = append(features, "userspace")
+  }
+  return c.Protocol + " [" + strings.Join(features, " ") + "]"
+}
+
+// Negotiate returns the features both ends support, remote is empty when
+// the other end predates capabilities and is taken to speak our protocol.
+func Negotiate(local Capabilities, remote Capabilities) (Capabilities, error) {
+  if remote.Protocol == "" {
+    return Capabilities{Protocol: local.Protocol}, nil
+  }
+  if local.Protocol != remote.Protocol {
+    return Capabilities{}, fmt.Errorf("%w: %v and %v", ErrProtocolMismatch, local.Protocol, remote.Protocol)
+  }
+  return Capabilities{
+    Protocol:       local.Protocol,
+    IPv6:           local.IPv6 && remote.IPv6,
+    PresharedKey:   local.PresharedKey && remote.PresharedKey,
+    LivePeerUpdate: local.LivePeerUpdate && remote.LivePeerUpdate,
+    L2:             local.L2 && remote.L2,
+    Userspace:      local.Userspace && remote.Userspace,
+  }, nil
+}
@@ -0,0 +1,35 @@
+package backend
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+  local := Capabilities{Protocol: ProtoWireGuard, LivePeerUpdate: true, Userspace: true}
+  remote := Capabilities{Protocol: ProtoWireGuard, LivePeerUpdate: true, IPv6: true}
+  expected := Capabilities{Protocol: ProtoWireGuard, LivePeerUpdate: true}
+  actual, err := Negotiate(local, remote)
+  if err != nil || actual != expected {
+    t.Errorf("Negotiate(%v, %v) = %v, %v; expected %v", local, remote, actual, err, expected)
+  }
+
+  // an empty remote predates capabilities
+  actual, err = Negotiate(local, Capabilities{})
+  if err != nil || actual != (Capabilities{Protocol: ProtoWireGuard}) {
+    t.Errorf("Negotiate(%v, {}) = %v, %v; expected only the protocol", local, actual, err)
+  }
+
+  remote = Capabilities{Protocol: ProtoOpenVPN}
+  if _, err := Negotiate(local, remote); !errors.Is(err, ErrProtocolMismatch) {
+    t.Errorf("Negotiate(%v, %v) = %v; expected %v", local, remote, err, ErrProtocolMismatch)
+  }
+}
+
+func TestCapabilitiesString(t *testing.T) {
+  in := Capabilities{Protocol: ProtoIPsec, IPv6: true, LivePeerUpdate: true}
+  expected := "ipsec [ipv6 live-peer-update]"
+  if actual := in.String(); actual != expected {
+    t.Errorf("String(%#v) = %v; expected %v", in, actual, expected)
+  }
+}
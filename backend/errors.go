@@ -0,0 +1,40 @@
+package backend
+
+import (
+  "errors"
+)
+
+var (
+  ErrEmptyKeyPair   = errors.New("empty keypair")
+  ErrInterfaceUp    = errors.New("interface is already up")
+  ErrInterfaceNotUp = errors.New("interface is not up")
+  ErrInvalidKey     = errors.New("invalid key")
+  ErrInvalidAddress = errors.New("invalid address")
+  ErrSnapshot       = errors.New("snapshot of another backend")
+)
+
+// Error describes which step of configuring an interface failed, daemon
+// forwards its message to trictl so the user sees more than "failed".
+type Error struct {
+  Op    string
+  Iface string
+  Err   error
+}
+
+func (e *Error) Error() string {
+  if e.Iface == "" {
+    return e.Op + ": " + e.Err.Error()
+  }
+  return e.Op + " " + e.Iface + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+func wrapError(op string, iface string, err error) error {
+  if err == nil {
+    return nil
+  }
+  return &Error{Op: op, Iface: iface, Err: err}
+}
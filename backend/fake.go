@@ -0,0 +1,224 @@
+package backend
+
+import (
+  "sync"
+  "time"
+)
+
+// Fake keeps the interface and peers in memory and never touches the host,
+// it lets the daemon flows be tested without root or any VPN installed.
+// The counters tell how often the interface was brought up, down or synced,
+// the peers of the running interface are those of the last up or sync.
+type Fake struct {
+  IfaceSec Interface
+  PeersSec []Peer
+  // Caps replaces the capabilities of WireGuard when its protocol is set
+  Caps Capabilities
+  // Handshakes are the last handshakes of the peers by public key, the
+  // others never completed one
+  Handshakes map[string]time.Time
+  // FailUp is returned by UpInterface while set, like a link which does
+  // not come up
+  FailUp error
+
+  Ups   int
+  Downs int
+  Syncs int
+
+  mu   sync.Mutex
+  kp   KeyPair
+  up   bool
+  live []Peer
+}
+
+func (v *Fake) Install(platform string) error {
+  return nil
+}
+
+func (v *Fake) Uninstall() error {
+  return nil
+}
+
+func (v *Fake) NewKeyPair() error {
+  privateKey, err := GeneratePrivateKey()
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  v.kp.privateKey = []byte(privateKey.String())
+  v.kp.publicKey = []byte(privateKey.PublicKey().String())
+  return nil
+}
+
+func (v *Fake) NewInterface(iface Interface) error {
+  if err := iface.Validate(); err != nil {
+    return wrapError("interface add", "", err)
+  }
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if len(v.kp.privateKey) == 0 {
+    return ErrEmptyKeyPair
+  }
+  v.IfaceSec = iface
+  return nil
+}
+
+func (v *Fake) AddPeer(peer Peer) error {
+  if err := peer.Validate(); err != nil {
+    return wrapError("peer add", "", err)
+  }
+  key, err := ParseKey(peer.PublicKey)
+  if err != nil {
+    return wrapError("peer add", "", err)
+  }
+  peer.PublicKey = key.String()
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  v.PeersSec = putPeer(v.PeersSec, peer)
+  return nil
+}
+
+func (v *Fake) DelPeer(publicKey string) error {
+  key, err := ParseKey(publicKey)
+  if err != nil {
+    return wrapError("peer del", "", err)
+  }
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  v.PeersSec, _ = delPeer(v.PeersSec, key.String())
+  return nil
+}
+
+func (v *Fake) Snapshot() (Snapshot, error) {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return wgSnapshot{kp: v.kp, iface: v.IfaceSec, peers: append([]Peer{}, v.PeersSec...)}, nil
+}
+
+func (v *Fake) Restore(s Snapshot) error {
+  snap, ok := s.(wgSnapshot)
+  if !ok {
+    return wrapError("restore", "", ErrSnapshot)
+  }
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  v.kp, v.IfaceSec, v.PeersSec = snap.kp, snap.iface, append([]Peer{}, snap.peers...)
+  return nil
+}
+
+func (v *Fake) UpInterface(i string) error {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if v.FailUp != nil {
+    return wrapError("link add", IfaceName(i), v.FailUp)
+  }
+  if v.up {
+    return wrapError("link add", IfaceName(i), ErrInterfaceUp)
+  }
+  v.up = true
+  v.live = append([]Peer{}, v.PeersSec...)
+  v.Ups++
+  return nil
+}
+
+func (v *Fake) DownInterface(i string) error {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if !v.up {
+    return wrapError("link del", IfaceName(i), ErrInterfaceNotUp)
+  }
+  v.up = false
+  v.live = nil
+  v.Downs++
+  return nil
+}
+
+func (v *Fake) SyncInterface(i string) error {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if !v.up {
+    return wrapError("configure device", IfaceName(i), ErrInterfaceNotUp)
+  }
+  v.live = append([]Peer{}, v.PeersSec...)
+  v.Syncs++
+  return nil
+}
+
+// IsUp tells the daemon whether the interface is up, the fake has no link
+// it could look up on the host.
+func (v *Fake) IsUp(i string) bool {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return v.up
+}
+
+func (v *Fake) PeerStats(i string) ([]PeerStat, error) {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if !v.up {
+    return nil, wrapError("show", IfaceName(i), ErrInterfaceNotUp)
+  }
+  return v.peerStats(), nil
+}
+
+func (v *Fake) Inspect(i string) (Device, error) {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if !v.up {
+    return Device{}, wrapError("show", IfaceName(i), ErrInterfaceNotUp)
+  }
+  return Device{PublicKey: string(v.kp.publicKey), ListenPort: v.IfaceSec.ListenPort, Peers: v.peerStats()}, nil
+}
+
+// SetLivePeers changes the peers of the running interface behind the back
+// of the config, like `wg set` by hand.
+func (v *Fake) SetLivePeers(peers []Peer) {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  v.live = append([]Peer{}, peers...)
+}
+
+func (v *Fake) peerStats() []PeerStat {
+  stats := []PeerStat{}
+  for _, p := range v.live {
+    stats = append(stats, PeerStat{
+      PublicKey:     p.PublicKey,
+      AllowedIPs:    append([]string{}, p.AllowedIPs...),
+      LastHandshake: v.Handshakes[p.PublicKey],
+    })
+  }
+  return stats
+}
+
+func (v *Fake) Config() (string, error) {
+  v.mu.Lock()
+  w := WireGuard{kp: v.kp, IfaceSec: v.IfaceSec, PeersSec: append([]Peer{}, v.PeersSec...)}
+  v.mu.Unlock()
+  return w.Config()
+}
+
+func (v *Fake) Interface() Interface {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return v.IfaceSec
+}
+
+func (v *Fake) Peers() []Peer {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return append([]Peer{}, v.PeersSec...)
+}
+
+func (v *Fake) Capabilities() Capabilities {
+  if v.Caps.Protocol != "" {
+    return v.Caps
+  }
+  return (&WireGuard{}).Capabilities()
+}
+
+func (v *Fake) PublicKey() string {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  return string(v.kp.publicKey)
+}
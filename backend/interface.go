@@ -1,7 +1,11 @@
 package backend
 
 const (
-  TyWireGuard = "wireguard"
+  TyWireGuard          = "wireguard"
+  TyWireGuardUserspace = "wireguard-userspace"
+  TyWireGuardNetlink   = "wireguard-netlink"
+  TyOpenVPN            = "openvpn"
+  TyIPsec              = "ipsec"
 )
 
 type VpnBackend interface {
@@ -17,16 +21,21 @@ type VpnBackend interface {
   //Disconnect(map[string]string) error
 
   NewKeyPair() error
-  NewInterface(map[string]string) error
-  AddPeer(map[string]string) error
-  DelPeer(string) error
+  NewInterface(Interface) error
+  // AddPeer adds the peer, a peer with the same public key is replaced
+  AddPeer(Peer) error
+  // DelPeer removes the peer with the given public key
+  DelPeer(publicKey string) error
   //preflight() error
   UpInterface(i string) error
   DownInterface(i string) error
+  // SyncInterface applies the current peers to a running interface without
+  // touching the sessions of unchanged peers, like `wg syncconf`
+  SyncInterface(i string) error
 
-  CIDR() string
-  Port() string
-  Peer() interface{}
+  Interface() Interface
+  Peers() []Peer
+  Capabilities() Capabilities
   PublicKey() string
   Config() (string, error)
   //restartIface(i string) error
@@ -34,12 +43,45 @@ type VpnBackend interface {
   // disableIface(i string) error
 }
 
-func NewBackend(ty string) VpnBackend {
+// Loader is implemented by backends keeping their interface and peers in
+// the state store, Load reads them back, e.g. after tricarbd restarted. The
+// other methods only see them once a change loaded them.
+type Loader interface {
+  Load() error
+}
+
+// Snapshot is the key pair, interface and peers of a backend at one time,
+// only the backend which took it can restore it.
+type Snapshot interface{}
+
+// Snapshotter is implemented by backends whose config can be put back, the
+// daemon restores the snapshot taken before an operation which failed half
+// way, e.g. after adding a peer to an interface which did not come up.
+type Snapshotter interface {
+  Snapshot() (Snapshot, error)
+  Restore(Snapshot) error
+}
+
+// NewBackend creates backend ty, which keeps its state in the store of env.
+func NewBackend(ty string, env Env) VpnBackend {
   switch ty {
   case TyWireGuard:
-    return &WireGuard{}
+    return &WireGuard{env: env}
+  case TyWireGuardUserspace:
+    return &WireGuardUserspace{WireGuard: WireGuard{env: env}}
+  case TyWireGuardNetlink:
+    return &WireGuardNetlink{WireGuard: WireGuard{env: env}}
+  case TyOpenVPN:
+    return &OpenVPN{env: env}
+  case TyIPsec:
+    return &IPsec{env: env}
   default:
-    println("not supported backend")
-    return nil
+    // anything else may be served by an out-of-process plugin
+    p, err := NewPlugin(ty, env)
+    if err != nil {
+      env.logger().Printf("not supported backend: %v\n", err)
+      return nil
+    }
+    return p
   }
 }
@@ -0,0 +1,476 @@
+package backend
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/pem"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+
+  "github.com/vishvananda/netlink"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// IPsec provisions IKEv2 tunnels through strongSwan's swanctl, nodes
+// authenticate with raw ECDSA public keys which take the place of the
+// WireGuard keys in the attach flow. Traffic is routed through an XFRM
+// interface so the tunnel looks like the other backends to the daemon.
+type IPsec struct {
+  env      Env
+  IfaceSec IPsecInterface
+  PeersSec []Peer
+}
+
+type IPsecInterface struct {
+  Interface  `mapstructure:",squash"`
+  PrivateKey string
+}
+
+const (
+  ipsecSwanctlKey   = "ipsec.swanctl"
+  defaultSwanctlDir = "/etc/swanctl"
+  ipsecConnPrefix   = "tricarb"
+  ipsecIfID         = 0x7c
+
+  configIPsecServerPeer = `  tricarb-RWTH_ID {
+    version = 2
+    local_addrs = %any
+    dpd_delay = 10s
+    local {
+      auth = pubkey
+      id = RWTH_LOCAL_ID
+      pubkeys = tricarb.pem
+    }
+    remote {
+      auth = pubkey
+      id = RWTH_REMOTE_ID
+      pubkeys = tricarb-RWTH_ID.pem
+    }
+    children {
+      tricarb-RWTH_ID {
+        local_ts = RWTH_LOCAL_TS
+        remote_ts = RWTH_REMOTE_TS
+        if_id_in = RWTH_IF_ID
+        if_id_out = RWTH_IF_ID
+        dpd_action = clear
+      }
+    }
+  }
+`
+  configIPsecClientPeer = `  tricarb-RWTH_ID {
+    version = 2
+    remote_addrs = RWTH_SERVER_IP
+    dpd_delay = 10s
+    local {
+      auth = pubkey
+      id = RWTH_LOCAL_ID
+      pubkeys = tricarb.pem
+    }
+    remote {
+      auth = pubkey
+      id = RWTH_REMOTE_ID
+      pubkeys = tricarb-RWTH_ID.pem
+    }
+    children {
+      tricarb-RWTH_ID {
+        local_ts = RWTH_LOCAL_TS
+        remote_ts = RWTH_REMOTE_TS
+        if_id_in = RWTH_IF_ID
+        if_id_out = RWTH_IF_ID
+        start_action = start
+        dpd_action = restart
+      }
+    }
+  }
+`
+)
+
+// please check https://docs.strongswan.org/docs/5.9/install/install.html
+func (v *IPsec) Install(platform string) error {
+  switch platform {
+  case "ubuntu.x86":
+  if err := utils.StdIOCmd("sudo", "apt-get", "update"); err != nil {
+    return err
+  }
+  if err := utils.StdIOCmd("sudo", "apt-get", "install", "strongswan-swanctl", "charon-systemd"); err != nil {
+    return err
+  }
+  default:
+    println("not implemented")
+  }
+  return nil
+}
+
+func (v *IPsec) Uninstall() error {
+  fmt.Println("Not implemented")
+  return nil
+}
+
+func (v *IPsec) NewKeyPair() error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+  der, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+  v.IfaceSec.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+  return nil
+}
+
+func (v *IPsec) NewInterface(iface Interface) error {
+  privateKey := v.IfaceSec.PrivateKey
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  if privateKey == "" {
+    return ErrEmptyKeyPair
+  }
+  if err := iface.Validate(); err != nil {
+    return wrapError("interface add", "", err)
+  }
+
+  v.IfaceSec = IPsecInterface{
+    Interface:  iface,
+    PrivateKey: privateKey,
+  }
+  return v.saveConfig()
+}
+
+func (v *IPsec) AddPeer(peer Peer) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  if err := peer.Validate(); err != nil {
+    return wrapError("peer add", "", err)
+  }
+  pub, err := parsePublicKey(peer.PublicKey)
+  if err != nil {
+    return wrapError("peer add", "", err)
+  }
+  peer.PublicKey = pub
+  v.PeersSec = putPeer(v.PeersSec, peer)
+
+  return v.saveConfig()
+}
+
+func (v *IPsec) DelPeer(publicKey string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  pub, err := parsePublicKey(publicKey)
+  if err != nil {
+    return wrapError("peer del", "", err)
+  }
+  v.PeersSec, _ = delPeer(v.PeersSec, pub)
+
+  return v.saveConfig()
+}
+
+func (v *IPsec) UpInterface(i string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  name := IfaceName(i)
+  if _, err := netlink.LinkByName(name); err == nil {
+    return wrapError("link add", name, ErrInterfaceUp)
+  }
+  attrs := netlink.NewLinkAttrs()
+  attrs.Name = name
+  if err := netlink.LinkAdd(&netlink.Xfrmi{LinkAttrs: attrs, Ifid: ipsecIfID}); err != nil {
+    return wrapError("link add", name, err)
+  }
+  if err := linkUp(name, v.IfaceSec.Interface, v.PeersSec); err != nil {
+    v.delLink(name)
+    return err
+  }
+
+  if err := v.loadSwanctl(i); err != nil {
+    v.delLink(name)
+    return err
+  }
+  for _, p := range v.PeersSec {
+    if p.Endpoint == nil {
+      continue
+    }
+    child := ipsecConnPrefix + "-" + keyID(p.PublicKey)
+    if err := utils.StdIOCmd("swanctl", "--initiate", "--child", child); err != nil {
+      v.delLink(name)
+      return wrapError("swanctl initiate", name, err)
+    }
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, true)
+  return nil
+}
+
+func (v *IPsec) DownInterface(i string) error {
+  name := IfaceName(i)
+  link, err := netlink.LinkByName(name)
+  if err != nil {
+    return wrapError("link del", name, ErrInterfaceNotUp)
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, false)
+
+  dir := v.swanctlDir()
+  if err := os.Remove(path.Join(dir, "conf.d", ipsecConnPrefix+".conf")); err != nil && !os.IsNotExist(err) {
+    return wrapError("swanctl unload", name, err)
+  }
+  if err := v.terminateStale(dir, map[string]bool{}); err != nil {
+    return wrapError("swanctl terminate", name, err)
+  }
+  if err := utils.StdIOCmd("swanctl", "--load-all"); err != nil {
+    return wrapError("swanctl unload", name, err)
+  }
+  if err := netlink.LinkDel(link); err != nil {
+    return wrapError("link del", name, err)
+  }
+  return nil
+}
+
+// SyncInterface reloads the connections, charon keeps the SAs of unchanged
+// connections and only the SAs of removed peers are terminated.
+func (v *IPsec) SyncInterface(i string) error {
+  if _, err := netlink.LinkByName(IfaceName(i)); err != nil {
+    return wrapError("swanctl load", IfaceName(i), ErrInterfaceNotUp)
+  }
+  return v.loadSwanctl(i)
+}
+
+func (v *IPsec) Config() (string, error) {
+  context := "connections {\n"
+
+  for _, p := range v.PeersSec {
+    rp := map[string]string{
+      "RWTH_ID":        keyID(p.PublicKey),
+      "RWTH_LOCAL_ID":  "@#" + keyID(v.PublicKey()),
+      "RWTH_REMOTE_ID": "@#" + keyID(p.PublicKey),
+      "RWTH_REMOTE_TS": strings.Join(p.AllowedIPs, ","),
+      "RWTH_IF_ID":     fmt.Sprintf("%d", ipsecIfID),
+    }
+    template := configIPsecServerPeer
+    if p.Endpoint != nil {
+      template = configIPsecClientPeer
+      rp["RWTH_SERVER_IP"] = p.Endpoint.Host
+    }
+    localTS, err := v.localTS(p.Endpoint != nil)
+    if err != nil {
+      return "", err
+    }
+    rp["RWTH_LOCAL_TS"] = localTS
+    peerText, err := utils.MakeText(template, rp)
+    if err != nil {
+      return "", err
+    }
+    context += peerText
+  }
+
+  context += "}\n"
+  return context, nil
+}
+
+func (v *IPsec) Interface() Interface {
+  return v.IfaceSec.Interface
+}
+
+func (v *IPsec) Peers() []Peer {
+  return v.PeersSec
+}
+
+// localTS is the tunnel address of a client or the network of a server,
+// one traffic selector per address.
+func (v *IPsec) localTS(client bool) (string, error) {
+  ts := []string{}
+  for _, addr := range v.IfaceSec.Addresses() {
+    ip, ipNet, err := net.ParseCIDR(addr)
+    if err != nil {
+      return "", fmt.Errorf("%w %v", ErrInvalidAddress, addr)
+    }
+    if client {
+      bits := 8 * len(ipNet.IP)
+      ts = append(ts, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String())
+    } else {
+      ts = append(ts, ipNet.String())
+    }
+  }
+  return strings.Join(ts, ","), nil
+}
+
+func (v *IPsec) Capabilities() Capabilities {
+  return Capabilities{Protocol: ProtoIPsec, LivePeerUpdate: true}
+}
+
+// PublicKey is the base64 encoded DER (SubjectPublicKeyInfo) public key.
+func (v *IPsec) PublicKey() string {
+  block, _ := pem.Decode([]byte(v.IfaceSec.PrivateKey))
+  if block == nil {
+    return ""
+  }
+  key, err := x509.ParseECPrivateKey(block.Bytes)
+  if err != nil {
+    return ""
+  }
+  der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+  if err != nil {
+    return ""
+  }
+  return base64.StdEncoding.EncodeToString(der)
+}
+
+// loadSwanctl installs the rendered config and the keys into the swanctl
+// directory and has charon load them.
+func (v *IPsec) loadSwanctl(i string) error {
+  name := IfaceName(i)
+  dir := v.swanctlDir()
+  conf, err := ioutil.ReadFile(i)
+  if err != nil {
+    return wrapError("swanctl load", name, err)
+  }
+
+  wanted := map[string]bool{}
+  files := map[string]string{
+    path.Join(dir, "conf.d", ipsecConnPrefix+".conf"): string(conf),
+    path.Join(dir, "ecdsa", ipsecConnPrefix+".pem"):   v.IfaceSec.PrivateKey,
+    path.Join(dir, "pubkey", ipsecConnPrefix+".pem"):  publicKeyPem(v.PublicKey()),
+  }
+  for _, p := range v.PeersSec {
+    id := keyID(p.PublicKey)
+    wanted[id] = true
+    files[path.Join(dir, "pubkey", ipsecConnPrefix+"-"+id+".pem")] = publicKeyPem(p.PublicKey)
+  }
+  for f, content := range files {
+    if err := os.MkdirAll(path.Dir(f), 0750); err != nil {
+      return wrapError("swanctl load", name, err)
+    }
+    if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+      return wrapError("swanctl load", name, err)
+    }
+  }
+
+  if err := v.terminateStale(dir, wanted); err != nil {
+    return wrapError("swanctl terminate", name, err)
+  }
+  if err := utils.StdIOCmd("swanctl", "--load-all"); err != nil {
+    return wrapError("swanctl load", name, err)
+  }
+  return nil
+}
+
+// terminateStale closes the SAs of the peers which are not wanted anymore
+// and removes their public keys.
+func (v *IPsec) terminateStale(dir string, wanted map[string]bool) error {
+  pubkeys, err := filepath.Glob(path.Join(dir, "pubkey", ipsecConnPrefix+"-*.pem"))
+  if err != nil {
+    return err
+  }
+  for _, f := range pubkeys {
+    id := strings.TrimSuffix(strings.TrimPrefix(path.Base(f), ipsecConnPrefix+"-"), ".pem")
+    if wanted[id] {
+      continue
+    }
+    // there may be no SA for the peer, that is fine
+    utils.StdIOCmd("swanctl", "--terminate", "--ike", ipsecConnPrefix+"-"+id, "--force")
+    if err := os.Remove(f); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (v *IPsec) delLink(name string) {
+  if link, err := netlink.LinkByName(name); err == nil {
+    netlink.LinkDel(link)
+  }
+}
+
+func (v *IPsec) Load() error {
+  return v.loadConfig()
+}
+
+type ipsecSnapshot struct {
+  iface IPsecInterface
+  peers []Peer
+}
+
+func (v *IPsec) Snapshot() (Snapshot, error) {
+  if err := v.loadConfig(); err != nil {
+    return nil, err
+  }
+  return ipsecSnapshot{iface: v.IfaceSec, peers: append([]Peer{}, v.PeersSec...)}, nil
+}
+
+func (v *IPsec) Restore(s Snapshot) error {
+  snap, ok := s.(ipsecSnapshot)
+  if !ok {
+    return wrapError("restore", "", ErrSnapshot)
+  }
+  v.IfaceSec, v.PeersSec = snap.iface, append([]Peer{}, snap.peers...)
+  return v.saveConfig()
+}
+
+func (v *IPsec) loadConfig() error {
+  if err := v.env.loadIface("ipsec.iface", &v.IfaceSec); err != nil {
+    return err
+  }
+  peers, err := v.env.loadPeers("ipsec.peers")
+  if err != nil {
+    return err
+  }
+  v.PeersSec = peers
+  return nil
+}
+
+func (v *IPsec) saveConfig() error {
+  iface := map[string]interface{} {
+    "ListenPort": v.IfaceSec.ListenPort,
+    "Address":    v.IfaceSec.Address,
+    "LocalEth":   v.IfaceSec.LocalEth,
+    "PrivateKey": v.IfaceSec.PrivateKey,
+  }
+  return v.env.saveSections("ipsec.iface", iface, "ipsec.peers", v.PeersSec)
+}
+
+func (v *IPsec) swanctlDir() string {
+  if dir := v.env.setting(ipsecSwanctlKey); dir != "" {
+    return dir
+  }
+  return defaultSwanctlDir
+}
+
+func parsePublicKey(s string) (string, error) {
+  der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+  if err != nil {
+    return "", fmt.Errorf("%w %q", ErrInvalidKey, s)
+  }
+  if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+    return "", fmt.Errorf("%w %q", ErrInvalidKey, s)
+  }
+  return base64.StdEncoding.EncodeToString(der), nil
+}
+
+func publicKeyPem(s string) string {
+  der, _ := base64.StdEncoding.DecodeString(s)
+  return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// keyID names the connection and forms the KEY_ID identity of a node, both
+// sides derive it from the public key exchanged while attaching.
+func keyID(s string) string {
+  der, _ := base64.StdEncoding.DecodeString(s)
+  sum := sha256.Sum256(der)
+  return hex.EncodeToString(sum[:10])
+}
@@ -0,0 +1,200 @@
+package backend
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/pem"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path"
+  "reflect"
+  "strings"
+  "testing"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// newIPsecKey returns a private key as IPsecInterface keeps it and its
+// public key as the peers exchange it.
+func newIPsecKey(t *testing.T) (string, string) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatalf("GenerateKey() got error %v", err)
+  }
+  der, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatalf("MarshalECPrivateKey() got error %v", err)
+  }
+  pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+  if err != nil {
+    t.Fatalf("MarshalPKIXPublicKey() got error %v", err)
+  }
+  return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+    base64.StdEncoding.EncodeToString(pub)
+}
+
+func TestIPsecConfig(t *testing.T) {
+  serverKey, serverPub := newIPsecKey(t)
+  clientKey, clientPub := newIPsecKey(t)
+  server := &IPsec{
+    IfaceSec: IPsecInterface{Interface: Interface{ListenPort: 500, Address: "10.0.0.1/24,fd00::1/64"}, PrivateKey: serverKey},
+    PeersSec: []Peer{{PublicKey: clientPub, AllowedIPs: []string{"10.0.0.2/32", "fd00::2/128"}}},
+  }
+  client := &IPsec{
+    IfaceSec: IPsecInterface{Interface: Interface{Address: "10.0.0.2/24,fd00::2/64"}, PrivateKey: clientKey},
+    PeersSec: []Peer{{
+      PublicKey:  serverPub,
+      AllowedIPs: []string{"10.0.0.0/24", "fd00::/64"},
+      Endpoint:   &Endpoint{Host: "1.2.3.4", Port: 500},
+    }},
+  }
+  if server.PublicKey() != serverPub || client.PublicKey() != clientPub {
+    t.Fatalf("PublicKey() does not match the private key")
+  }
+
+  // both ends name the connection after the other one and agree on the ids
+  cases := []struct {
+    name     string
+    v        *IPsec
+    expected []string
+    missing  []string
+  }{
+    {"server", server, []string{
+      "tricarb-" + keyID(clientPub) + " {",
+      "local_addrs = %any",
+      "id = @#" + keyID(serverPub),
+      "id = @#" + keyID(clientPub),
+      "pubkeys = tricarb-" + keyID(clientPub) + ".pem",
+      "local_ts = 10.0.0.0/24,fd00::/64",
+      "remote_ts = 10.0.0.2/32,fd00::2/128",
+      "if_id_in = 124",
+      "dpd_action = clear",
+    }, []string{"remote_addrs", "start_action"}},
+    {"client", client, []string{
+      "tricarb-" + keyID(serverPub) + " {",
+      "remote_addrs = 1.2.3.4",
+      "id = @#" + keyID(clientPub),
+      "id = @#" + keyID(serverPub),
+      "local_ts = 10.0.0.2/32,fd00::2/128",
+      "remote_ts = 10.0.0.0/24,fd00::/64",
+      "start_action = start",
+      "dpd_action = restart",
+    }, []string{"local_addrs"}},
+  }
+  for _, c := range cases {
+    conf, err := c.v.Config()
+    if err != nil {
+      t.Fatalf("Config() of the %v got error %v", c.name, err)
+    }
+    if !strings.HasPrefix(conf, "connections {\n") || !strings.HasSuffix(conf, "}\n") {
+      t.Errorf("Config() of the %v = %q; expected a connections section", c.name, conf)
+    }
+    for _, line := range c.expected {
+      if !strings.Contains(conf, line) {
+        t.Errorf("Config() of the %v misses %q:\n%v", c.name, line, conf)
+      }
+    }
+    for _, line := range c.missing {
+      if strings.Contains(conf, line) {
+        t.Errorf("Config() of the %v has %q:\n%v", c.name, line, conf)
+      }
+    }
+  }
+}
+
+func TestIPsecLocalTS(t *testing.T) {
+  cases := []struct {
+    address string
+    client  bool
+    ts      string
+  }{
+    {"10.0.0.1/24", false, "10.0.0.0/24"},
+    {"10.0.0.2/24", true, "10.0.0.2/32"},
+    {"10.0.0.1/24,fd00::1/64", false, "10.0.0.0/24,fd00::/64"},
+    {"10.0.0.2/24,fd00::2/64", true, "10.0.0.2/32,fd00::2/128"},
+  }
+  for _, c := range cases {
+    v := &IPsec{IfaceSec: IPsecInterface{Interface: Interface{Address: c.address}}}
+    if ts, err := v.localTS(c.client); err != nil || ts != c.ts {
+      t.Errorf("localTS(%v) of %v = %v, %v; expected %v", c.client, c.address, ts, err, c.ts)
+    }
+  }
+
+  v := &IPsec{IfaceSec: IPsecInterface{Interface: Interface{Address: "10.0.0.1"}}}
+  if _, err := v.localTS(false); !errors.Is(err, ErrInvalidAddress) {
+    t.Errorf("localTS() of an address without prefix got error %v; expected %v", err, ErrInvalidAddress)
+  }
+}
+
+func TestParsePublicKey(t *testing.T) {
+  _, pub := newIPsecKey(t)
+  if parsed, err := parsePublicKey(" " + pub + "\n"); err != nil || parsed != pub {
+    t.Errorf("parsePublicKey() = %v, %v; expected %v", parsed, err, pub)
+  }
+  for _, in := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("not a key"))} {
+    if _, err := parsePublicKey(in); !errors.Is(err, ErrInvalidKey) {
+      t.Errorf("parsePublicKey(%q) got error %v; expected %v", in, err, ErrInvalidKey)
+    }
+  }
+
+  _, other := newIPsecKey(t)
+  id := keyID(pub)
+  if len(id) != 20 || strings.Trim(id, "0123456789abcdef") != "" {
+    t.Errorf("keyID() = %v; expected 20 hex digits", id)
+  }
+  if keyID(pub) != id || keyID(other) == id {
+    t.Errorf("keyID() is not derived from the key alone")
+  }
+}
+
+func TestIPsecTerminateStale(t *testing.T) {
+  dir := t.TempDir()
+  v := &IPsec{env: Env{Settings: mapSettings{ipsecSwanctlKey: dir}}}
+  pubkeys := path.Join(dir, "pubkey")
+  if err := os.MkdirAll(pubkeys, 0750); err != nil {
+    t.Fatalf("MkdirAll() got error %v", err)
+  }
+  for _, name := range []string{"tricarb.pem", "tricarb-kept.pem", "tricarb-stale.pem", "tricarb-gone.pem", "other.pem"} {
+    if err := ioutil.WriteFile(path.Join(pubkeys, name), []byte("key"), 0600); err != nil {
+      t.Fatalf("WriteFile(%v) got error %v", name, err)
+    }
+  }
+
+  // a peer without an SA fails to terminate, its key goes all the same
+  runner := &utils.RecordRunner{Errors: map[string]error{
+    "swanctl --terminate --ike tricarb-gone --force": errors.New("no matching SAs"),
+  }}
+  defer utils.SetRunner(utils.SetRunner(runner))
+  if err := v.terminateStale(v.swanctlDir(), map[string]bool{"kept": true}); err != nil {
+    t.Fatalf("terminateStale() got error %v", err)
+  }
+
+  expected := []string{
+    "swanctl --terminate --ike tricarb-gone --force",
+    "swanctl --terminate --ike tricarb-stale --force",
+  }
+  if commands := runner.Commands(); !reflect.DeepEqual(commands, expected) {
+    t.Errorf("terminateStale() ran %v; expected %v", commands, expected)
+  }
+  files, err := ioutil.ReadDir(pubkeys)
+  if err != nil {
+    t.Fatalf("ReadDir() got error %v", err)
+  }
+  left := []string{}
+  for _, f := range files {
+    left = append(left, f.Name())
+  }
+  if expected := []string{"other.pem", "tricarb-kept.pem", "tricarb.pem"}; !reflect.DeepEqual(left, expected) {
+    t.Errorf("after terminateStale(): pubkeys %v; expected %v", left, expected)
+  }
+
+  // nothing to do without a swanctl directory
+  v.env.Settings = mapSettings{ipsecSwanctlKey: path.Join(dir, "missing")}
+  if err := v.terminateStale(v.swanctlDir(), map[string]bool{}); err != nil {
+    t.Errorf("terminateStale() of a missing directory got error %v", err)
+  }
+}
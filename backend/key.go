@@ -0,0 +1,62 @@
+package backend
+
+import (
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/hex"
+  "fmt"
+  "strings"
+
+  "golang.org/x/crypto/curve25519"
+)
+
+const (
+  KeyLen = 32
+)
+
+// Key is a Curve25519 key in the form WireGuard uses it, configs carry it
+// base64 encoded and the userspace API hex encoded.
+type Key [KeyLen]byte
+
+// GeneratePrivateKey is the in-process `wg genkey`.
+func GeneratePrivateKey() (Key, error) {
+  var k Key
+  if _, err := rand.Read(k[:]); err != nil {
+    return Key{}, err
+  }
+  k[0] &= 248
+  k[31] = (k[31] & 127) | 64
+  return k, nil
+}
+
+// ParseKey accepts a base64 encoded key, surrounding whitespace (e.g. the
+// newline `wg genkey` prints) is ignored.
+func ParseKey(s string) (Key, error) {
+  raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+  if err != nil || len(raw) != KeyLen {
+    return Key{}, fmt.Errorf("%w %q", ErrInvalidKey, s)
+  }
+  var k Key
+  copy(k[:], raw)
+  return k, nil
+}
+
+// PublicKey is the in-process `wg pubkey`, k has to be a private key.
+func (k Key) PublicKey() Key {
+  var pub Key
+  raw, err := curve25519.X25519(k[:], curve25519.Basepoint)
+  if err != nil {
+    // only happens for a low order point, never for the base point
+    panic(err)
+  }
+  copy(pub[:], raw)
+  return pub
+}
+
+func (k Key) String() string {
+  return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func (k Key) Hex() string {
+  return hex.EncodeToString(k[:])
+}
@@ -0,0 +1,44 @@
+package backend
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestKeyPublicKey(t *testing.T) {
+  // RFC 7748 section 6.1, Alice's key pair
+  var (
+    in       = "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="
+    expected = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+  )
+  k, err := ParseKey(in)
+  if err != nil {
+    t.Fatalf("ParseKey(%v) got error %v", in, err)
+  }
+  actual := k.PublicKey().String()
+  if actual != expected {
+    t.Errorf("PublicKey(%v) = %v; expected %v", in, actual, expected)
+  }
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+  k, err := GeneratePrivateKey()
+  if err != nil {
+    t.Fatalf("GeneratePrivateKey() got error %v", err)
+  }
+  if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+    t.Errorf("GeneratePrivateKey() = %v; not clamped", k.Hex())
+  }
+  parsed, err := ParseKey(k.String() + "\n")
+  if err != nil || parsed != k {
+    t.Errorf("ParseKey(%v) = %v, %v; expected %v", k.String(), parsed, err, k)
+  }
+}
+
+func TestParseKeyInvalid(t *testing.T) {
+  for _, in := range []string{"", "not-base64", "YWJj"} {
+    if _, err := ParseKey(in); !errors.Is(err, ErrInvalidKey) {
+      t.Errorf("ParseKey(%q) got error %v; expected %v", in, err, ErrInvalidKey)
+    }
+  }
+}
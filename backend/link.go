@@ -0,0 +1,79 @@
+package backend
+
+import (
+  "fmt"
+  "net"
+  "path"
+  "strings"
+
+  "github.com/vishvananda/netlink"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// IfaceName follows wg-quick, the interface is named after the config file.
+func IfaceName(i string) string {
+  base := path.Base(i)
+  return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// linkUp assigns the addresses, brings the link up and routes the allowed
+// ips of peers with an endpoint (the server seen from a client) through it.
+func linkUp(name string, iface Interface, peers []Peer) error {
+  link, err := netlink.LinkByName(name)
+  if err != nil {
+    return wrapError("link lookup", name, err)
+  }
+  for _, address := range iface.Addresses() {
+    addr, err := netlink.ParseAddr(address)
+    if err != nil {
+      return wrapError("address parse", name, fmt.Errorf("%w %v", ErrInvalidAddress, address))
+    }
+    if err := netlink.AddrReplace(link, addr); err != nil {
+      return wrapError("address add", name, err)
+    }
+  }
+  if err := netlink.LinkSetUp(link); err != nil {
+    return wrapError("link up", name, err)
+  }
+
+  for _, p := range peers {
+    if p.Endpoint == nil {
+      continue
+    }
+    for _, ip := range p.AllowedIPs {
+      _, dst, err := net.ParseCIDR(ip)
+      if err != nil {
+        return wrapError("route parse", name, fmt.Errorf("%w %v", ErrInvalidAddress, ip))
+      }
+      route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst}
+      if err := netlink.RouteReplace(route); err != nil {
+        return wrapError("route add", name, err)
+      }
+    }
+  }
+  return nil
+}
+
+// forwardRules mirrors the PostUp/PostDown rules of the wg-quick config, a
+// missing iptables is common on the hosts these backends target so failures
+// only produce a warning.
+func forwardRules(iface string, eth string, add bool) {
+  if eth == "" {
+    return
+  }
+  op := "-D"
+  if add {
+    op = "-A"
+  }
+  rules := [][]string{
+    {op, "FORWARD", "-i", iface, "-j", "ACCEPT"},
+    {op, "FORWARD", "-o", iface, "-j", "ACCEPT"},
+    {"-t", "nat", op, "POSTROUTING", "-o", eth, "-j", "MASQUERADE"},
+  }
+  for _, r := range rules {
+    if err := utils.StdIOCmd("iptables", r...); err != nil {
+      fmt.Printf("warning: iptables %v: %v\n", strings.Join(r, " "), err)
+    }
+  }
+}
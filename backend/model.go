@@ -0,0 +1,271 @@
+package backend
+
+import (
+  "fmt"
+  "log"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+
+  "github.com/mitchellh/mapstructure"
+
+  "github.com/GreysTone/tricarboxylic/state"
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// Env is where a backend keeps its interface and peers and reads its
+// settings, the zero value is the default store and config.yaml.
+type Env struct {
+  Store    *state.Store
+  Settings Settings
+  // Logger gets the warnings, nil prints them to stdout
+  Logger Logger
+}
+
+// Logger is where a backend warns about what it could not report back,
+// *log.Logger is one.
+type Logger interface {
+  Printf(format string, v ...interface{})
+}
+
+// Settings reads what a user configured, e.g. openvpn.proto.
+type Settings interface {
+  ReadString(key string) string
+}
+
+func (e Env) setting(key string) string {
+  if e.Settings == nil {
+    return utils.ReadString(key)
+  }
+  return e.Settings.ReadString(key)
+}
+
+func (e Env) logger() Logger {
+  if e.Logger == nil {
+    return log.New(os.Stdout, "", 0)
+  }
+  return e.Logger
+}
+
+func (e Env) store() (*state.Store, error) {
+  if e.Store == nil {
+    return state.Default()
+  }
+  return e.Store, nil
+}
+
+// Interface is the local end of the tunnel, ListenPort is only set on a
+// server. Address holds the CIDRs separated by commas as in wg-quick, e.g.
+// one of each family for dual-stack or one per pool on a server. Keys are
+// backend specific and stay inside the backends.
+type Interface struct {
+  ListenPort int
+  Address    string
+  LocalEth   string
+}
+
+// Endpoint is where a peer is reached, only set for the peers this node
+// connects to (the server seen from a client).
+type Endpoint struct {
+  Host string
+  Port int
+}
+
+type Peer struct {
+  PublicKey           string
+  AllowedIPs          []string
+  Endpoint            *Endpoint
+  PersistentKeepalive int
+}
+
+// ValidationError names the field of an Interface or Peer which is missing
+// or malformed.
+type ValidationError struct {
+  Field  string
+  Reason string
+}
+
+func (e *ValidationError) Error() string {
+  return "invalid " + e.Field + ": " + e.Reason
+}
+
+func (i Interface) Validate() error {
+  addrs := i.Addresses()
+  if len(addrs) == 0 {
+    return &ValidationError{Field: "Address", Reason: "missing"}
+  }
+  for _, addr := range addrs {
+    if _, _, err := net.ParseCIDR(addr); err != nil {
+      return &ValidationError{Field: "Address", Reason: fmt.Sprintf("%q is not a CIDR", addr)}
+    }
+  }
+  if i.ListenPort < 0 || i.ListenPort > 65535 {
+    return &ValidationError{Field: "ListenPort", Reason: fmt.Sprintf("%v is out of range", i.ListenPort)}
+  }
+  return nil
+}
+
+// Addresses splits Address into its CIDRs.
+func (i Interface) Addresses() []string {
+  addrs := []string{}
+  for _, addr := range strings.Split(i.Address, ",") {
+    if addr = strings.TrimSpace(addr); addr != "" {
+      addrs = append(addrs, addr)
+    }
+  }
+  return addrs
+}
+
+// IsServer tells whether the interface accepts peers or connects to one.
+func (i Interface) IsServer() bool {
+  return i.ListenPort != 0
+}
+
+// Validate checks the shape of the peer, whether the public key is valid is
+// up to the backend since every backend has its own kind of keys.
+func (p Peer) Validate() error {
+  if p.PublicKey == "" {
+    return &ValidationError{Field: "PublicKey", Reason: "missing"}
+  }
+  if len(p.AllowedIPs) == 0 {
+    return &ValidationError{Field: "AllowedIPs", Reason: "missing"}
+  }
+  for _, ip := range p.AllowedIPs {
+    if _, _, err := net.ParseCIDR(ip); err != nil {
+      return &ValidationError{Field: "AllowedIPs", Reason: fmt.Sprintf("%q is not a CIDR", ip)}
+    }
+  }
+  if p.Endpoint != nil {
+    if p.Endpoint.Host == "" {
+      return &ValidationError{Field: "Endpoint.Host", Reason: "missing"}
+    }
+    if p.Endpoint.Port <= 0 || p.Endpoint.Port > 65535 {
+      return &ValidationError{Field: "Endpoint.Port", Reason: fmt.Sprintf("%v is out of range", p.Endpoint.Port)}
+    }
+  }
+  if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+    return &ValidationError{Field: "PersistentKeepalive", Reason: fmt.Sprintf("%v is out of range", p.PersistentKeepalive)}
+  }
+  return nil
+}
+
+func (e Endpoint) String() string {
+  return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// peerRecord is how a peer is persisted in the state store, the endpoint keys
+// and the weak typing keep configs of older versions loadable.
+type peerRecord struct {
+  PublicKey           string
+  AllowedIPs          []string
+  EndPointIp          string
+  EndPointPort        int
+  PersistentKeepalive int
+}
+
+func decodeConfig(raw interface{}, out interface{}) error {
+  d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+    WeaklyTypedInput: true,
+    Result:           out,
+  })
+  if err != nil {
+    return err
+  }
+  return d.Decode(raw)
+}
+
+func (e Env) loadIface(section string, out interface{}) error {
+  raw := map[string]interface{}{}
+  if err := e.get(section, &raw); err != nil {
+    return wrapError("config load", "", err)
+  }
+  return decodeConfig(raw, out)
+}
+
+func (e Env) loadPeers(section string) ([]Peer, error) {
+  raw := []interface{}{}
+  if err := e.get(section, &raw); err != nil {
+    return nil, wrapError("config load", "", err)
+  }
+  records := []peerRecord{}
+  if err := decodeConfig(raw, &records); err != nil {
+    return nil, err
+  }
+  peers := []Peer{}
+  for _, r := range records {
+    p := Peer{
+      PublicKey:           r.PublicKey,
+      AllowedIPs:          r.AllowedIPs,
+      PersistentKeepalive: r.PersistentKeepalive,
+    }
+    if r.EndPointIp != "" {
+      p.Endpoint = &Endpoint{Host: r.EndPointIp, Port: r.EndPointPort}
+    }
+    peers = append(peers, p)
+  }
+  return peers, nil
+}
+
+func (e Env) get(section string, v interface{}) error {
+  s, err := e.store()
+  if err != nil {
+    return err
+  }
+  _, err = s.Get(section, v)
+  return err
+}
+
+// saveSections persists the interface and peers of a backend together.
+func (e Env) saveSections(ifaceSection string, iface map[string]interface{}, peersSection string, peers []Peer) error {
+  records := []interface{}{}
+  for _, p := range peers {
+    record := map[string]interface{} {
+      "PublicKey":  p.PublicKey,
+      "AllowedIPs": p.AllowedIPs,
+    }
+    if p.Endpoint != nil {
+      record["EndPointIp"] = p.Endpoint.Host
+      record["EndPointPort"] = p.Endpoint.Port
+    }
+    if p.PersistentKeepalive != 0 {
+      record["PersistentKeepalive"] = p.PersistentKeepalive
+    }
+    records = append(records, record)
+  }
+  s, err := e.store()
+  if err != nil {
+    return wrapError("config save", "", err)
+  }
+  return wrapError("config save", "", s.Update(func(tx *state.Tx) error {
+    if err := tx.Put(ifaceSection, iface); err != nil {
+      return err
+    }
+    return tx.Put(peersSection, records)
+  }))
+}
+
+// putPeer adds the peer, or replaces the one with the same (normalized) key
+// so attaching again does not leave two sections of a key behind.
+func putPeer(peers []Peer, peer Peer) []Peer {
+  for i, p := range peers {
+    if p.PublicKey == peer.PublicKey {
+      peers[i] = peer
+      return peers
+    }
+  }
+  return append(peers, peer)
+}
+
+// delPeer removes the peer with the given (normalized) key, it reports
+// whether there was one.
+func delPeer(peers []Peer, publicKey string) ([]Peer, bool) {
+  for i, p := range peers {
+    if p.PublicKey == publicKey {
+      fmt.Println("Delete the following node:")
+      fmt.Printf("%v\n", p)
+      return append(peers[:i], peers[i+1:]...), true
+    }
+  }
+  return peers, false
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+  "errors"
+  "path"
+  "testing"
+
+  "github.com/GreysTone/tricarboxylic/state"
+)
+
+type mapSettings map[string]string
+
+func (m mapSettings) ReadString(key string) string {
+  return m[key]
+}
+
+func TestPeerValidate(t *testing.T) {
+  valid := Peer{PublicKey: "key", AllowedIPs: []string{"10.0.0.2/32"}}
+  if err := valid.Validate(); err != nil {
+    t.Errorf("Validate(%v) got error %v", valid, err)
+  }
+
+  cases := map[string]Peer{
+    "PublicKey":     {AllowedIPs: []string{"10.0.0.2/32"}},
+    "AllowedIPs":    {PublicKey: "key", AllowedIPs: []string{"10.0.0.2"}},
+    "Endpoint.Host": {PublicKey: "key", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: &Endpoint{Port: 10000}},
+    "Endpoint.Port": {PublicKey: "key", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: &Endpoint{Host: "1.2.3.4"}},
+  }
+  for field, in := range cases {
+    var vErr *ValidationError
+    if err := in.Validate(); !errors.As(err, &vErr) || vErr.Field != field {
+      t.Errorf("Validate(%v) = %v; expected invalid %v", in, err, field)
+    }
+  }
+}
+
+func TestInterfaceValidate(t *testing.T) {
+  in := Interface{Address: "10.0.0.1/24", ListenPort: 70000}
+  var vErr *ValidationError
+  if err := in.Validate(); !errors.As(err, &vErr) || vErr.Field != "ListenPort" {
+    t.Errorf("Validate(%v) = %v; expected invalid ListenPort", in, err)
+  }
+  in = Interface{Address: "10.0.0.1"}
+  if err := in.Validate(); !errors.As(err, &vErr) || vErr.Field != "Address" {
+    t.Errorf("Validate(%v) = %v; expected invalid Address", in, err)
+  }
+}
+
+func TestEndpointString(t *testing.T) {
+  for in, expected := range map[Endpoint]string{
+    {Host: "1.2.3.4", Port: 10000}: "1.2.3.4:10000",
+    {Host: "fd00::1", Port: 10000}: "[fd00::1]:10000",
+  } {
+    if actual := in.String(); actual != expected {
+      t.Errorf("String(%v) = %v; expected %v", in, actual, expected)
+    }
+  }
+}
+
+func TestEnv(t *testing.T) {
+  store, err := state.OpenIsolated(path.Join(t.TempDir(), state.FileName))
+  if err != nil {
+    t.Fatalf("state.OpenIsolated() got error %v", err)
+  }
+  defer store.Close()
+  env := Env{Store: store, Settings: mapSettings{ipsecSwanctlKey: "/tmp/swanctl"}}
+
+  v := NewBackend(TyWireGuard, env)
+  if err := v.NewKeyPair(); err != nil {
+    t.Fatalf("NewKeyPair() got error %v", err)
+  }
+  if err := v.NewInterface(Interface{ListenPort: 10001, Address: "10.0.0.1/24"}); err != nil {
+    t.Fatalf("NewInterface() got error %v", err)
+  }
+  if ok, err := store.Get("wg.iface", &map[string]interface{}{}); !ok || err != nil {
+    t.Errorf("Get(wg.iface) = %v, %v; expected the interface in the store of env", ok, err)
+  }
+  loaded := NewBackend(TyWireGuard, env)
+  if err := loaded.(Loader).Load(); err != nil || loaded.PublicKey() != v.PublicKey() {
+    t.Errorf("Load() = %v, key %v; expected %v", err, loaded.PublicKey(), v.PublicKey())
+  }
+
+  if dir := NewBackend(TyIPsec, env).(*IPsec).swanctlDir(); dir != "/tmp/swanctl" {
+    t.Errorf("swanctlDir() = %v; expected the setting of env", dir)
+  }
+}
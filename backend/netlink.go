@@ -0,0 +1,163 @@
+package backend
+
+import (
+  "fmt"
+  "net"
+  "time"
+
+  "github.com/vishvananda/netlink"
+  "golang.zx2c4.com/wireguard/wgctrl"
+  "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireGuardNetlink drives the kernel module directly, the link, addresses and
+// routes through rtnetlink and the device through the WireGuard generic
+// netlink API, so wireguard-tools are not needed and every failure comes back
+// as an *Error naming the step.
+type WireGuardNetlink struct {
+  WireGuard
+}
+
+func (v *WireGuardNetlink) Install(platform string) error {
+  fmt.Println("Nothing to install, only the wireguard kernel module is required")
+  return nil
+}
+
+func (v *WireGuardNetlink) UpInterface(i string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  name := IfaceName(i)
+  cfg, err := v.deviceConfig()
+  if err != nil {
+    return wrapError("configure device", name, err)
+  }
+
+  if _, err := netlink.LinkByName(name); err == nil {
+    return wrapError("link add", name, ErrInterfaceUp)
+  }
+  attrs := netlink.NewLinkAttrs()
+  attrs.Name = name
+  if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs}); err != nil {
+    return wrapError("link add", name, err)
+  }
+
+  client, err := wgctrl.New()
+  if err != nil {
+    v.delLink(name)
+    return wrapError("configure device", name, err)
+  }
+  defer client.Close()
+  if err := client.ConfigureDevice(name, cfg); err != nil {
+    v.delLink(name)
+    return wrapError("configure device", name, err)
+  }
+
+  if err := linkUp(name, v.IfaceSec, v.PeersSec); err != nil {
+    v.delLink(name)
+    return err
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, true)
+  return nil
+}
+
+func (v *WireGuardNetlink) DownInterface(i string) error {
+  name := IfaceName(i)
+  link, err := netlink.LinkByName(name)
+  if err != nil {
+    return wrapError("link del", name, ErrInterfaceNotUp)
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, false)
+  if err := netlink.LinkDel(link); err != nil {
+    return wrapError("link del", name, err)
+  }
+  return nil
+}
+
+func (v *WireGuardNetlink) SyncInterface(i string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  name := IfaceName(i)
+  cfg, err := v.deviceConfig()
+  if err != nil {
+    return wrapError("configure device", name, err)
+  }
+
+  client, err := wgctrl.New()
+  if err != nil {
+    return wrapError("configure device", name, err)
+  }
+  defer client.Close()
+  dev, err := client.Device(name)
+  if err != nil {
+    return wrapError("configure device", name, ErrInterfaceNotUp)
+  }
+
+  // keep key and port, replacing them or the whole peer list would drop
+  // the sessions of every peer, so only the peers which are gone are removed
+  wanted := map[wgtypes.Key]bool{}
+  for _, p := range cfg.Peers {
+    wanted[p.PublicKey] = true
+  }
+  sync := wgtypes.Config{Peers: cfg.Peers}
+  for _, p := range dev.Peers {
+    if !wanted[p.PublicKey] {
+      sync.Peers = append(sync.Peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+    }
+  }
+  if err := client.ConfigureDevice(name, sync); err != nil {
+    return wrapError("configure device", name, err)
+  }
+  return nil
+}
+
+func (v *WireGuardNetlink) delLink(name string) {
+  if link, err := netlink.LinkByName(name); err == nil {
+    netlink.LinkDel(link)
+  }
+}
+
+func (v *WireGuardNetlink) deviceConfig() (wgtypes.Config, error) {
+  prvKey, err := wgtypes.ParseKey(string(v.kp.privateKey))
+  if err != nil {
+    return wgtypes.Config{}, ErrInvalidKey
+  }
+  cfg := wgtypes.Config{
+    PrivateKey:   &prvKey,
+    ReplacePeers: true,
+  }
+  if v.IfaceSec.IsServer() {
+    port := v.IfaceSec.ListenPort
+    cfg.ListenPort = &port
+  }
+
+  for _, p := range v.PeersSec {
+    pubKey, err := wgtypes.ParseKey(p.PublicKey)
+    if err != nil {
+      return wgtypes.Config{}, ErrInvalidKey
+    }
+    peer := wgtypes.PeerConfig{
+      PublicKey:         pubKey,
+      ReplaceAllowedIPs: true,
+    }
+    for _, ip := range p.AllowedIPs {
+      _, ipNet, err := net.ParseCIDR(ip)
+      if err != nil {
+        return wgtypes.Config{}, fmt.Errorf("%w %v", ErrInvalidAddress, ip)
+      }
+      peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+    }
+    if p.Endpoint != nil {
+      endpoint, err := net.ResolveUDPAddr("udp", p.Endpoint.String())
+      if err != nil {
+        return wgtypes.Config{}, err
+      }
+      peer.Endpoint = endpoint
+    }
+    keepalive := time.Duration(p.PersistentKeepalive) * time.Second
+    peer.PersistentKeepaliveInterval = &keepalive
+    cfg.Peers = append(cfg.Peers, peer)
+  }
+  return cfg, nil
+}
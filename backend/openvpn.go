@@ -0,0 +1,601 @@
+package backend
+
+import (
+  "bufio"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "os"
+  "os/exec"
+  "path"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// OpenVPN gives every node a self-signed certificate and pins the peers by
+// certificate fingerprint (OpenVPN 2.6 peer-fingerprint), so the fingerprint
+// plays the role of the WireGuard public key in the attach flow.
+type OpenVPN struct {
+  env      Env
+  IfaceSec OpenVPNInterface
+  PeersSec []Peer
+}
+
+type OpenVPNInterface struct {
+  Interface   `mapstructure:",squash"`
+  Proto       string
+  Certificate string
+  PrivateKey  string
+}
+
+const (
+  ovpnProtoKey = "openvpn.proto"
+  ovpnPortKey  = "openvpn.port"
+
+  configOvpnServer = `mode server
+tls-server
+topology subnet
+proto RWTH_PROTO
+port RWTH_PORT
+ifconfig RWTH_IP RWTH_MASK
+push "topology subnet"
+push "route-gateway RWTH_IP"
+dh none
+keepalive 10 60
+`
+  configOvpnClient = `client
+proto RWTH_PROTO
+remote RWTH_SERVER_IP RWTH_PORT
+nobind
+keepalive 10 60
+`
+  // the server address of a peer is pushed by the client-connect script,
+  // the ccd files are named after the peer's fingerprint. A peer without
+  // one is refused, those connected leave their common name behind for
+  // SyncInterface to drop them.
+  scriptOvpnConnect = `#!/bin/sh
+fp=$(echo "$tls_digest_sha256_0" | tr -d ':' | tr 'a-f' 'A-F')
+[ -f "RWTH_CCD/$fp" ] || exit 1
+echo "$common_name" > "RWTH_CN/$fp"
+cat "RWTH_CCD/$fp" > "$1"
+`
+
+  // management commands wait that long for openvpn
+  ovpnManagementTimeout = 5 * time.Second
+)
+
+func (v *OpenVPN) Install(platform string) error {
+  switch platform {
+  case "ubuntu.x86":
+  if err := utils.StdIOCmd("sudo", "apt-get", "update"); err != nil {
+    return err
+  }
+  if err := utils.StdIOCmd("sudo", "apt-get", "install", "openvpn"); err != nil {
+    return err
+  }
+  default:
+    println("not implemented")
+  }
+  return nil
+}
+
+func (v *OpenVPN) Uninstall() error {
+  fmt.Println("Not implemented")
+  return nil
+}
+
+func (v *OpenVPN) NewKeyPair() error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+  serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+  template := x509.Certificate{
+    SerialNumber: serial,
+    // unique, SyncInterface drops a peer by its common name
+    Subject:      pkix.Name{CommonName: "tricarb-" + serial.Text(16)},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().AddDate(10, 0, 0),
+    KeyUsage:     x509.KeyUsageDigitalSignature,
+    ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+  }
+  der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+  if err != nil {
+    return wrapError("certificate create", "", err)
+  }
+  keyDer, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return wrapError("key generate", "", err)
+  }
+
+  v.IfaceSec.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+  v.IfaceSec.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+  return nil
+}
+
+func (v *OpenVPN) NewInterface(iface Interface) error {
+  certificate, privateKey := v.IfaceSec.Certificate, v.IfaceSec.PrivateKey
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  if certificate == "" {
+    return ErrEmptyKeyPair
+  }
+  if err := iface.Validate(); err != nil {
+    return wrapError("interface add", "", err)
+  }
+
+  v.IfaceSec = OpenVPNInterface{
+    Interface:   iface,
+    Proto:       "udp",
+    Certificate: certificate,
+    PrivateKey:  privateKey,
+  }
+  if proto := v.env.setting(ovpnProtoKey); proto != "" {
+    v.IfaceSec.Proto = proto
+  }
+  // e.g. tcp/443 to get through restrictive firewalls, which is outside of
+  // the port range tricarb picks from
+  if port := v.env.setting(ovpnPortKey); port != "" && v.IfaceSec.IsServer() {
+    p, err := strconv.Atoi(port)
+    if err != nil {
+      return wrapError("interface add", "", &ValidationError{Field: ovpnPortKey, Reason: fmt.Sprintf("%q is not a port", port)})
+    }
+    v.IfaceSec.ListenPort = p
+  }
+
+  return v.saveConfig()
+}
+
+func (v *OpenVPN) AddPeer(peer Peer) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  if err := peer.Validate(); err != nil {
+    return wrapError("peer add", "", err)
+  }
+  fp, err := parseFingerprint(peer.PublicKey)
+  if err != nil {
+    return wrapError("peer add", "", err)
+  }
+  peer.PublicKey = fp
+  v.PeersSec = putPeer(v.PeersSec, peer)
+
+  return v.saveConfig()
+}
+
+func (v *OpenVPN) DelPeer(publicKey string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  fp, err := parseFingerprint(publicKey)
+  if err != nil {
+    return wrapError("peer del", "", err)
+  }
+  v.PeersSec, _ = delPeer(v.PeersSec, fp)
+
+  return v.saveConfig()
+}
+
+func (v *OpenVPN) UpInterface(i string) error {
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  name := IfaceName(i)
+  if _, err := net.InterfaceByName(name); err == nil {
+    return wrapError("process start", name, ErrInterfaceUp)
+  }
+
+  args := []string{"--config", i, "--dev", name, "--dev-type", "tun", "--writepid", v.pidPath(i)}
+  if v.IfaceSec.IsServer() {
+    script, err := v.writeClientConnect(i)
+    if err != nil {
+      return wrapError("client-connect", name, err)
+    }
+    if err := v.writePinned(i); err != nil {
+      return wrapError("process start", name, err)
+    }
+    os.Remove(v.managementPath(i))
+    args = append(args, "--script-security", "2", "--client-connect", script,
+      "--management", v.managementPath(i), "unix")
+  }
+  cmd := exec.Command("openvpn", args...)
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+  if err := cmd.Start(); err != nil {
+    return wrapError("process start", name, err)
+  }
+  exited := make(chan error, 1)
+  go func() { exited <- cmd.Wait() }()
+
+  // a client only creates its tun device once the server pushed the address
+  for timeout := time.After(15 * time.Second); ; {
+    if _, err := net.InterfaceByName(name); err == nil {
+      break
+    }
+    select {
+    case err := <-exited:
+      return wrapError("process start", name, fmt.Errorf("openvpn exited: %v", err))
+    case <-timeout:
+      cmd.Process.Kill()
+      return wrapError("process start", name, errors.New("timeout waiting for the tun device"))
+    case <-time.After(200 * time.Millisecond):
+    }
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, true)
+  return nil
+}
+
+func (v *OpenVPN) DownInterface(i string) error {
+  name := IfaceName(i)
+  // the pid file still works when tricarbd was restarted in the meantime
+  pid, err := v.readPid(i)
+  if err != nil {
+    return wrapError("process stop", name, ErrInterfaceNotUp)
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, false)
+  if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+    return wrapError("process stop", name, err)
+  }
+  for retry := 0; retry < 50; retry++ {
+    if _, err := net.InterfaceByName(name); err != nil {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  os.Remove(v.pidPath(i))
+  return nil
+}
+
+// SyncInterface applies the peers to a running server without dropping the
+// sessions of the others. The client-connect script admits the peers, a
+// removed one is dropped through the management interface. OpenVPN only
+// reads the pinned fingerprints on start, so a peer the running instance
+// has never seen takes a reload (SIGHUP), after which the connected
+// clients reconnect on their own. So does a client, and a server started
+// before it had a management interface.
+func (v *OpenVPN) SyncInterface(i string) error {
+  name := IfaceName(i)
+  pid, err := v.readPid(i)
+  if err != nil {
+    return wrapError("process reload", name, ErrInterfaceNotUp)
+  }
+  if !v.IfaceSec.IsServer() {
+    return wrapError("process reload", name, syscall.Kill(pid, syscall.SIGHUP))
+  }
+  if _, err := v.writeClientConnect(i); err != nil {
+    return wrapError("client-connect", name, err)
+  }
+  if v.pinsPeers(i) {
+    if err := v.dropRemoved(i); err == nil {
+      return nil
+    }
+  }
+  if err := v.writePinned(i); err != nil {
+    return wrapError("process reload", name, err)
+  }
+  return wrapError("process reload", name, syscall.Kill(pid, syscall.SIGHUP))
+}
+
+// pinsPeers tells whether the running instance pinned every peer.
+func (v *OpenVPN) pinsPeers(i string) bool {
+  raw, err := ioutil.ReadFile(v.pinnedPath(i))
+  if err != nil {
+    return false
+  }
+  pinned := map[string]bool{}
+  for _, fp := range strings.Fields(string(raw)) {
+    pinned[fp] = true
+  }
+  for _, p := range v.PeersSec {
+    if !pinned[p.PublicKey] {
+      return false
+    }
+  }
+  return true
+}
+
+// writePinned records the fingerprints the instance about to (re)load pins.
+func (v *OpenVPN) writePinned(i string) error {
+  pinned := ""
+  for _, p := range v.PeersSec {
+    pinned += p.PublicKey + "\n"
+  }
+  return ioutil.WriteFile(v.pinnedPath(i), []byte(pinned), 0600)
+}
+
+// dropRemoved kills the sessions of the connected peers which were removed,
+// by the common name the client-connect script left behind.
+func (v *OpenVPN) dropRemoved(i string) error {
+  configured := map[string]bool{}
+  for _, p := range v.PeersSec {
+    configured[strings.Replace(p.PublicKey, ":", "", -1)] = true
+  }
+  files, err := ioutil.ReadDir(v.cnPath(i))
+  if err != nil {
+    return err
+  }
+  for _, f := range files {
+    if configured[f.Name()] {
+      continue
+    }
+    cn, err := ioutil.ReadFile(path.Join(v.cnPath(i), f.Name()))
+    if err != nil {
+      return err
+    }
+    if err := v.manage(i, "kill "+strings.TrimSpace(string(cn))); err != nil {
+      return err
+    }
+    os.Remove(path.Join(v.cnPath(i), f.Name()))
+  }
+  return nil
+}
+
+// manage runs one command on the management interface of the instance, a
+// kill of a client which is not connected is no error.
+func (v *OpenVPN) manage(i string, command string) error {
+  conn, err := net.DialTimeout("unix", v.managementPath(i), ovpnManagementTimeout)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(ovpnManagementTimeout))
+  if _, err := conn.Write([]byte(command + "\n")); err != nil {
+    return err
+  }
+  r := bufio.NewScanner(conn)
+  for r.Scan() {
+    line := r.Text()
+    switch {
+    case strings.HasPrefix(line, "SUCCESS:"):
+      return nil
+    case strings.HasPrefix(line, "ERROR:") && strings.Contains(line, "not found"):
+      return nil
+    case strings.HasPrefix(line, "ERROR:"):
+      return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+    }
+    // e.g. the >INFO: greeting
+  }
+  if err := r.Err(); err != nil {
+    return err
+  }
+  return errors.New("management interface closed")
+}
+
+func (v *OpenVPN) Config() (string, error) {
+  context := ""
+
+  rp := map[string]string{
+    "RWTH_PROTO": v.IfaceSec.Proto,
+    "RWTH_PORT":  strconv.Itoa(v.IfaceSec.ListenPort),
+  }
+  if v.IfaceSec.IsServer() {
+    ip, ipNet, err := net.ParseCIDR(v.IfaceSec.Address)
+    if err != nil {
+      return "", fmt.Errorf("%w %v", ErrInvalidAddress, v.IfaceSec.Address)
+    }
+    rp["RWTH_IP"] = ip.String()
+    rp["RWTH_MASK"] = net.IP(ipNet.Mask).String()
+    if v.IfaceSec.Proto == "tcp" {
+      rp["RWTH_PROTO"] = "tcp-server"
+    }
+    serverText, err := utils.MakeText(configOvpnServer, rp)
+    if err != nil {
+      return "", err
+    }
+    context += serverText
+  } else {
+    for _, p := range v.PeersSec {
+      if p.Endpoint == nil {
+        continue
+      }
+      rp["RWTH_SERVER_IP"] = p.Endpoint.Host
+      rp["RWTH_PORT"] = strconv.Itoa(p.Endpoint.Port)
+    }
+    if v.IfaceSec.Proto == "tcp" {
+      rp["RWTH_PROTO"] = "tcp-client"
+    }
+    clientText, err := utils.MakeText(configOvpnClient, rp)
+    if err != nil {
+      return "", err
+    }
+    context += clientText
+  }
+
+  context += "<cert>\n" + v.IfaceSec.Certificate + "</cert>\n"
+  context += "<key>\n" + v.IfaceSec.PrivateKey + "</key>\n"
+  context += "<peer-fingerprint>\n"
+  for _, p := range v.PeersSec {
+    context += p.PublicKey + "\n"
+  }
+  if len(v.PeersSec) == 0 {
+    // openvpn refuses an empty list, nobody but this node holds its own key
+    context += v.PublicKey() + "\n"
+  }
+  context += "</peer-fingerprint>\n"
+
+  return context, nil
+}
+
+func (v *OpenVPN) Interface() Interface {
+  return v.IfaceSec.Interface
+}
+
+func (v *OpenVPN) Peers() []Peer {
+  return v.PeersSec
+}
+
+// Capabilities has no live peer update, a new peer takes a reload, see
+// SyncInterface. OpenVPN 2.6 moves the tunnel into its DCO kernel module
+// where one is loaded, so it is not userspace.
+func (v *OpenVPN) Capabilities() Capabilities {
+  return Capabilities{Protocol: ProtoOpenVPN}
+}
+
+// PublicKey is the SHA256 fingerprint of the node's certificate.
+func (v *OpenVPN) PublicKey() string {
+  block, _ := pem.Decode([]byte(v.IfaceSec.Certificate))
+  if block == nil {
+    return ""
+  }
+  return fingerprint(block.Bytes)
+}
+
+func (v *OpenVPN) pidPath(i string) string {
+  return path.Join(path.Dir(i), IfaceName(i)+".pid")
+}
+
+func (v *OpenVPN) managementPath(i string) string {
+  return path.Join(path.Dir(i), IfaceName(i)+".mgmt")
+}
+
+func (v *OpenVPN) pinnedPath(i string) string {
+  return path.Join(path.Dir(i), IfaceName(i)+".pinned")
+}
+
+// cnPath holds the common name of each connected peer, by fingerprint.
+func (v *OpenVPN) cnPath(i string) string {
+  return path.Join(path.Dir(i), IfaceName(i)+".cn")
+}
+
+func (v *OpenVPN) readPid(i string) (int, error) {
+  raw, err := ioutil.ReadFile(v.pidPath(i))
+  if err != nil {
+    return 0, err
+  }
+  return strconv.Atoi(strings.TrimSpace(string(raw)))
+}
+
+// writeClientConnect renders the ccd entry of every peer and the script
+// pushing it, it returns the path of the script.
+func (v *OpenVPN) writeClientConnect(i string) (string, error) {
+  ccd := path.Join(path.Dir(i), IfaceName(i)+".ccd")
+  if err := os.RemoveAll(ccd); err != nil {
+    return "", err
+  }
+  if err := os.MkdirAll(ccd, 0700); err != nil {
+    return "", err
+  }
+  _, ipNet, err := net.ParseCIDR(v.IfaceSec.Address)
+  if err != nil {
+    return "", fmt.Errorf("%w %v", ErrInvalidAddress, v.IfaceSec.Address)
+  }
+  for _, p := range v.PeersSec {
+    // the first allowed ip is the tunnel address of the client
+    ip, _, err := net.ParseCIDR(p.AllowedIPs[0])
+    if err != nil {
+      return "", fmt.Errorf("%w %v", ErrInvalidAddress, p.AllowedIPs[0])
+    }
+    entry := "ifconfig-push " + ip.String() + " " + net.IP(ipNet.Mask).String() + "\n"
+    name := strings.Replace(p.PublicKey, ":", "", -1)
+    if err := ioutil.WriteFile(path.Join(ccd, name), []byte(entry), 0600); err != nil {
+      return "", err
+    }
+  }
+
+  // kept across rewrites, the peers in it are connected
+  if err := os.MkdirAll(v.cnPath(i), 0700); err != nil {
+    return "", err
+  }
+
+  script := path.Join(path.Dir(i), IfaceName(i)+"-connect.sh")
+  text, err := utils.MakeText(scriptOvpnConnect, map[string]string{"RWTH_CCD": ccd, "RWTH_CN": v.cnPath(i)})
+  if err != nil {
+    return "", err
+  }
+  if err := ioutil.WriteFile(script, []byte(text), 0700); err != nil {
+    return "", err
+  }
+  return script, nil
+}
+
+func (v *OpenVPN) Load() error {
+  return v.loadConfig()
+}
+
+type ovpnSnapshot struct {
+  iface OpenVPNInterface
+  peers []Peer
+}
+
+func (v *OpenVPN) Snapshot() (Snapshot, error) {
+  if err := v.loadConfig(); err != nil {
+    return nil, err
+  }
+  return ovpnSnapshot{iface: v.IfaceSec, peers: append([]Peer{}, v.PeersSec...)}, nil
+}
+
+func (v *OpenVPN) Restore(s Snapshot) error {
+  snap, ok := s.(ovpnSnapshot)
+  if !ok {
+    return wrapError("restore", "", ErrSnapshot)
+  }
+  v.IfaceSec, v.PeersSec = snap.iface, append([]Peer{}, snap.peers...)
+  return v.saveConfig()
+}
+
+func (v *OpenVPN) loadConfig() error {
+  if err := v.env.loadIface("ovpn.iface", &v.IfaceSec); err != nil {
+    return err
+  }
+  peers, err := v.env.loadPeers("ovpn.peers")
+  if err != nil {
+    return err
+  }
+  v.PeersSec = peers
+  return nil
+}
+
+func (v *OpenVPN) saveConfig() error {
+  iface := map[string]interface{} {
+    "ListenPort":  v.IfaceSec.ListenPort,
+    "Address":     v.IfaceSec.Address,
+    "LocalEth":    v.IfaceSec.LocalEth,
+    "Proto":       v.IfaceSec.Proto,
+    "Certificate": v.IfaceSec.Certificate,
+    "PrivateKey":  v.IfaceSec.PrivateKey,
+  }
+  return v.env.saveSections("ovpn.iface", iface, "ovpn.peers", v.PeersSec)
+}
+
+func fingerprint(der []byte) string {
+  sum := sha256.Sum256(der)
+  return formatFingerprint(sum[:])
+}
+
+func parseFingerprint(s string) (string, error) {
+  raw, err := hex.DecodeString(strings.Replace(strings.TrimSpace(s), ":", "", -1))
+  if err != nil || len(raw) != sha256.Size {
+    return "", fmt.Errorf("%w %q", ErrInvalidKey, s)
+  }
+  return formatFingerprint(raw), nil
+}
+
+// formatFingerprint prints the digest the way openvpn does, AB:CD:...
+func formatFingerprint(raw []byte) string {
+  parts := make([]string, len(raw))
+  for i := range raw {
+    parts[i] = strings.ToUpper(hex.EncodeToString(raw[i:i+1]))
+  }
+  return strings.Join(parts, ":")
+}
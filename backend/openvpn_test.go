@@ -0,0 +1,95 @@
+package backend
+
+import (
+  "bufio"
+  "bytes"
+  "io/ioutil"
+  "net"
+  "os"
+  "os/exec"
+  "path"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+// runningOpenVPN stands in for openvpn, a process which a SIGHUP ends.
+func runningOpenVPN(t *testing.T, v *OpenVPN, i string) chan error {
+  cmd := exec.Command("sleep", "30")
+  if err := cmd.Start(); err != nil {
+    t.Skipf("no sleep to stand in for openvpn: %v", err)
+  }
+  t.Cleanup(func() { cmd.Process.Kill() })
+  exited := make(chan error, 1)
+  go func() { exited <- cmd.Wait() }()
+  if err := ioutil.WriteFile(v.pidPath(i), []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+    t.Fatalf("writing the pid file got error %v", err)
+  }
+  return exited
+}
+
+// fakeManagement answers one command on the management socket.
+func fakeManagement(t *testing.T, v *OpenVPN, i string) chan string {
+  lis, err := net.Listen("unix", v.managementPath(i))
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  t.Cleanup(func() { lis.Close() })
+  commands := make(chan string, 1)
+  go func() {
+    conn, err := lis.Accept()
+    if err != nil {
+      return
+    }
+    defer conn.Close()
+    conn.Write([]byte(">INFO:OpenVPN Management Interface Version 5\r\n"))
+    line, _ := bufio.NewReader(conn).ReadString('\n')
+    commands <- strings.TrimSpace(line)
+    conn.Write([]byte("SUCCESS: common name found, 1 client(s) killed\r\n"))
+  }()
+  return commands
+}
+
+func TestOpenVPNSyncInterface(t *testing.T) {
+  i := path.Join(t.TempDir(), "tun0.conf")
+  kept := formatFingerprint(bytes.Repeat([]byte{0xab}, 32))
+  removed := formatFingerprint(bytes.Repeat([]byte{0xcd}, 32))
+  v := &OpenVPN{
+    IfaceSec: OpenVPNInterface{Interface: Interface{ListenPort: 1194, Address: "10.0.0.1/24"}},
+    PeersSec: []Peer{{PublicKey: kept, AllowedIPs: []string{"10.0.0.2/32"}}},
+  }
+  exited := runningOpenVPN(t, v, i)
+  ioutil.WriteFile(v.pinnedPath(i), []byte(kept+"\n"+removed+"\n"), 0600)
+  os.MkdirAll(v.cnPath(i), 0700)
+  ioutil.WriteFile(path.Join(v.cnPath(i), strings.Replace(removed, ":", "", -1)), []byte("tricarb-cd\n"), 0600)
+
+  // the removed peer is dropped, the others keep their sessions
+  commands := fakeManagement(t, v, i)
+  if err := v.SyncInterface(i); err != nil {
+    t.Fatalf("SyncInterface() got error %v", err)
+  }
+  if command := <-commands; command != "kill tricarb-cd" {
+    t.Errorf("SyncInterface() sent %q; expected kill tricarb-cd", command)
+  }
+  select {
+  case <-exited:
+    t.Fatalf("SyncInterface() of a removed peer reloaded openvpn")
+  case <-time.After(100 * time.Millisecond):
+  }
+
+  // a peer it has never seen takes a reload
+  added := formatFingerprint(bytes.Repeat([]byte{0xef}, 32))
+  v.PeersSec = append(v.PeersSec, Peer{PublicKey: added, AllowedIPs: []string{"10.0.0.3/32"}})
+  if err := v.SyncInterface(i); err != nil {
+    t.Fatalf("SyncInterface() got error %v", err)
+  }
+  select {
+  case <-exited:
+  case <-time.After(5 * time.Second):
+    t.Errorf("SyncInterface() of a new peer did not reload openvpn")
+  }
+  if !v.pinsPeers(i) {
+    t.Errorf("after reload: the new peer is not recorded as pinned")
+  }
+}
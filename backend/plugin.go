@@ -0,0 +1,438 @@
+package backend
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "os/exec"
+  "path"
+  "strings"
+  "time"
+
+  "google.golang.org/grpc"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+const (
+  PluginProtocolVersion = 3
+
+  pluginDirKey     = "plugin.dir"
+  defaultPluginDir = "/usr/lib/tricarb/plugins"
+  pluginPrefix     = "tricarb-backend-"
+  pluginSocketEnv  = "TRICARB_PLUGIN_SOCKET"
+
+  pluginTimeout     = 10 * time.Second
+  pluginLongTimeout = 2 * time.Minute
+)
+
+var (
+  ErrPluginNotFound = errors.New("plugin not found")
+  ErrPluginVersion  = errors.New("plugin protocol version mismatch")
+)
+
+// Plugin forwards every call to a backend executable found in the plugin
+// directory, e.g. backend "foo" is served by tricarb-backend-foo. tricarbd
+// starts the executable with TRICARB_PLUGIN_SOCKET set to a unix socket
+// path, the plugin serves the TricarbPlugin gRPC service there.
+type Plugin struct {
+  name string
+  // dir holds the socket
+  dir  string
+  cmd  *exec.Cmd
+  conn *grpc.ClientConn
+  c    pb.TricarbPluginClient
+  log  Logger
+}
+
+// Plugins lists the backends served by the executables in the plugin
+// directory of env, a missing directory has none.
+func Plugins(env Env) ([]string, error) {
+  dir := pluginDir(env)
+  entries, err := ioutil.ReadDir(dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  plugins := []string{}
+  for _, entry := range entries {
+    ty := strings.TrimPrefix(entry.Name(), pluginPrefix)
+    if ty == entry.Name() || ty == "" {
+      continue
+    }
+    // the same check as NewPlugin, links are followed
+    if info, err := os.Stat(path.Join(dir, entry.Name())); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+      continue
+    }
+    plugins = append(plugins, ty)
+  }
+  return plugins, nil
+}
+
+func pluginDir(env Env) string {
+  if dir := env.setting(pluginDirKey); dir != "" {
+    return dir
+  }
+  return defaultPluginDir
+}
+
+// NewPlugin starts the plugin serving backend ty and checks its protocol
+// version, the plugin keeps its state itself and only the settings and the
+// logger of env are used.
+func NewPlugin(ty string, env Env) (*Plugin, error) {
+  bin := path.Join(pluginDir(env), pluginPrefix+ty)
+  if info, err := os.Stat(bin); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+    return nil, fmt.Errorf("%w: %v", ErrPluginNotFound, bin)
+  }
+
+  // a fresh directory only tricarbd may enter, nobody else can bind the
+  // socket before the plugin does
+  dir, err := ioutil.TempDir("", pluginPrefix+ty+"-")
+  if err != nil {
+    return nil, wrapError("plugin start", ty, err)
+  }
+  sock := path.Join(dir, "plugin.sock")
+  cmd := exec.Command(bin)
+  cmd.Env = append(os.Environ(), pluginSocketEnv+"="+sock)
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+  if err := cmd.Start(); err != nil {
+    os.RemoveAll(dir)
+    return nil, wrapError("plugin start", ty, err)
+  }
+  go cmd.Wait()
+
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  conn, err := grpc.DialContext(ctx, sock, grpc.WithInsecure(), grpc.WithBlock(),
+    grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+      return dialPlugin(ctx, addr, cmd.Process.Pid)
+    }))
+  if err != nil {
+    cmd.Process.Kill()
+    os.RemoveAll(dir)
+    return nil, wrapError("plugin connect", ty, err)
+  }
+  p := &Plugin{name: ty, dir: dir, cmd: cmd, conn: conn, c: pb.NewTricarbPluginClient(conn), log: env.logger()}
+
+  r, err := p.c.Handshake(ctx, &pb.HandshakeRequest{Version: PluginProtocolVersion})
+  if err != nil {
+    p.Close()
+    return nil, wrapError("plugin handshake", ty, err)
+  }
+  if r.GetVersion() != PluginProtocolVersion {
+    p.Close()
+    return nil, wrapError("plugin handshake", ty,
+      fmt.Errorf("%w: %v speaks %v, tricarbd %v", ErrPluginVersion, r.GetName(), r.GetVersion(), PluginProtocolVersion))
+  }
+  return p, nil
+}
+
+// Close stops the plugin process.
+func (p *Plugin) Close() error {
+  p.conn.Close()
+  defer os.RemoveAll(p.dir)
+  return p.cmd.Process.Kill()
+}
+
+// dialPlugin connects to the socket of the plugin, the process on the other
+// end has to be the one tricarbd started: it gets the private keys.
+func dialPlugin(ctx context.Context, sock string, pid int) (net.Conn, error) {
+  var d net.Dialer
+  conn, err := d.DialContext(ctx, "unix", sock)
+  if err != nil {
+    return nil, err
+  }
+  cred, err := utils.PeerCred(conn)
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  if int(cred.Pid) != pid {
+    conn.Close()
+    return nil, fmt.Errorf("socket served by pid %v, expected the plugin's %v", cred.Pid, pid)
+  }
+  return conn, nil
+}
+
+func (p *Plugin) Install(platform string) error {
+  return p.call(p.c.Install, &pb.PluginRequest{Arg: platform}, pluginLongTimeout)
+}
+
+func (p *Plugin) Uninstall() error {
+  return p.call(p.c.Uninstall, &pb.PluginRequest{}, pluginLongTimeout)
+}
+
+func (p *Plugin) NewKeyPair() error {
+  return p.call(p.c.NewKeyPair, &pb.PluginRequest{}, pluginTimeout)
+}
+
+func (p *Plugin) NewInterface(iface Interface) error {
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  r, err := p.c.NewInterface(ctx, toPluginInterface(iface))
+  if err != nil {
+    return wrapError("plugin call", p.name, err)
+  }
+  return pluginError(r)
+}
+
+func (p *Plugin) AddPeer(peer Peer) error {
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  r, err := p.c.AddPeer(ctx, toPluginPeer(peer))
+  if err != nil {
+    return wrapError("plugin call", p.name, err)
+  }
+  return pluginError(r)
+}
+
+func (p *Plugin) DelPeer(publicKey string) error {
+  return p.call(p.c.DelPeer, &pb.PluginRequest{Arg: publicKey}, pluginTimeout)
+}
+
+func (p *Plugin) UpInterface(i string) error {
+  return p.call(p.c.UpInterface, &pb.PluginRequest{Arg: i}, pluginLongTimeout)
+}
+
+func (p *Plugin) DownInterface(i string) error {
+  return p.call(p.c.DownInterface, &pb.PluginRequest{Arg: i}, pluginLongTimeout)
+}
+
+func (p *Plugin) SyncInterface(i string) error {
+  return p.call(p.c.SyncInterface, &pb.PluginRequest{Arg: i}, pluginLongTimeout)
+}
+
+func (p *Plugin) Config() (string, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  r, err := p.c.Config(ctx, &pb.PluginRequest{})
+  if err != nil {
+    return "", wrapError("plugin call", p.name, err)
+  }
+  if err := pluginError(r); err != nil {
+    return "", err
+  }
+  return r.GetText(), nil
+}
+
+func (p *Plugin) Interface() Interface {
+  return fromPluginInterface(p.info().GetIface())
+}
+
+func (p *Plugin) Peers() []Peer {
+  peers := []Peer{}
+  for _, peer := range p.info().GetPeers() {
+    peers = append(peers, fromPluginPeer(peer))
+  }
+  return peers
+}
+
+// Capabilities is empty if the plugin failed.
+func (p *Plugin) Capabilities() Capabilities {
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  r, err := p.c.Capabilities(ctx, &pb.PluginRequest{})
+  if err != nil {
+    p.log.Printf("warning: plugin %v: %v\n", p.name, err)
+    return Capabilities{}
+  }
+  return Capabilities{
+    Protocol:       r.GetProtocol(),
+    IPv6:           r.GetIpv6(),
+    PresharedKey:   r.GetPresharedKey(),
+    LivePeerUpdate: r.GetLivePeerUpdate(),
+    L2:             r.GetL2(),
+    Userspace:      r.GetUserspace(),
+  }
+}
+
+func (p *Plugin) PublicKey() string {
+  return p.info().GetPublicKey()
+}
+
+// info returns an empty PluginInfo if the plugin failed, like the built-in
+// backends do before they were configured.
+func (p *Plugin) info() *pb.PluginInfo {
+  ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+  defer cancel()
+  r, err := p.c.Info(ctx, &pb.PluginRequest{})
+  if err != nil {
+    p.log.Printf("warning: plugin %v: %v\n", p.name, err)
+    return &pb.PluginInfo{}
+  }
+  return r
+}
+
+func (p *Plugin) call(
+  rpc func(context.Context, *pb.PluginRequest, ...grpc.CallOption) (*pb.PluginReply, error),
+  in *pb.PluginRequest, timeout time.Duration) error {
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  r, err := rpc(ctx, in)
+  if err != nil {
+    return wrapError("plugin call", p.name, err)
+  }
+  return pluginError(r)
+}
+
+func pluginError(r *pb.PluginReply) error {
+  if r.GetError() == "" {
+    return nil
+  }
+  if r.GetOp() != "" {
+    return &Error{Op: r.GetOp(), Iface: r.GetIface(), Err: errors.New(r.GetError())}
+  }
+  return errors.New(r.GetError())
+}
+
+// ServePlugin is the entry point of a plugin written in Go, it serves impl
+// on the socket tricarbd passed in and only returns on failure.
+func ServePlugin(name string, impl VpnBackend) error {
+  sock := os.Getenv(pluginSocketEnv)
+  if sock == "" {
+    return errors.New(pluginSocketEnv + " not set, plugins are started by tricarbd")
+  }
+  lis, err := net.Listen("unix", sock)
+  if err != nil {
+    return err
+  }
+  defer os.Remove(sock)
+  s := grpc.NewServer()
+  pb.RegisterTricarbPluginServer(s, &pluginServer{name: name, impl: impl})
+  return s.Serve(lis)
+}
+
+type pluginServer struct {
+  pb.UnimplementedTricarbPluginServer
+  name string
+  impl VpnBackend
+}
+
+func (s *pluginServer) Handshake(ctx context.Context, in *pb.HandshakeRequest) (*pb.HandshakeReply, error) {
+  return &pb.HandshakeReply{Version: PluginProtocolVersion, Name: s.name}, nil
+}
+
+func (s *pluginServer) Install(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.Install(in.GetArg())), nil
+}
+
+func (s *pluginServer) Uninstall(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.Uninstall()), nil
+}
+
+func (s *pluginServer) NewKeyPair(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.NewKeyPair()), nil
+}
+
+func (s *pluginServer) NewInterface(ctx context.Context, in *pb.PluginInterface) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.NewInterface(fromPluginInterface(in))), nil
+}
+
+func (s *pluginServer) AddPeer(ctx context.Context, in *pb.PluginPeer) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.AddPeer(fromPluginPeer(in))), nil
+}
+
+func (s *pluginServer) DelPeer(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.DelPeer(in.GetArg())), nil
+}
+
+func (s *pluginServer) UpInterface(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.UpInterface(in.GetArg())), nil
+}
+
+func (s *pluginServer) DownInterface(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.DownInterface(in.GetArg())), nil
+}
+
+func (s *pluginServer) SyncInterface(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  return pluginReply(s.impl.SyncInterface(in.GetArg())), nil
+}
+
+func (s *pluginServer) Config(ctx context.Context, in *pb.PluginRequest) (*pb.PluginReply, error) {
+  conf, err := s.impl.Config()
+  r := pluginReply(err)
+  r.Text = conf
+  return r, nil
+}
+
+func (s *pluginServer) Info(ctx context.Context, in *pb.PluginRequest) (*pb.PluginInfo, error) {
+  info := &pb.PluginInfo{
+    Iface:     toPluginInterface(s.impl.Interface()),
+    PublicKey: s.impl.PublicKey(),
+  }
+  for _, p := range s.impl.Peers() {
+    info.Peers = append(info.Peers, toPluginPeer(p))
+  }
+  return info, nil
+}
+
+func (s *pluginServer) Capabilities(ctx context.Context, in *pb.PluginRequest) (*pb.PluginCapabilities, error) {
+  c := s.impl.Capabilities()
+  return &pb.PluginCapabilities{
+    Protocol:       c.Protocol,
+    Ipv6:           c.IPv6,
+    PresharedKey:   c.PresharedKey,
+    LivePeerUpdate: c.LivePeerUpdate,
+    L2:             c.L2,
+    Userspace:      c.Userspace,
+  }, nil
+}
+
+func toPluginInterface(iface Interface) *pb.PluginInterface {
+  return &pb.PluginInterface{
+    ListenPort: int32(iface.ListenPort),
+    Address:    iface.Address,
+    LocalEth:   iface.LocalEth,
+  }
+}
+
+func fromPluginInterface(iface *pb.PluginInterface) Interface {
+  return Interface{
+    ListenPort: int(iface.GetListenPort()),
+    Address:    iface.GetAddress(),
+    LocalEth:   iface.GetLocalEth(),
+  }
+}
+
+func toPluginPeer(p Peer) *pb.PluginPeer {
+  peer := &pb.PluginPeer{
+    PublicKey:           p.PublicKey,
+    AllowedIps:          p.AllowedIPs,
+    PersistentKeepalive: int32(p.PersistentKeepalive),
+  }
+  if p.Endpoint != nil {
+    peer.EndPointHost = p.Endpoint.Host
+    peer.EndPointPort = int32(p.Endpoint.Port)
+  }
+  return peer
+}
+
+func fromPluginPeer(p *pb.PluginPeer) Peer {
+  peer := Peer{
+    PublicKey:           p.GetPublicKey(),
+    AllowedIPs:          p.GetAllowedIps(),
+    PersistentKeepalive: int(p.GetPersistentKeepalive()),
+  }
+  if p.GetEndPointHost() != "" {
+    peer.Endpoint = &Endpoint{Host: p.GetEndPointHost(), Port: int(p.GetEndPointPort())}
+  }
+  return peer
+}
+
+func pluginReply(err error) *pb.PluginReply {
+  if err == nil {
+    return &pb.PluginReply{}
+  }
+  var beErr *Error
+  if errors.As(err, &beErr) {
+    return &pb.PluginReply{Error: beErr.Err.Error(), Op: beErr.Op, Iface: beErr.Iface}
+  }
+  return &pb.PluginReply{Error: err.Error()}
+}
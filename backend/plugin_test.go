@@ -0,0 +1,67 @@
+package backend
+
+import (
+  "context"
+  "io/ioutil"
+  "net"
+  "os"
+  "path"
+  "reflect"
+  "testing"
+)
+
+func TestDialPluginChecksPid(t *testing.T) {
+  sock := path.Join(t.TempDir(), "plugin.sock")
+  lis, err := net.Listen("unix", sock)
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  defer lis.Close()
+  go func() {
+    for {
+      conn, err := lis.Accept()
+      if err != nil {
+        return
+      }
+      defer conn.Close()
+    }
+  }()
+
+  // this process serves the socket, not the plugin
+  if conn, err := dialPlugin(context.Background(), sock, os.Getpid()+1); err == nil {
+    conn.Close()
+    t.Errorf("dialPlugin() of a socket served by another process succeeded")
+  }
+  conn, err := dialPlugin(context.Background(), sock, os.Getpid())
+  if err != nil {
+    t.Fatalf("dialPlugin() got error %v", err)
+  }
+  conn.Close()
+}
+
+func TestPlugins(t *testing.T) {
+  dir := t.TempDir()
+  for name, mode := range map[string]os.FileMode{
+    "tricarb-backend-foo": 0755,
+    "tricarb-backend-bar": 0755,
+    "tricarb-backend-doc": 0644,
+    "tricarb-backend-":    0755,
+    "other":               0755,
+  } {
+    if err := ioutil.WriteFile(path.Join(dir, name), nil, mode); err != nil {
+      t.Fatalf("WriteFile(%v) got error %v", name, err)
+    }
+  }
+  if err := os.Mkdir(path.Join(dir, "tricarb-backend-dir"), 0755); err != nil {
+    t.Fatalf("Mkdir() got error %v", err)
+  }
+
+  plugins, err := Plugins(Env{Settings: mapSettings{pluginDirKey: dir}})
+  if err != nil || !reflect.DeepEqual(plugins, []string{"bar", "foo"}) {
+    t.Errorf("Plugins() = %v, %v; expected [bar foo]", plugins, err)
+  }
+  plugins, err = Plugins(Env{Settings: mapSettings{pluginDirKey: path.Join(dir, "missing")}})
+  if err != nil || len(plugins) != 0 {
+    t.Errorf("Plugins() of a missing directory = %v, %v; expected none", plugins, err)
+  }
+}
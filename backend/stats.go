@@ -0,0 +1,238 @@
+package backend
+
+import (
+  "bufio"
+  "encoding/hex"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.zx2c4.com/wireguard/wgctrl"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// PeerStat is what a running interface knows about a peer, LastHandshake is
+// zero if the peer never completed a handshake.
+type PeerStat struct {
+  PublicKey     string
+  AllowedIPs    []string
+  LastHandshake time.Time
+  RxBytes       int64
+  TxBytes       int64
+}
+
+// Device is the live state of a running interface, as opposed to the
+// interface and peers kept in the state store.
+type Device struct {
+  PublicKey  string
+  ListenPort int
+  Peers      []PeerStat
+}
+
+// StatsReporter is implemented by backends which can tell when the peers of
+// a running interface last completed a handshake, the daemon only drops
+// stale peers of those.
+type StatsReporter interface {
+  PeerStats(i string) ([]PeerStat, error)
+}
+
+// Inspector is implemented by backends which can read the live state of a
+// running interface, the daemon repairs what differs from the state store.
+type Inspector interface {
+  Inspect(i string) (Device, error)
+}
+
+func (v *WireGuard) Inspect(i string) (Device, error) {
+  out, err := utils.OutputCmd("wg", "show", IfaceName(i), "dump")
+  if err != nil {
+    return Device{}, wrapError("show", IfaceName(i), err)
+  }
+  dev, err := parseDump(string(out))
+  return dev, wrapError("show", IfaceName(i), err)
+}
+
+func (v *WireGuard) PeerStats(i string) ([]PeerStat, error) {
+  dev, err := v.Inspect(i)
+  return dev.Peers, err
+}
+
+func (v *WireGuardNetlink) Inspect(i string) (Device, error) {
+  name := IfaceName(i)
+  client, err := wgctrl.New()
+  if err != nil {
+    return Device{}, wrapError("show", name, err)
+  }
+  defer client.Close()
+  dev, err := client.Device(name)
+  if err != nil {
+    return Device{}, wrapError("show", name, ErrInterfaceNotUp)
+  }
+  live := Device{PublicKey: dev.PublicKey.String(), ListenPort: dev.ListenPort, Peers: []PeerStat{}}
+  for _, p := range dev.Peers {
+    stat := PeerStat{
+      PublicKey:     p.PublicKey.String(),
+      LastHandshake: p.LastHandshakeTime,
+      RxBytes:       p.ReceiveBytes,
+      TxBytes:       p.TransmitBytes,
+    }
+    for _, ip := range p.AllowedIPs {
+      stat.AllowedIPs = append(stat.AllowedIPs, ip.String())
+    }
+    live.Peers = append(live.Peers, stat)
+  }
+  return live, nil
+}
+
+func (v *WireGuardNetlink) PeerStats(i string) ([]PeerStat, error) {
+  dev, err := v.Inspect(i)
+  return dev.Peers, err
+}
+
+func (v *WireGuardUserspace) Inspect(i string) (Device, error) {
+  if v.dev == nil {
+    return Device{}, wrapError("show", IfaceName(i), ErrInterfaceNotUp)
+  }
+  uapi, err := v.dev.IpcGet()
+  if err != nil {
+    return Device{}, wrapError("show", IfaceName(i), err)
+  }
+  dev, err := parseUAPIDevice(uapi)
+  return dev, wrapError("show", IfaceName(i), err)
+}
+
+func (v *WireGuardUserspace) PeerStats(i string) ([]PeerStat, error) {
+  dev, err := v.Inspect(i)
+  return dev.Peers, err
+}
+
+// parseDump reads `wg show <interface> dump`, the first line is the
+// interface: private key, public key, port and fwmark. Every other one is a
+// peer: public key, preshared key, endpoint, allowed ips, latest handshake,
+// rx and tx bytes and keepalive.
+func parseDump(dump string) (Device, error) {
+  dev := Device{Peers: []PeerStat{}}
+  scanner := bufio.NewScanner(strings.NewReader(dump))
+  for first := true; scanner.Scan(); first = false {
+    fields := strings.Split(scanner.Text(), "\t")
+    if first {
+      if len(fields) < 4 {
+        return Device{}, fmt.Errorf("invalid interface line %q", scanner.Text())
+      }
+      dev.PublicKey = fields[1]
+      port, err := strconv.Atoi(fields[2])
+      if err != nil {
+        return Device{}, err
+      }
+      dev.ListenPort = port
+      continue
+    }
+    if len(fields) < 8 {
+      return Device{}, fmt.Errorf("invalid peer line %q", scanner.Text())
+    }
+    key, err := ParseKey(fields[0])
+    if err != nil {
+      return Device{}, err
+    }
+    stat := PeerStat{PublicKey: key.String()}
+    if fields[3] != "(none)" {
+      stat.AllowedIPs = strings.Split(fields[3], ",")
+    }
+    var handshake int64
+    for _, f := range []struct {
+      s string
+      n *int64
+    }{{fields[4], &handshake}, {fields[5], &stat.RxBytes}, {fields[6], &stat.TxBytes}} {
+      if *f.n, err = strconv.ParseInt(f.s, 10, 64); err != nil {
+        return Device{}, err
+      }
+    }
+    if handshake != 0 {
+      stat.LastHandshake = time.Unix(handshake, 0)
+    }
+    dev.Peers = append(dev.Peers, stat)
+  }
+  return dev, scanner.Err()
+}
+
+// parseUAPIDevice reads a get in the userspace API format, the interface
+// comes first and each peer starts with its public key, keys are hex.
+func parseUAPIDevice(uapi string) (Device, error) {
+  dev := Device{Peers: []PeerStat{}}
+  var sec, nsec int64
+  flush := func() {
+    if len(dev.Peers) != 0 && (sec != 0 || nsec != 0) {
+      dev.Peers[len(dev.Peers)-1].LastHandshake = time.Unix(sec, nsec)
+    }
+    sec, nsec = 0, 0
+  }
+  for _, line := range strings.Split(uapi, "\n") {
+    kv := strings.SplitN(line, "=", 2)
+    if len(kv) != 2 {
+      continue
+    }
+    switch kv[0] {
+    case "private_key":
+      k, err := parseHexKey(kv[1])
+      if err != nil {
+        return Device{}, err
+      }
+      dev.PublicKey = k.PublicKey().String()
+      continue
+    case "listen_port":
+      port, err := strconv.Atoi(kv[1])
+      if err != nil {
+        return Device{}, fmt.Errorf("invalid listen_port: %w", err)
+      }
+      dev.ListenPort = port
+      continue
+    case "public_key":
+      flush()
+      k, err := parseHexKey(kv[1])
+      if err != nil {
+        return Device{}, err
+      }
+      dev.Peers = append(dev.Peers, PeerStat{PublicKey: k.String()})
+      continue
+    }
+    if len(dev.Peers) == 0 {
+      continue
+    }
+    peer := &dev.Peers[len(dev.Peers)-1]
+    if kv[0] == "allowed_ip" {
+      peer.AllowedIPs = append(peer.AllowedIPs, kv[1])
+      continue
+    }
+    var n *int64
+    switch kv[0] {
+    case "last_handshake_time_sec":
+      n = &sec
+    case "last_handshake_time_nsec":
+      n = &nsec
+    case "rx_bytes":
+      n = &peer.RxBytes
+    case "tx_bytes":
+      n = &peer.TxBytes
+    default:
+      continue
+    }
+    v, err := strconv.ParseInt(kv[1], 10, 64)
+    if err != nil {
+      return Device{}, fmt.Errorf("invalid %v: %w", kv[0], err)
+    }
+    *n = v
+  }
+  flush()
+  return dev, nil
+}
+
+func parseHexKey(s string) (Key, error) {
+  raw, err := hex.DecodeString(s)
+  if err != nil || len(raw) != KeyLen {
+    return Key{}, fmt.Errorf("%w %q", ErrInvalidKey, s)
+  }
+  var k Key
+  copy(k[:], raw)
+  return k, nil
+}
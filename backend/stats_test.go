@@ -0,0 +1,70 @@
+package backend
+
+import (
+  "reflect"
+  "testing"
+  "time"
+)
+
+const (
+  // RFC 7748 section 6.1, Alice's private and public key and Bob's public
+  // key
+  statsPrivateKeyHex = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+  statsKey           = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+  statsKeyHex        = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+  otherKey           = "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08="
+)
+
+func TestParseDump(t *testing.T) {
+  in := "cHJpdmF0ZQ==\t" + otherKey + "\t10001\toff\n" +
+    statsKey + "\t(none)\t1.2.3.4:51820\t10.20.30.2/32,fd00::2/128\t1700000000\t1024\t2048\t10\n" +
+    otherKey + "\t(none)\t(none)\t(none)\t0\t0\t0\toff\n"
+  expected := Device{
+    PublicKey:  otherKey,
+    ListenPort: 10001,
+    Peers: []PeerStat{
+      {
+        PublicKey:     statsKey,
+        AllowedIPs:    []string{"10.20.30.2/32", "fd00::2/128"},
+        LastHandshake: time.Unix(1700000000, 0),
+        RxBytes:       1024,
+        TxBytes:       2048,
+      },
+      {PublicKey: otherKey},
+    },
+  }
+  actual, err := parseDump(in)
+  if err != nil || !reflect.DeepEqual(actual, expected) {
+    t.Errorf("parseDump() = %v, %v; expected %v", actual, err, expected)
+  }
+
+  if _, err := parseDump(in + "garbage\n"); err == nil {
+    t.Errorf("parseDump() of a short peer line got no error")
+  }
+}
+
+func TestParseUAPIDevice(t *testing.T) {
+  in := "private_key=" + statsPrivateKeyHex + "\nlisten_port=10001\n" +
+    "public_key=" + statsKeyHex + "\nendpoint=1.2.3.4:51820\n" +
+    "last_handshake_time_sec=1700000000\nlast_handshake_time_nsec=5\n" +
+    "tx_bytes=2048\nrx_bytes=1024\nallowed_ip=10.20.30.2/32\n" +
+    "public_key=" + statsKeyHex + "\nlast_handshake_time_sec=0\nlast_handshake_time_nsec=0\n"
+  expected := Device{
+    PublicKey:  statsKey,
+    ListenPort: 10001,
+    Peers: []PeerStat{
+      {
+        PublicKey:     statsKey,
+        AllowedIPs:    []string{"10.20.30.2/32"},
+        LastHandshake: time.Unix(1700000000, 5),
+        RxBytes:       1024,
+        TxBytes:       2048,
+      },
+      {PublicKey: statsKey},
+    },
+  }
+  actual, err := parseUAPIDevice(in)
+  if err != nil || !reflect.DeepEqual(actual, expected) {
+    t.Errorf("parseUAPIDevice() = %v, %v; expected %v", actual, err, expected)
+  }
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+
+  "golang.zx2c4.com/wireguard/conn"
+  "golang.zx2c4.com/wireguard/device"
+  "golang.zx2c4.com/wireguard/tun"
+)
+
+// WireGuardUserspace runs WireGuard inside tricarbd (wireguard-go) on top of
+// a TUN device, so neither the kernel module nor wireguard-tools are needed.
+// Interface and peers are kept in the same config sections as WireGuard.
+type WireGuardUserspace struct {
+  WireGuard
+
+  tunDev tun.Device
+  dev    *device.Device
+}
+
+func (v *WireGuardUserspace) Install(platform string) error {
+  fmt.Println("Nothing to install, wireguard runs inside tricarbd")
+  return nil
+}
+
+func (v *WireGuardUserspace) Capabilities() Capabilities {
+  return Capabilities{Protocol: ProtoWireGuard, IPv6: true, LivePeerUpdate: true, Userspace: true}
+}
+
+func (v *WireGuardUserspace) UpInterface(i string) error {
+  if v.dev != nil {
+    return wrapError("link add", IfaceName(i), ErrInterfaceUp)
+  }
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  uapi, err := v.uapiConfig()
+  if err != nil {
+    return err
+  }
+
+  name := IfaceName(i)
+  tunDev, err := tun.CreateTUN(name, device.DefaultMTU)
+  if err != nil {
+    return wrapError("tun create", name, err)
+  }
+  dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "("+name+") "))
+  if err := dev.IpcSet(uapi); err != nil {
+    dev.Close()
+    return wrapError("configure device", name, err)
+  }
+  if err := dev.Up(); err != nil {
+    dev.Close()
+    return wrapError("device up", name, err)
+  }
+  v.tunDev = tunDev
+  v.dev = dev
+
+  if err := linkUp(name, v.IfaceSec, v.PeersSec); err != nil {
+    v.closeDevice()
+    return err
+  }
+  forwardRules(name, v.IfaceSec.LocalEth, true)
+  return nil
+}
+
+func (v *WireGuardUserspace) DownInterface(i string) error {
+  if v.dev == nil {
+    return wrapError("link del", IfaceName(i), ErrInterfaceNotUp)
+  }
+  forwardRules(IfaceName(i), v.IfaceSec.LocalEth, false)
+  v.closeDevice()
+  return nil
+}
+
+func (v *WireGuardUserspace) SyncInterface(i string) error {
+  if v.dev == nil {
+    return wrapError("configure device", IfaceName(i), ErrInterfaceNotUp)
+  }
+  if err := v.loadConfig(); err != nil {
+    return err
+  }
+  current, err := v.dev.IpcGet()
+  if err != nil {
+    return wrapError("configure device", IfaceName(i), err)
+  }
+  uapi, err := v.uapiPeers()
+  if err != nil {
+    return wrapError("configure device", IfaceName(i), err)
+  }
+
+  // replace_peers would drop the sessions of every peer, so only the peers
+  // which are gone are removed and the rest are updated in place
+  wanted := map[string]bool{}
+  for _, p := range v.PeersSec {
+    if pubKey, err := base64ToHex(p.PublicKey); err == nil {
+      wanted[pubKey] = true
+    }
+  }
+  for _, line := range strings.Split(current, "\n") {
+    if !strings.HasPrefix(line, "public_key=") {
+      continue
+    }
+    pubKey := strings.TrimPrefix(line, "public_key=")
+    if !wanted[pubKey] {
+      uapi = "public_key=" + pubKey + "\nremove=true\n" + uapi
+    }
+  }
+  return wrapError("configure device", IfaceName(i), v.dev.IpcSet(uapi))
+}
+
+func (v *WireGuardUserspace) closeDevice() {
+  // closing the device also closes the tun device and removes the link
+  v.dev.Close()
+  v.dev = nil
+  v.tunDev = nil
+}
+
+// uapiConfig renders the interface and peers in the wireguard cross-platform
+// userspace API format, keys have to be hex instead of base64 there.
+func (v *WireGuardUserspace) uapiConfig() (string, error) {
+  context := ""
+
+  prvKey, err := base64ToHex(string(v.kp.privateKey))
+  if err != nil {
+    return "", err
+  }
+  context += "private_key=" + prvKey + "\n"
+  if v.IfaceSec.IsServer() {
+    context += "listen_port=" + strconv.Itoa(v.IfaceSec.ListenPort) + "\n"
+  }
+  context += "replace_peers=true\n"
+
+  peers, err := v.uapiPeers()
+  if err != nil {
+    return "", err
+  }
+  return context + peers, nil
+}
+
+func (v *WireGuardUserspace) uapiPeers() (string, error) {
+  context := ""
+  for _, p := range v.PeersSec {
+    pubKey, err := base64ToHex(p.PublicKey)
+    if err != nil {
+      return "", err
+    }
+    context += "public_key=" + pubKey + "\n"
+    context += "replace_allowed_ips=true\n"
+    for _, ip := range p.AllowedIPs {
+      context += "allowed_ip=" + ip + "\n"
+    }
+    if p.Endpoint != nil {
+      context += "endpoint=" + p.Endpoint.String() + "\n"
+    }
+    context += "persistent_keepalive_interval=" + strconv.Itoa(p.PersistentKeepalive) + "\n"
+  }
+  return context, nil
+}
+
+func base64ToHex(key string) (string, error) {
+  k, err := ParseKey(key)
+  if err != nil {
+    return "", err
+  }
+  return k.Hex(), nil
+}
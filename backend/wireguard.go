@@ -1,14 +1,12 @@
 package backend
 
 import (
-  "errors"
   "fmt"
-  "os/exec"
+  "io/ioutil"
+  "os"
+  "strconv"
   "strings"
 
-  "github.com/mitchellh/mapstructure"
-
-  "github.com/GreysTone/tricarboxylic/config"
   "github.com/GreysTone/tricarboxylic/utils"
 )
 
@@ -17,21 +15,8 @@ type KeyPair struct {
   publicKey  []byte
 }
 
-type Interface struct {
-  ListenPort string
-  Address    string
-  PrivateKey string
-  LocalEth   string
-}
-
-type Peer struct {
-  PublicKey  string
-  AllowedIps string
-  EndPointIp   string
-  EndPointPort string
-}
-
 type WireGuard struct {
+  env      Env
   kp       KeyPair
   IfaceSec Interface
   PeersSec []Peer
@@ -49,8 +34,9 @@ PostUp   = iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j A
 PostDown = iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT; iptables -t nat -D POSTROUTING -o RWTH_ETH -j MASQUERADE
 
 `
-  configClientPeer = `Endpoint = RWTH_SERVER_IP:RWTH_PORT
-PersistentKeepalive = 10
+  configClientPeer = `Endpoint = RWTH_ENDPOINT
+`
+  configKeepalivePeer = `PersistentKeepalive = RWTH_KEEPALIVE
 `
 )
 
@@ -79,39 +65,27 @@ func (v *WireGuard) Uninstall() error {
 }
 
 func (v *WireGuard) NewKeyPair() error {
-  privateKey, err := exec.Command("wg", "genkey").Output()
+  privateKey, err := GeneratePrivateKey()
   if err != nil {
-    return err
+    return wrapError("key generate", "", err)
   }
-  v.kp.privateKey = privateKey
-
-  pubCmd := exec.Command("wg", "pubkey")
-  pubCmd.Stdin = strings.NewReader(string(v.kp.privateKey))
-  v.kp.publicKey, err = pubCmd.Output()
-  if err != nil {
-    return err
-  }
-
-  fmt.Println("PublicKey:", string(v.kp.publicKey))
+  v.kp.privateKey = []byte(privateKey.String())
+  v.kp.publicKey = []byte(privateKey.PublicKey().String())
   return nil
 }
 
-func (v *WireGuard) NewInterface(config map[string]string) error {
+func (v *WireGuard) NewInterface(iface Interface) error {
   if err := v.loadConfig(); err != nil {
     return err
   }
 
   if string(v.kp.privateKey) == "" {
-    return errors.New("empty keypair")
+    return ErrEmptyKeyPair
   }
-
-  var newInterface = Interface{
-    ListenPort: config["ListenPort"],
-    Address:    config["Address"],
-    PrivateKey: strings.TrimSpace(string(v.kp.privateKey)),
-    LocalEth:   config["LocalEth"],
+  if err := iface.Validate(); err != nil {
+    return wrapError("interface add", "", err)
   }
-  v.IfaceSec = newInterface
+  v.IfaceSec = iface
 
   if err := v.saveConfig(); err != nil {
     return err
@@ -119,20 +93,20 @@ func (v *WireGuard) NewInterface(config map[string]string) error {
   return nil
 }
 
-func (v *WireGuard) AddPeer(config map[string]string) error {
+func (v *WireGuard) AddPeer(peer Peer) error {
   if err := v.loadConfig(); err != nil {
     return err
   }
 
-  var newPeer = Peer{
-    PublicKey:  config["PublicKey"],
-    AllowedIps: config["AllowedIPs"],
+  if err := peer.Validate(); err != nil {
+    return wrapError("peer add", "", err)
   }
-  if config["EndPointIp"] != "" {
-    newPeer.EndPointIp = config["EndPointIp"]
-    newPeer.EndPointPort = config["EndPointPort"]
+  key, err := ParseKey(peer.PublicKey)
+  if err != nil {
+    return wrapError("peer add", "", err)
   }
-  v.PeersSec = append(v.PeersSec, newPeer)
+  peer.PublicKey = key.String()
+  v.PeersSec = putPeer(v.PeersSec, peer)
 
   if err := v.saveConfig(); err != nil {
     return err
@@ -140,19 +114,15 @@ func (v *WireGuard) AddPeer(config map[string]string) error {
   return nil
 }
 
-func (v *WireGuard) DelPeer(hash string) error {
+func (v *WireGuard) DelPeer(publicKey string) error {
   if err := v.loadConfig(); err != nil {
     return err
   }
-
-  for i, p := range v.PeersSec {
-    if strings.Contains(p.PublicKey, hash) {
-      fmt.Println("Delete the following node:")
-      fmt.Printf("%v\n", p)
-      v.PeersSec = append(v.PeersSec[:i], v.PeersSec[i+1:]...)
-      break
-    }
+  key, err := ParseKey(publicKey)
+  if err != nil {
+    return wrapError("peer del", "", err)
   }
+  v.PeersSec, _ = delPeer(v.PeersSec, key.String())
 
   if err := v.saveConfig(); err != nil {
     return err
@@ -168,17 +138,38 @@ func (v *WireGuard) DownInterface(i string) error {
   return utils.StdIOCmd("wg-quick", "down", i)
 }
 
+func (v *WireGuard) SyncInterface(i string) error {
+  // syncconf only understands the wg(8) subset of the wg-quick config
+  stripped, err := utils.OutputCmd("wg-quick", "strip", i)
+  if err != nil {
+    return wrapError("config strip", IfaceName(i), err)
+  }
+  f, err := ioutil.TempFile("", "tricarb-sync-*.conf")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(f.Name())
+  if _, err := f.Write(stripped); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Close(); err != nil {
+    return err
+  }
+  return wrapError("syncconf", IfaceName(i), utils.StdIOCmd("wg", "syncconf", IfaceName(i), f.Name()))
+}
+
 func (v *WireGuard) Config() (string, error) {
   context := ""
 
   context += "[Interface]\n"
   ifaceRp := map[string]string{
-    "RWTH_PORT":    v.IfaceSec.ListenPort,
+    "RWTH_PORT":    strconv.Itoa(v.IfaceSec.ListenPort),
     "RWTH_CIDR":    v.IfaceSec.Address,
-    "RWTH_PRV_KEY": v.IfaceSec.PrivateKey,
+    "RWTH_PRV_KEY": string(v.kp.privateKey),
     "RWTH_ETH":     v.IfaceSec.LocalEth,
   }
-  if v.IfaceSec.ListenPort != "" {
+  if v.IfaceSec.IsServer() {
     if ifaceTextS, err := utils.MakeText(configServerInterface, ifaceRp); err != nil {
       return "", err
     } else {
@@ -196,76 +187,114 @@ func (v *WireGuard) Config() (string, error) {
     context += "[Peer]\n"
     peerRp := map[string]string {
       "RWTH_PUB_KEY":   p.PublicKey,
-      "RWTH_CIDR":      p.AllowedIps,
-      "RWTH_SERVER_IP": p.EndPointIp,
-      "RWTH_PORT":      p.EndPointPort,
+      "RWTH_CIDR":      strings.Join(p.AllowedIPs, ", "),
+      "RWTH_KEEPALIVE": strconv.Itoa(p.PersistentKeepalive),
     }
     if peerTextS, err := utils.MakeText(configServerPeer, peerRp); err != nil {
       return "", err
     } else {
       context += peerTextS
     }
-    if p.EndPointIp != "" {
+    if p.Endpoint != nil {
+      peerRp["RWTH_ENDPOINT"] = p.Endpoint.String()
       if peerTextC, err := utils.MakeText(configClientPeer, peerRp); err != nil {
         return "", err
       } else {
         context += peerTextC
       }
     }
+    if p.PersistentKeepalive != 0 {
+      if peerTextK, err := utils.MakeText(configKeepalivePeer, peerRp); err != nil {
+        return "", err
+      } else {
+        context += peerTextK
+      }
+    }
     context += "\n"
   }
 
   return context, nil
 }
 
-func (v *WireGuard) CIDR() string {
-  return v.IfaceSec.Address
+func (v *WireGuard) Interface() Interface {
+  return v.IfaceSec
 }
 
-func (v *WireGuard) Port() string {
-  return v.IfaceSec.ListenPort
+func (v *WireGuard) Peers() []Peer {
+  return v.PeersSec
 }
 
-func (v *WireGuard) Peer() interface{} {
-  return v.PeersSec
+func (v *WireGuard) Capabilities() Capabilities {
+  return Capabilities{Protocol: ProtoWireGuard, IPv6: true, LivePeerUpdate: true}
 }
 
 func (v *WireGuard) PublicKey() string {
   return string(v.kp.publicKey)
 }
 
+// wgInterface is the persisted interface, only the private key of the key
+// pair is kept.
+type wgInterface struct {
+  Interface  `mapstructure:",squash"`
+  PrivateKey string
+}
+
+func (v *WireGuard) Load() error {
+  return v.loadConfig()
+}
+
+type wgSnapshot struct {
+  kp    KeyPair
+  iface Interface
+  peers []Peer
+}
+
+func (v *WireGuard) Snapshot() (Snapshot, error) {
+  if err := v.loadConfig(); err != nil {
+    return nil, err
+  }
+  return wgSnapshot{kp: v.kp, iface: v.IfaceSec, peers: append([]Peer{}, v.PeersSec...)}, nil
+}
+
+func (v *WireGuard) Restore(s Snapshot) error {
+  snap, ok := s.(wgSnapshot)
+  if !ok {
+    return wrapError("restore", "", ErrSnapshot)
+  }
+  v.kp, v.IfaceSec, v.PeersSec = snap.kp, snap.iface, append([]Peer{}, snap.peers...)
+  return v.saveConfig()
+}
+
 func (v *WireGuard) loadConfig() error {
-  rawIface := config.Iface("wg.iface")
-  if err := mapstructure.Decode(rawIface, &v.IfaceSec); err != nil {
+  var iface wgInterface
+  if err := v.env.loadIface("wg.iface", &iface); err != nil {
     return err
   }
-  rawPeers := config.Peers("wg.peers")
-  if err := mapstructure.Decode(rawPeers, &v.PeersSec); err != nil {
+  v.IfaceSec = iface.Interface
+  peers, err := v.env.loadPeers("wg.peers")
+  if err != nil {
     return err
   }
+  v.PeersSec = peers
+
+  // after a restart of tricarbd the key pair is derived from the private key
+  if len(v.kp.privateKey) == 0 && iface.PrivateKey != "" {
+    privateKey, err := ParseKey(iface.PrivateKey)
+    if err != nil {
+      return wrapError("key load", "", err)
+    }
+    v.kp.privateKey = []byte(privateKey.String())
+    v.kp.publicKey = []byte(privateKey.PublicKey().String())
+  }
   return nil
 }
 
 func (v *WireGuard) saveConfig() error {
-	iface := map[string]interface{} {
-		"ListenPort": v.IfaceSec.ListenPort,
-		"Address":    v.IfaceSec.Address,
-		"PrivateKey": v.IfaceSec.PrivateKey,
-		"LocalEth":   v.IfaceSec.LocalEth,
-	}
-	config.SubmitIface("wg.iface", iface)
-	peers := []interface{}{}
-	for _, p := range v.PeersSec {
-		peer := map[string]string {
-			"PublicKey":  p.PublicKey,
-			"AllowedIPs": p.AllowedIps,
-		}
-		if p.EndPointIp != "" {
-			peer["EndPointIp"] = p.EndPointIp
-			peer["EndPointPort"] = p.EndPointPort
-		}
-		peers = append(peers, peer)
-	}
-	config.SubmitPeers("wg.peers", peers)
-	return nil
+  iface := map[string]interface{} {
+    "ListenPort": v.IfaceSec.ListenPort,
+    "Address":    v.IfaceSec.Address,
+    "PrivateKey": string(v.kp.privateKey),
+    "LocalEth":   v.IfaceSec.LocalEth,
+  }
+  return v.env.saveSections("wg.iface", iface, "wg.peers", v.PeersSec)
 }
@@ -6,37 +6,37 @@ import (
   "fmt"
   "log"
   "os"
+  "strings"
   "time"
 
+  "github.com/GreysTone/tricarboxylic/client"
   "github.com/GreysTone/tricarboxylic/config"
   pb "github.com/GreysTone/tricarboxylic/rpc"
   "github.com/spf13/cobra"
-  "google.golang.org/grpc"
 )
 
 const (
-  TricarbdAddr = "localhost:50101"
-  TricarbdPort = "50101"
+  TricarbdPort = client.DefaultPort
+
+  // drift waits at least that long, a repair may restart the interface
+  driftTimeout = 10 * time.Second
 )
 
 var (
+  addrFlag string
+  timeoutFlag time.Duration
+
   statusCmd = &cobra.Command{
     Use:		"list",
     Short:	"list current status of tricarb",
     Run: func(cmd *cobra.Command, args[]string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.Status(ctx, &pb.Request{Client: "trictl"})
+      c := dial()
+      defer c.Close()
+      status, err := c.Status(context.Background())
       if err != nil {
-        log.Fatalf("failed to list status: %v\n", err)
+        log.Fatalf("failed to %v\n", err)
       }
-      fmt.Print(r.GetMsg())
+      fmt.Print(status)
     },
   }
 
@@ -46,19 +46,39 @@ var (
     Run: func(cmd *cobra.Command, args []string) {
       fmt.Printf("trictl:\n%v\n\n", config.Version())
 
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
+      c := dial()
+      defer c.Close()
+      version, err := c.Version(context.Background())
       if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
+        log.Fatalf("failed to %v\n", err)
       }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.Version(ctx, &pb.Request{Client: "trictl"})
+      fmt.Printf("tricarbd:\n%v\n", version)
+    },
+  }
+
+  capabilitiesCmd = &cobra.Command{
+    Use:     "capabilities",
+    Aliases: []string{"caps"},
+    Short:   "show what the backend of tricarbd supports and the plugins it finds",
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      plugins, err := c.Plugins(context.Background())
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("plugins:          %v\n", strings.Join(plugins, " "))
+      name, caps, err := c.Capabilities(context.Background())
       if err != nil {
-        log.Fatalf("failed to get version: %v\n", err)
+        log.Fatalf("failed to %v\n", err)
       }
-      fmt.Printf("tricarbd:\n%v\n", r.GetMsg())
+      fmt.Printf("backend:          %v\n", name)
+      fmt.Printf("protocol:         %v\n", caps.GetProtocol())
+      fmt.Printf("ipv6:             %v\n", caps.GetIpv6())
+      fmt.Printf("preshared-key:    %v\n", caps.GetPresharedKey())
+      fmt.Printf("live-peer-update: %v\n", caps.GetLivePeerUpdate())
+      fmt.Printf("l2:               %v\n", caps.GetL2())
+      fmt.Printf("userspace:        %v\n", caps.GetUserspace())
     },
   }
 
@@ -77,23 +97,12 @@ var (
     Short:	"set a static CIDR for network",
     Args: 	cobra.MinimumNArgs(1),
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.SetCIDR(ctx, &pb.ConfigRequest{Config: args[0]})
-      if err != nil {
-        log.Fatalf("failed to set CIDR: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        fmt.Printf("failed to set CIDR, %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("set CIDR to: %v\n", args[0])
+      c := dial()
+      defer c.Close()
+      if err := c.SetCIDR(context.Background(), args[0]); err != nil {
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("set CIDR to: %v\n", args[0])
     },
   }
 
@@ -102,23 +111,12 @@ var (
     Short:	"set a static port for network",
     Args: 	cobra.MinimumNArgs(1),
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.SetPort(ctx, &pb.ConfigRequest{Config: args[0]})
-      if err != nil {
-        log.Fatalf("failed to set port: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        fmt.Printf("failed to set port, %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("set port to: %v\n", args[0])
+      c := dial()
+      defer c.Close()
+      if err := c.SetPort(context.Background(), args[0]); err != nil {
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("set port to: %v\n", args[0])
     },
   }
 
@@ -127,23 +125,26 @@ var (
     Short: "select a physical network interface for network",
     Args:  cobra.MinimumNArgs(1),
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
+      c := dial()
+      defer c.Close()
+      if err := c.SetNetIC(context.Background(), args[0]); err != nil {
+        log.Fatalf("failed to %v\n", err)
       }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.SetNetIC(ctx, &pb.ConfigRequest{Config: args[0]})
-      if err != nil {
-        log.Fatalf("failed to set physical network interface: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        fmt.Printf("failed to set physical network interface, %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("set physical network interface to: %v\n", args[0])
+      fmt.Printf("set physical network interface to: %v\n", args[0])
+    },
+  }
+
+  setStaleCmd = &cobra.Command{
+    Use:   "stale",
+    Short: "drop peers without a handshake for the given period, 0 never does",
+    Args:  cobra.MinimumNArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      if err := c.SetStale(context.Background(), args[0]); err != nil {
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("set stale period to: %v\n", args[0])
     },
   }
 
@@ -161,23 +162,13 @@ var (
     Use:		"start",
     Short:	"start a tricarb server",
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
+      c := dial()
+      defer c.Close()
+      access, err := c.StartServer(context.Background())
       if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.ServerStart(ctx, &pb.Request{Client: "trictl"})
-      if err != nil {
-        log.Fatalf("failed to start a tricarb server: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        log.Fatalf("failed to start a tricarb server: %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("start a tricarb server on: %v\n", r.GetMsg())
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("start a tricarb server on: %v\n", access)
     },
   }
 
@@ -185,23 +176,12 @@ var (
     Use:		"stop",
     Short:	"stop a tricarb server",
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.ServerStop(ctx, &pb.Request{Client: "trictl"})
-      if err != nil {
-        log.Fatalf("failed to stop the tricarb server: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        log.Fatalf("failed to stop the tricarb server: %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("stop the tricarb server\n")
+      c := dial()
+      defer c.Close()
+      if err := c.StopServer(context.Background()); err != nil {
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("stop the tricarb server\n")
     },
   }
 
@@ -216,33 +196,29 @@ var (
   }
 
   hostFlag string
+  portFlag string
   accessCode string
+  nameFlag string
+  ttlFlag time.Duration
 
   clientAttachCmd = &cobra.Command{
     Use:		"attach",
     Short:	"attach to a tricarb server",
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.ClientAttach(ctx, &pb.ServerInfo{
+      c := dial()
+      defer c.Close()
+      negotiated, err := c.Attach(context.Background(), client.Remote{
         Host:				hostFlag,
-        Port:				TricarbdPort,
+        Port:				portFlag,
         AccessCode:	accessCode,
+        Name:				nameFlag,
+        TTL:				ttlFlag,
       })
       if err != nil {
-        log.Fatalf("failed to attach to tricarb server: %v\n", err)
-      }
-      if r.GetCode() != 0 {
-        log.Fatalf("failed to attach to tricarb server: %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("attached to server: %v\n", hostFlag)
+        log.Fatalf("failed to %v\n", err)
       }
+      fmt.Printf("attached to server: %v\n", hostFlag)
+      fmt.Printf("negotiated: %v\n", negotiated)
     },
   }
 
@@ -250,31 +226,223 @@ var (
     Use:		"detach",
     Short:	"detach from a tricarb server",
     Run: func(cmd *cobra.Command, args []string) {
-      conn, err := grpc.Dial(TricarbdAddr, grpc.WithInsecure(), grpc.WithBlock())
-      if err != nil {
-        log.Fatalf("failed to connect to server: %v\n", err)
-      }
-      defer conn.Close()
-      c := pb.NewTricarbClient(conn)
-      ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-      defer cancel()
-      r, err := c.ClientDetach(ctx, &pb.ServerInfo{
+      c := dial()
+      defer c.Close()
+      err := c.Detach(context.Background(), client.Remote{
         Host:       hostFlag,
-        Port:       TricarbdPort,
+        Port:       portFlag,
         AccessCode: accessCode,
       })
       if err != nil {
-        log.Fatalf("failed to detach from tricarb server: %v\n", err)
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("detached from server: %v\n", hostFlag)
+    },
+  }
+
+  reservationCmd = &cobra.Command{
+    Use:     "reservation",
+    Aliases: []string{"rsv"},
+    Short:   "reservation add/list/del",
+    Run: func(cmd *cobra.Command, args []string) {
+      if err := cmd.Help(); err != nil {
+        os.Exit(0)
+      }
+    },
+  }
+
+  keyFlag string
+  addressFlags []string
+  poolFlag string
+
+  reservationAddCmd = &cobra.Command{
+    Use:   "add",
+    Short: "reserve an address for a peer's public key or name",
+    Run: func(cmd *cobra.Command, args []string) {
+      if keyFlag == "" && nameFlag == "" {
+        log.Fatalf("failed to add reservation: --key or --name is required\n")
+      }
+      c := dial()
+      defer c.Close()
+      rsv, err := c.AddReservation(context.Background(), &pb.Reservation{
+        PublicKey: keyFlag,
+        Name:      nameFlag,
+        Addresses: addressFlags,
+        Pool:      poolFlag,
+      })
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("reserved: %v\n", strings.Join(rsv.GetAddresses(), ", "))
+    },
+  }
+
+  reservationListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "list reserved addresses",
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      reservations, err := c.ListReservations(context.Background())
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      for _, rsv := range reservations {
+        fmt.Printf("%-12v %-40v %-16v %v\n", rsv.GetPool(), strings.Join(rsv.GetAddresses(), ", "), rsv.GetName(), rsv.GetPublicKey())
+      }
+    },
+  }
+
+  reservationDelCmd = &cobra.Command{
+    Use:   "del",
+    Short: "delete the reservation of a peer's public key or name",
+    Run: func(cmd *cobra.Command, args []string) {
+      if keyFlag == "" && nameFlag == "" {
+        log.Fatalf("failed to delete reservation: --key or --name is required\n")
+      }
+      c := dial()
+      defer c.Close()
+      rsv, err := c.DelReservation(context.Background(), &pb.Reservation{PublicKey: keyFlag, Name: nameFlag, Pool: poolFlag})
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("released reservation: %v\n", strings.Join(rsv.GetAddresses(), ", "))
+    },
+  }
+
+  poolCmd = &cobra.Command{
+    Use:   "pool",
+    Short: "pool add/list/del",
+    Run: func(cmd *cobra.Command, args []string) {
+      if err := cmd.Help(); err != nil {
+        os.Exit(0)
+      }
+    },
+  }
+
+  cidrFlag string
+
+  poolAddCmd = &cobra.Command{
+    Use:   "add",
+    Short: "add a named address pool with its own access code",
+    Long:  "Add a named address pool with its own access code. A running server restarts its interface\nfor the address in the new pool, so this is refused while peers are attached.",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      pool, err := c.AddPool(context.Background(), args[0], cidrFlag)
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("added pool %v with access code: %v\n", pool.GetName(), pool.GetAccessCode())
+    },
+  }
+
+  poolListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "list address pools",
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      pools, err := c.ListPools(context.Background())
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      for _, p := range pools {
+        fmt.Printf("%-12v %-40v %-6v %v\n", p.GetName(), strings.Join(p.GetNetworks(), ", "), p.GetPeers(), p.GetAccessCode())
+      }
+    },
+  }
+
+  poolDelCmd = &cobra.Command{
+    Use:   "del",
+    Short: "delete an address pool without peers",
+    Long:  "Delete an address pool without peers. A running server restarts its interface to drop the\naddress in the pool, so this is refused while peers of other pools are attached.",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      if err := c.DelPool(context.Background(), args[0]); err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      fmt.Printf("deleted pool: %v\n", args[0])
+    },
+  }
+
+  repairFlag bool
+
+  driftCmd = &cobra.Command{
+    Use:   "drift",
+    Short: "compare the live device with the config of tricarbd",
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      timeout := timeoutFlag
+      if timeout < driftTimeout {
+        timeout = driftTimeout
+      }
+      ctx, cancel := context.WithTimeout(context.Background(), timeout)
+      defer cancel()
+      found, repaired, err := c.Drift(ctx, repairFlag)
+      for _, d := range found {
+        fmt.Println(d)
+      }
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      if len(found) == 0 {
+        fmt.Println("no drift")
+      } else if repaired {
+        fmt.Println("repaired")
       }
-      if r.GetCode() != 0 {
-        log.Fatalf("failed to detach from tricarb server: %v\n", r.GetMsg())
-      } else {
-        fmt.Printf("detached from server: %v\n", hostFlag)
+    },
+  }
+
+  peerCmd = &cobra.Command{
+    Use:   "peer",
+    Short: "peer list",
+    Run: func(cmd *cobra.Command, args []string) {
+      if err := cmd.Help(); err != nil {
+        os.Exit(0)
+      }
+    },
+  }
+
+  peerListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "list attached peers with their expiry and last handshake",
+    Run: func(cmd *cobra.Command, args []string) {
+      c := dial()
+      defer c.Close()
+      peers, err := c.ListPeers(context.Background())
+      if err != nil {
+        log.Fatalf("failed to %v\n", err)
+      }
+      for _, p := range peers {
+        fmt.Printf("%-44v %-16v %-12v %-40v expires %-20v handshake %v\n", p.GetPublicKey(), p.GetName(), p.GetPool(),
+          strings.Join(p.GetAddresses(), ", "), unixTime(p.GetExpires()), unixTime(p.GetLastHandshake()))
       }
     },
   }
 )
 
+// dial connects to tricarbd, trictl ends when it can not.
+func dial() *client.Client {
+  c, err := client.Dial(client.Options{Addr: addrFlag, Timeout: timeoutFlag, Name: "trictl"})
+  if err != nil {
+    log.Fatalf("failed to %v\n", err)
+  }
+  return c
+}
+
+// unixTime prints unix seconds, zero is unset.
+func unixTime(sec int64) string {
+  if sec == 0 {
+    return "-"
+  }
+  return time.Unix(sec, 0).Format("2006-01-02 15:04:05")
+}
+
 func NewTricarbCtl() * cobra.Command {
   return &cobra.Command{
     Use:   "trictl",
@@ -289,13 +457,19 @@ func NewTricarbCtl() * cobra.Command {
 }
 
 func SetupTricarbCtl(cmd * cobra.Command) {
+  // the admin socket as config.yaml sets it, trictl and tricarbd share it
+  cmd.PersistentFlags().StringVar(&addrFlag, "addr", "unix://"+config.AdminSocket(), "tricarbd's admin socket")
+  cmd.PersistentFlags().DurationVar(&timeoutFlag, "timeout", client.DefaultTimeout, "how long to wait for tricarbd's reply")
+
   cmd.AddCommand(statusCmd)
   cmd.AddCommand(versionCmd)
+  cmd.AddCommand(capabilitiesCmd)
 
   cmd.AddCommand(setCmd)
   setCmd.AddCommand(setCIDRCmd)
   setCmd.AddCommand(setPortCmd)
   setCmd.AddCommand(setNetICCmd)
+  setCmd.AddCommand(setStaleCmd)
 
   cmd.AddCommand(serverCmd)
   serverCmd.AddCommand(serverStartCmd)
@@ -307,5 +481,33 @@ func SetupTricarbCtl(cmd * cobra.Command) {
   clientAttachCmd.Flags().StringVarP(&hostFlag, "host", "n", "", "tricarb server's host")
   clientAttachCmd.Flags().StringVarP(&accessCode, "access", "a", "", "tricarb server's access code")
   clientDetachCmd.Flags().StringVarP(&hostFlag, "host", "n", "", "tricarb server's host")
+  clientAttachCmd.Flags().StringVar(&nameFlag, "name", "", "name to look up reservations by, defaults to the hostname")
+  clientAttachCmd.Flags().DurationVar(&ttlFlag, "ttl", 0, "the server drops this node after this long, e.g. 2h, defaults to never")
   clientDetachCmd.Flags().StringVarP(&accessCode, "access", "a", "", "tricarb server's access code")
+  for _, c := range []*cobra.Command{clientAttachCmd, clientDetachCmd} {
+    c.Flags().StringVarP(&portFlag, "port", "p", TricarbdPort, "tricarb server's public port")
+  }
+
+  cmd.AddCommand(reservationCmd)
+  reservationCmd.AddCommand(reservationAddCmd)
+  reservationCmd.AddCommand(reservationListCmd)
+  reservationCmd.AddCommand(reservationDelCmd)
+  for _, c := range []*cobra.Command{reservationAddCmd, reservationDelCmd} {
+    c.Flags().StringVarP(&keyFlag, "key", "k", "", "peer's public key")
+    c.Flags().StringVarP(&nameFlag, "name", "m", "", "peer's name")
+    c.Flags().StringVarP(&poolFlag, "pool", "p", "", "address pool, defaults to the default one")
+  }
+  reservationAddCmd.Flags().StringSliceVarP(&addressFlags, "address", "i", nil, "addresses to reserve, one per network, defaults to the lowest free ones")
+
+  cmd.AddCommand(poolCmd)
+  poolCmd.AddCommand(poolAddCmd)
+  poolCmd.AddCommand(poolListCmd)
+  poolCmd.AddCommand(poolDelCmd)
+  poolAddCmd.Flags().StringVarP(&cidrFlag, "cidr", "c", "", "base CIDR of the pool's networks, defaults to a random ipv4 /24")
+
+  cmd.AddCommand(peerCmd)
+  peerCmd.AddCommand(peerListCmd)
+
+  cmd.AddCommand(driftCmd)
+  driftCmd.Flags().BoolVarP(&repairFlag, "repair", "r", false, "bring the device back in line with the config")
 }
@@ -0,0 +1,382 @@
+package client
+
+import (
+  "context"
+  "time"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/credentials"
+
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+const (
+  // DefaultPort is where a server node takes attaching clients
+  DefaultPort = "50101"
+  // DefaultDialTimeout is how long Dial waits for tricarbd
+  DefaultDialTimeout = 5 * time.Second
+  // DefaultTimeout is how long a call waits for its reply
+  DefaultTimeout = time.Second
+  // MinSetupTimeout is the least Attach, Detach and StartServer wait,
+  // tricarbd dials the server node or brings the interface up first
+  MinSetupTimeout = 15 * time.Second
+  // DefaultName tells tricarbd who calls
+  DefaultName = "tricarb-client"
+)
+
+// Options are where tricarbd is and how long to wait for it, only Addr must
+// be set.
+type Options struct {
+  // Addr is unix:///path of the admin socket, or the host and port of the
+  // public address which only takes joining and leaving peers. The admin
+  // socket is where the config of tricarbd puts it, trictl reads config.yaml
+  Addr string
+  // Credentials secure the connection, nil is plaintext
+  Credentials credentials.TransportCredentials
+  // DialTimeout bounds Dial
+  DialTimeout time.Duration
+  // Timeout bounds each call whose context has no deadline of its own,
+  // those setting up the tunnel wait at least MinSetupTimeout
+  Timeout time.Duration
+  // Name is sent to tricarbd with the calls which take one
+  Name string
+}
+
+// Client calls the operations of a tricarbd, it is safe for concurrent use.
+// The methods return an *Error, whose Err is ErrRefused when tricarbd
+// answered with a failure.
+type Client struct {
+  conn *grpc.ClientConn
+  rpc  pb.TricarbClient
+  opts Options
+}
+
+// Remote is the server node a client attaches to or detaches from.
+type Remote struct {
+  Host string
+  // Port defaults to DefaultPort
+  Port string
+  AccessCode string
+  // Name looks up reservations, empty is the hostname of the client node
+  Name string
+  // TTL drops the client after that long, zero never does
+  TTL time.Duration
+}
+
+// Dial connects to tricarbd, it gives up after the dial timeout.
+func Dial(opts Options) (*Client, error) {
+  if opts.Addr == "" {
+    return nil, wrapError("connect", ErrNoAddr)
+  }
+  if opts.DialTimeout == 0 {
+    opts.DialTimeout = DefaultDialTimeout
+  }
+  if opts.Timeout == 0 {
+    opts.Timeout = DefaultTimeout
+  }
+  if opts.Name == "" {
+    opts.Name = DefaultName
+  }
+  security := grpc.WithInsecure()
+  if opts.Credentials != nil {
+    security = grpc.WithTransportCredentials(opts.Credentials)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+  defer cancel()
+  conn, err := grpc.DialContext(ctx, opts.Addr, security, grpc.WithBlock())
+  if err != nil {
+    return nil, wrapError("connect to "+opts.Addr, err)
+  }
+  return &Client{conn: conn, rpc: pb.NewTricarbClient(conn), opts: opts}, nil
+}
+
+func (c *Client) Close() error {
+  return c.conn.Close()
+}
+
+// RPC is the generated client, for calls without a method here.
+func (c *Client) RPC() pb.TricarbClient {
+  return c.rpc
+}
+
+// withTimeout bounds a call by the timeout unless ctx already is.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+  if _, ok := ctx.Deadline(); ok {
+    return context.WithCancel(ctx)
+  }
+  return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// withSetupTimeout is withTimeout for calls which set up the tunnel, the
+// timeout is raised to MinSetupTimeout.
+func (c *Client) withSetupTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+  if _, ok := ctx.Deadline(); ok {
+    return context.WithCancel(ctx)
+  }
+  timeout := c.opts.Timeout
+  if timeout < MinSetupTimeout {
+    timeout = MinSetupTimeout
+  }
+  return context.WithTimeout(ctx, timeout)
+}
+
+func (c *Client) request() *pb.Request {
+  return &pb.Request{Client: c.opts.Name}
+}
+
+// Status tells the role of the node, the drift found last and the config of
+// its backend.
+func (c *Client) Status(ctx context.Context) (string, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.Status(ctx, c.request())
+  if err != nil {
+    return "", wrapError("list status", err)
+  }
+  return r.GetMsg(), replyError("list status", r.GetCode(), r.GetMsg())
+}
+
+func (c *Client) Version(ctx context.Context) (string, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.Version(ctx, c.request())
+  if err != nil {
+    return "", wrapError("get version", err)
+  }
+  return r.GetMsg(), replyError("get version", r.GetCode(), r.GetMsg())
+}
+
+// Capabilities tells the backend of tricarbd and what it supports.
+func (c *Client) Capabilities(ctx context.Context) (string, *pb.Capabilities, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.Capabilities(ctx, c.request())
+  if err != nil {
+    return "", nil, wrapError("get capabilities", err)
+  }
+  if err := replyError("get capabilities", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return "", nil, err
+  }
+  return r.GetBackend(), r.GetCapabilities(), nil
+}
+
+// Plugins lists the backends served by the plugins of tricarbd, they are
+// listed even if the selected backend failed to load.
+func (c *Client) Plugins(ctx context.Context) ([]string, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.Capabilities(ctx, c.request())
+  if err != nil {
+    return nil, wrapError("get plugins", err)
+  }
+  return r.GetPlugins(), nil
+}
+
+// set changes one setting with the RPC of it.
+func (c *Client) set(ctx context.Context, op string, value string,
+  call func(context.Context, *pb.ConfigRequest, ...grpc.CallOption) (*pb.Reply, error)) error {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := call(ctx, &pb.ConfigRequest{Config: value})
+  if err != nil {
+    return wrapError(op, err)
+  }
+  return replyError(op, r.GetCode(), r.GetMsg())
+}
+
+func (c *Client) SetMode(ctx context.Context, mode string) error {
+  return c.set(ctx, "set mode", mode, c.rpc.SetMode)
+}
+
+// SetCIDR sets the base the networks are picked from, e.g.
+// 10.0.0.0/8,fd00::/8 for dual-stack.
+func (c *Client) SetCIDR(ctx context.Context, cidr string) error {
+  return c.set(ctx, "set CIDR", cidr, c.rpc.SetCIDR)
+}
+
+func (c *Client) SetPort(ctx context.Context, port string) error {
+  return c.set(ctx, "set port", port, c.rpc.SetPort)
+}
+
+func (c *Client) SetNetIC(ctx context.Context, nic string) error {
+  return c.set(ctx, "set physical network interface", nic, c.rpc.SetNetIC)
+}
+
+// SetStale drops peers without a handshake for the period, e.g. 30m, 0
+// never does.
+func (c *Client) SetStale(ctx context.Context, period string) error {
+  return c.set(ctx, "set stale period", period, c.rpc.SetStale)
+}
+
+// StartServer makes the node a server and returns its access code.
+func (c *Client) StartServer(ctx context.Context) (string, error) {
+  ctx, cancel := c.withSetupTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ServerStart(ctx, c.request())
+  if err != nil {
+    return "", wrapError("start a tricarb server", err)
+  }
+  if err := replyError("start a tricarb server", r.GetCode(), r.GetMsg()); err != nil {
+    return "", err
+  }
+  return r.GetMsg(), nil
+}
+
+func (c *Client) StopServer(ctx context.Context) error {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ServerStop(ctx, c.request())
+  if err != nil {
+    return wrapError("stop the tricarb server", err)
+  }
+  return replyError("stop the tricarb server", r.GetCode(), r.GetMsg())
+}
+
+func (remote Remote) serverInfo() *pb.ServerInfo {
+  port := remote.Port
+  if port == "" {
+    port = DefaultPort
+  }
+  return &pb.ServerInfo{
+    Host:       remote.Host,
+    Port:       port,
+    AccessCode: remote.AccessCode,
+    Name:       remote.Name,
+    // rounded up, a zero ttl never expires
+    Ttl:        int64((remote.TTL + time.Second - 1) / time.Second),
+  }
+}
+
+// Attach makes the node a client of the remote server, it returns what the
+// nodes negotiated.
+func (c *Client) Attach(ctx context.Context, remote Remote) (string, error) {
+  ctx, cancel := c.withSetupTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ClientAttach(ctx, remote.serverInfo())
+  if err != nil {
+    return "", wrapError("attach to tricarb server", err)
+  }
+  if err := replyError("attach to tricarb server", r.GetCode(), r.GetMsg()); err != nil {
+    return "", err
+  }
+  return r.GetMsg(), nil
+}
+
+func (c *Client) Detach(ctx context.Context, remote Remote) error {
+  ctx, cancel := c.withSetupTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ClientDetach(ctx, remote.serverInfo())
+  if err != nil {
+    return wrapError("detach from tricarb server", err)
+  }
+  return replyError("detach from tricarb server", r.GetCode(), r.GetMsg())
+}
+
+// AddReservation reserves addresses for a public key or name, those left
+// out get the lowest free ones. It returns the reservation made.
+func (c *Client) AddReservation(ctx context.Context, rsv *pb.Reservation) (*pb.Reservation, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.AddReservation(ctx, rsv)
+  if err != nil {
+    return nil, wrapError("add reservation", err)
+  }
+  if err := replyError("add reservation", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetReservation(), nil
+}
+
+func (c *Client) ListReservations(ctx context.Context) ([]*pb.Reservation, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ListReservations(ctx, c.request())
+  if err != nil {
+    return nil, wrapError("list reservations", err)
+  }
+  if err := replyError("list reservations", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetReservations(), nil
+}
+
+// DelReservation releases the reservation of a public key or name and
+// returns it.
+func (c *Client) DelReservation(ctx context.Context, rsv *pb.Reservation) (*pb.Reservation, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.DelReservation(ctx, rsv)
+  if err != nil {
+    return nil, wrapError("delete reservation", err)
+  }
+  if err := replyError("delete reservation", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetReservation(), nil
+}
+
+// AddPool adds a named pool, an empty cidr is a random ipv4 /24. The pool
+// returned holds its access code.
+func (c *Client) AddPool(ctx context.Context, name string, cidr string) (*pb.Pool, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.AddPool(ctx, &pb.Pool{Name: name, Cidr: cidr})
+  if err != nil {
+    return nil, wrapError("add pool", err)
+  }
+  if err := replyError("add pool", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetPool(), nil
+}
+
+func (c *Client) ListPools(ctx context.Context) ([]*pb.Pool, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ListPools(ctx, c.request())
+  if err != nil {
+    return nil, wrapError("list pools", err)
+  }
+  if err := replyError("list pools", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetPools(), nil
+}
+
+// DelPool deletes a pool without peers.
+func (c *Client) DelPool(ctx context.Context, name string) error {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.DelPool(ctx, &pb.Pool{Name: name})
+  if err != nil {
+    return wrapError("delete pool", err)
+  }
+  return replyError("delete pool", r.GetStatus().GetCode(), r.GetStatus().GetMsg())
+}
+
+// ListPeers lists the attached peers with their expiry and last handshake.
+func (c *Client) ListPeers(ctx context.Context) ([]*pb.PeerStatus, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.ListPeers(ctx, c.request())
+  if err != nil {
+    return nil, wrapError("list peers", err)
+  }
+  if err := replyError("list peers", r.GetStatus().GetCode(), r.GetStatus().GetMsg()); err != nil {
+    return nil, err
+  }
+  return r.GetPeers(), nil
+}
+
+// Drift compares the live device with the config, with repair it is
+// brought back in line. The differences are returned even when the repair
+// failed, repaired tells whether there were any to repair.
+func (c *Client) Drift(ctx context.Context, repair bool) ([]string, bool, error) {
+  ctx, cancel := c.withTimeout(ctx)
+  defer cancel()
+  r, err := c.rpc.Drift(ctx, &pb.DriftRequest{Repair: repair})
+  if err != nil {
+    return nil, false, wrapError("check drift", err)
+  }
+  return r.GetDifferences(), r.GetRepaired(), replyError("check drift", r.GetStatus().GetCode(), r.GetStatus().GetMsg())
+}
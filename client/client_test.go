@@ -0,0 +1,134 @@
+package client
+
+import (
+  "context"
+  "errors"
+  "net"
+  "testing"
+  "time"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+// fakeTricarbd answers a few calls the way tricarbd does.
+type fakeTricarbd struct {
+  pb.UnimplementedTricarbServer
+  client string
+}
+
+func (f *fakeTricarbd) Status(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
+  f.client = in.GetClient()
+  return &pb.Reply{Code: 0, Msg: "role: idle\n"}, nil
+}
+
+func (f *fakeTricarbd) ServerStop(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
+  return &pb.Reply{Code: 1, Msg: "no server running"}, nil
+}
+
+// ServerStart takes longer than the timeouts of TestTimeout, as bringing up
+// the interface does.
+func (f *fakeTricarbd) ServerStart(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
+  time.Sleep(50 * time.Millisecond)
+  return &pb.Reply{Code: 0, Msg: "access"}, nil
+}
+
+func (f *fakeTricarbd) ListPeers(ctx context.Context, in *pb.Request) (*pb.PeersReply, error) {
+  <-ctx.Done()
+  return nil, ctx.Err()
+}
+
+func (f *fakeTricarbd) Drift(ctx context.Context, in *pb.DriftRequest) (*pb.DriftReply, error) {
+  return &pb.DriftReply{
+    Status:      &pb.Reply{Code: 1, Msg: "failed to reconcile"},
+    Differences: []string{"peer a is missing"},
+  }, nil
+}
+
+func dialFake(t *testing.T, opts Options) (*Client, *fakeTricarbd) {
+  lis, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  fake := &fakeTricarbd{}
+  s := grpc.NewServer()
+  pb.RegisterTricarbServer(s, fake)
+  go s.Serve(lis)
+  t.Cleanup(s.Stop)
+
+  opts.Addr = lis.Addr().String()
+  c, err := Dial(opts)
+  if err != nil {
+    t.Fatalf("Dial(%v) got error %v", opts.Addr, err)
+  }
+  t.Cleanup(func() { c.Close() })
+  return c, fake
+}
+
+func TestStatus(t *testing.T) {
+  c, fake := dialFake(t, Options{Name: "test"})
+  if msg, err := c.Status(context.Background()); err != nil || msg != "role: idle\n" {
+    t.Errorf("Status() = %q, %v; expected the idle role", msg, err)
+  }
+  if fake.client != "test" {
+    t.Errorf("Status() sent client %q; expected test", fake.client)
+  }
+}
+
+func TestRefused(t *testing.T) {
+  c, _ := dialFake(t, Options{})
+  err := c.StopServer(context.Background())
+  var e *Error
+  if !errors.Is(err, ErrRefused) || !errors.As(err, &e) || e.Code != 1 {
+    t.Fatalf("StopServer() got error %v; expected it refused", err)
+  }
+  if err.Error() != "stop the tricarb server: no server running" {
+    t.Errorf("StopServer() got error %q; expected the message of tricarbd", err)
+  }
+
+  // the differences come with the error
+  found, repaired, err := c.Drift(context.Background(), true)
+  if !errors.Is(err, ErrRefused) || len(found) != 1 || repaired {
+    t.Errorf("Drift() = %v, %v, %v; expected the difference and the error", found, repaired, err)
+  }
+}
+
+func TestTimeout(t *testing.T) {
+  c, _ := dialFake(t, Options{Timeout: 10 * time.Millisecond})
+  _, err := c.ListPeers(context.Background())
+  if errors.Is(err, ErrRefused) || status.Code(errors.Unwrap(err)) != codes.DeadlineExceeded {
+    t.Errorf("ListPeers() got error %v; expected the deadline exceeded", err)
+  }
+  // setting up the tunnel waits at least MinSetupTimeout
+  if access, err := c.StartServer(context.Background()); err != nil || access != "access" {
+    t.Errorf("StartServer() = %q, %v; expected the access code", access, err)
+  }
+
+  // a deadline of the caller wins over the timeout
+  ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+  defer cancel()
+  if msg, err := c.Status(ctx); err != nil || msg == "" {
+    t.Errorf("Status() = %q, %v", msg, err)
+  }
+}
+
+func TestDialNoAddr(t *testing.T) {
+  if _, err := Dial(Options{}); !errors.Is(err, ErrNoAddr) {
+    t.Errorf("Dial() without an address got error %v; expected ErrNoAddr", err)
+  }
+}
+
+func TestDialTimeout(t *testing.T) {
+  lis, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  addr := lis.Addr().String()
+  lis.Close()
+  if _, err := Dial(Options{Addr: addr, DialTimeout: 50 * time.Millisecond}); err == nil {
+    t.Errorf("Dial(%v) of nothing listening succeeded", addr)
+  }
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+  "errors"
+)
+
+var (
+  // ErrRefused is wrapped by the Error of an operation tricarbd answered
+  // with a failure, e.g. a wrong access code
+  ErrRefused = errors.New("refused by tricarbd")
+  // ErrNoAddr is returned by Dial without Options.Addr
+  ErrNoAddr = errors.New("no address of tricarbd")
+)
+
+// Error tells which operation failed. Err is ErrRefused when tricarbd
+// refused it, Code and Msg are then those of its reply; otherwise Err is
+// what the connection or the call returned, e.g. a grpc status.
+type Error struct {
+  Op   string
+  Code uint32
+  Msg  string
+  Err  error
+}
+
+func (e *Error) Error() string {
+  if e.Err == ErrRefused {
+    return e.Op + ": " + e.Msg
+  }
+  return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+func wrapError(op string, err error) error {
+  if err == nil {
+    return nil
+  }
+  return &Error{Op: op, Err: err}
+}
+
+// replyError is the error of a reply, nil for success.
+func replyError(op string, code uint32, msg string) error {
+  if code == 0 {
+    return nil
+  }
+  return &Error{Op: op, Code: code, Msg: msg, Err: ErrRefused}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
   "fmt"
+  "path"
 
   "github.com/GreysTone/tricarboxylic/utils"
 )
@@ -14,8 +15,14 @@ var (
 )
 
 const (
-  backendKey      = "backend"
-  defaultBackend  = "wireguard"
+  BackendKey      = "backend"
+  DefaultBackend  = "wireguard"
+
+  // the admin API is only served on a unix socket, the public address only
+  // takes peers joining and leaving
+  AdminSocketKey    = "listen.admin"
+  PublicAddrKey     = "listen.public"
+  DefaultPublicAddr = ":50101"
 )
 
 func Version() string {
@@ -29,25 +36,26 @@ func Version() string {
 }
 
 func Backend() string {
-  if ret := utils.ReadString(backendKey); ret != "" {
+  if ret := utils.ReadString(BackendKey); ret != "" {
     return ret
   } else {
-    return defaultBackend
+    return DefaultBackend
   }
 }
 
-func Iface(backendSpec string) map[string]interface{} {
-  return utils.ReadMap(backendSpec)
-}
-
-func SubmitIface(backendSpec string, ctx map[string]interface{}) {
-  utils.UpdateMap(backendSpec, ctx)
-}
-
-func Peers(backendSpec string) []interface{} {
-  return utils.ReadArray(backendSpec)
+// AdminSocket is the unix socket of the admin API, tricarbd.sock next to
+// config.yaml by default.
+func AdminSocket() string {
+  if ret := utils.ReadString(AdminSocketKey); ret != "" {
+    return ret
+  }
+  return path.Join(utils.ConfigDir(), "tricarbd.sock")
 }
 
-func SubmitPeers(backendSpec string, ctx []interface{}) {
-  utils.UpdateArray(backendSpec, ctx)
+// PublicAddr is where server nodes take attaching clients.
+func PublicAddr() string {
+  if ret := utils.ReadString(PublicAddrKey); ret != "" {
+    return ret
+  }
+  return DefaultPublicAddr
 }
@@ -9,15 +9,17 @@ import (
   "math/rand"
   "net"
   "os"
-  "os/exec"
   "path"
   "strconv"
   "strings"
+  "sync"
   "time"
 
   "github.com/GreysTone/tricarboxylic/backend"
   "github.com/GreysTone/tricarboxylic/config"
+  "github.com/GreysTone/tricarboxylic/ipam"
   pb "github.com/GreysTone/tricarboxylic/rpc"
+  "github.com/GreysTone/tricarboxylic/state"
   "github.com/GreysTone/tricarboxylic/utils"
   "google.golang.org/grpc"
 )
@@ -25,74 +27,255 @@ import (
 const (
   TyServerMode = "server"
   TyClientMode = "client"
+  TyIdleMode   = "idle"
 
   ConfAccessKey = "access"
   ConfCIDRKey   = "default.cidr"
   ConfPortKey   = "default.port"
   ConfNetICKey  = "default.nic"
+  ConfModeKey   = "default.mode"
 )
 
-var (
+const (
+  // random networks tried before giving up on a base CIDR
+  maxNetworkTries = 16
+  // a client waits that long for the server, the other operations wait
+  // for it
+  dialTimeout = 5 * time.Second
+)
+
+// Config holds the settings a user edits, e.g. the base CIDR, the port and
+// the nic, config.yaml by default.
+type Config interface {
+  ReadString(key string) string
+  UpdateString(key string, value string) error
+}
+
+// Logger gets the warnings and what the reaper and the reconciler did,
+// *log.Logger is one.
+type Logger interface {
+  Printf(format string, v ...interface{})
+}
+
+// Options are what New builds a Server from, the zero value is tricarbd:
+// the backend named in config.yaml with the state next to it.
+type Options struct {
+  // Backend serves the tunnel, nil creates the one named by Config on
+  // first use. Those keep their interface and peers in Store and read
+  // their settings from Config. A Loader is loaded by New.
+  Backend backend.VpnBackend
+  // Store keeps the access code, the role, the pools and the leases, nil
+  // is the default store next to config.yaml
+  Store *state.Store
+  // Config holds the settings, nil is config.yaml
+  Config Config
+  // Logger gets the warnings, nil prints them to stdout
+  Logger Logger
+  // ConfPath is the config file of the interface, empty is ~/wg.conf
+  ConfPath string
+}
+
+// Server is a tricarb node, a server or a client. It owns every piece of
+// its state, several of them may run in one process.
+type Server struct {
+  pb.UnimplementedTricarbServer
+
+  // mu serializes the operations, the handlers, the reaper, the
+  // reconciler and Recover, they all read and write the state below
+  mu sync.Mutex
+
+  store *state.Store
+  conf  Config
+  log   Logger
+
   accessCode string
 
-  workingMode string
-  tricarbCIDR string
-  tricarbPort string
+  workingMode  string
+  tricarbCIDR  string
+  tricarbPort  string
   tricarbNetIC string
 
-  addrPool map[uint32]bool
-  be backend.VpnBackend
+  addrPool *ipam.Pool
+  be       backend.VpnBackend
   confPath string
-)
 
-func init() {
-  addrPool = map[uint32]bool{}
-  confPath = path.Join(os.Getenv("HOME"), "wg.conf")
+  // groups are the named pools besides addrPool
+  groups map[string]*group
+  // staleAfter drops peers without a handshake for that long, zero never
+  staleAfter time.Duration
+
+  // drift is what the last check found, checked is zero before the first
+  drift        []string
+  driftChecked time.Time
+
+  // localPrefixes leaves out the routes of the tunnel, tests replace it
+  localPrefixes func() ([]string, error)
+  // newPoolStore keeps the state of a named pool
+  newPoolStore func(name string) ipam.Store
+}
+
+// New builds a Server from the options and loads its settings and state.
+// Neither the interface nor anything in the background is started, see
+// Recover, RunReaper and RunReconciler.
+func New(opts Options) (*Server, error) {
+  s := &Server{
+    store:    opts.Store,
+    conf:     opts.Config,
+    log:      opts.Logger,
+    be:       opts.Backend,
+    confPath: opts.ConfPath,
+    groups:   map[string]*group{},
+  }
+  if s.store == nil {
+    store, err := state.Default()
+    if err != nil {
+      return nil, err
+    }
+    s.store = store
+  }
+  if s.conf == nil {
+    s.conf = fileConfig{}
+  }
+  if s.log == nil {
+    s.log = log.New(os.Stdout, "", 0)
+  }
+  if l, ok := s.be.(backend.Loader); ok {
+    if err := l.Load(); err != nil {
+      return nil, err
+    }
+  }
+  if s.confPath == "" {
+    s.confPath = path.Join(os.Getenv("HOME"), "wg.conf")
+  }
+  s.localPrefixes = func() ([]string, error) {
+    return ipam.LocalPrefixes(backend.IfaceName(s.confPath))
+  }
+  s.newPoolStore = func(name string) ipam.Store {
+    return ipam.StateStore{Store: s.store, Pool: name}
+  }
+
+  var err error
+  if s.addrPool, err = ipam.New(s.newPoolStore("")); err != nil {
+    return nil, err
+  }
+  if err := s.loadGroups(); err != nil {
+    return nil, err
+  }
+  if _, err := s.store.Get(ConfAccessKey, &s.accessCode); err != nil {
+    return nil, err
+  }
+  if s.accessCode == "" {
+    s.accessCode = utils.GenerateAccessCode(32)
+  }
+  if _, err := s.store.Get(ConfModeKey, &s.workingMode); err != nil {
+    return nil, err
+  }
+  if s.workingMode == "" {
+    s.workingMode = TyIdleMode
+  }
 
-  accessCode = utils.ReadString(ConfAccessKey)
-  if accessCode == "" {
-    accessCode = utils.GenerateAccessCode(32)
+  s.tricarbCIDR = s.conf.ReadString(ConfCIDRKey)
+  s.tricarbPort = s.conf.ReadString(ConfPortKey)
+  s.tricarbNetIC = s.conf.ReadString(ConfNetICKey)
+  if s.staleAfter, err = parseStale(s.conf.ReadString(ConfStaleKey)); err != nil {
+    s.log.Printf("warning: ignoring %v: %v\n", ConfStaleKey, err)
   }
+  return s, nil
+}
+
+// fileConfig is config.yaml.
+type fileConfig struct{}
 
-  tricarbCIDR = utils.ReadString(ConfCIDRKey)
-  tricarbPort = utils.ReadString(ConfPortKey)
-  tricarbNetIC = utils.ReadString(ConfNetICKey)
+func (fileConfig) ReadString(key string) string {
+  return utils.ReadString(key)
 }
 
-type Server struct {
-  pb.UnimplementedTricarbServer
+func (fileConfig) UpdateString(key string, value string) error {
+  return utils.UpdateString(key, value)
+}
+
+// backendName is the backend selected in the config.
+func (s *Server) backendName() string {
+  if name := s.conf.ReadString(config.BackendKey); name != "" {
+    return name
+  }
+  return config.DefaultBackend
 }
 
 func (s *Server) Version(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
   return &pb.Reply{Code: 0, Msg: config.Version()}, nil
 }
 
+// Status tells the role of this node, server, client or idle without a
+// tunnel, what the last reconcile found and the config of the backend.
 func (s *Server) Status(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
-  if be == nil {
-    be = backend.NewBackend(config.Backend())
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  status := "role: " + s.workingMode + "\n" + s.driftStatus()
+  if err := s.loadBackend(); err != nil {
+    return &pb.Reply{Code: 1, Msg: status + err.Error()}, nil
   }
 
-  conf, err := be.Config()
+  conf, err := s.be.Config()
   if err != nil {
     return &pb.Reply{Code: 1, Msg: "failed to get config"}, err
   }
-  return &pb.Reply{Code: 0, Msg: conf}, nil
+  return &pb.Reply{Code: 0, Msg: status + conf}, nil
+}
+
+// Capabilities also lists the plugins found in plugin.dir, they are the
+// backends the config may select besides the built-in ones.
+func (s *Server) Capabilities(ctx context.Context, in *pb.Request) (*pb.CapabilitiesReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  plugins, err := backend.Plugins(backend.Env{Settings: s.conf, Logger: s.log})
+  if err != nil {
+    s.log.Printf("warning: failed to list the plugins: %v\n", err)
+  }
+  if err := s.loadBackend(); err != nil {
+    return &pb.CapabilitiesReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}, Plugins: plugins}, nil
+  }
+  return &pb.CapabilitiesReply{
+    Status:       &pb.Reply{Code: 0, Msg: ""},
+    Backend:      s.backendName(),
+    Capabilities: toPbCapabilities(s.be.Capabilities()),
+    Plugins:      plugins,
+  }, nil
 }
 
 func (s *Server) SetMode(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply, error) {
   return &pb.Reply{Code: 1, Msg: "deprecated"}, nil
 }
 
+// SetCIDR takes the base of the server's network, an ipv4 and an ipv6 one
+// separated by commas make a dual-stack network.
 func (s *Server) SetCIDR(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply, error) {
-  if _, _, err := net.ParseCIDR(in.GetConfig()); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to parse the given CIDR"}, err
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if len(splitCIDRs(in.GetConfig())) == 0 {
+    return &pb.Reply{Code: 1, Msg: "failed to parse the given CIDR"}, nil
+  }
+  if err := s.checkCIDRs(in.GetConfig()); err != nil {
+    return &pb.Reply{Code: 1, Msg: err.Error()}, nil
+  }
+  // the networks of attached peers are kept, those move with a new CIDR
+  if n := len(s.addrPool.Leases()); n != 0 {
+    return &pb.Reply{Code: 1, Msg: fmt.Sprintf("%v peers are attached, detach them first", n)}, nil
+  }
+  if err := s.conf.UpdateString(ConfCIDRKey, in.GetConfig()); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to save the given CIDR, " + err.Error()}, nil
+  }
+  s.tricarbCIDR = in.GetConfig()
+  // the next server start picks networks under the new CIDR
+  if err := s.addrPool.Reset(); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to reset address pool"}, err
   }
-  utils.UpdateString(ConfCIDRKey, in.GetConfig())
-  tricarbCIDR = in.GetConfig()
   return &pb.Reply{Code: 0, Msg: ""}, nil
 }
 
 func (s *Server) SetPort(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
   i, err := strconv.Atoi(in.GetConfig())
   if err != nil {
     return &pb.Reply{Code: 1, Msg: "failed to parse the given port"}, err
@@ -100,107 +283,185 @@ func (s *Server) SetPort(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply,
   if i < 10000 || i > 20000 {
     return &pb.Reply{Code: 1, Msg: "invalid range of the given port, 10000-20000"}, err
   }
-  utils.UpdateString(ConfPortKey, in.GetConfig())
-  tricarbPort = in.GetConfig()
+  if err := s.conf.UpdateString(ConfPortKey, in.GetConfig()); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to save the given port, " + err.Error()}, nil
+  }
+  s.tricarbPort = in.GetConfig()
   return &pb.Reply{Code: 0, Msg: ""}, nil
 }
 
 func (s *Server) SetNetIC(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply, error) {
-  _, err := exec.Command("ifconfig", in.GetConfig()).Output()
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  _, err := utils.OutputCmd("ifconfig", in.GetConfig())
   if err != nil {
     return &pb.Reply{Code: 1, Msg: "failed to detect the given network interface card"}, err
   }
-  utils.UpdateString(ConfNetICKey, in.GetConfig())
-  tricarbNetIC = in.GetConfig()
+  if err := s.conf.UpdateString(ConfNetICKey, in.GetConfig()); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to save the given network interface card, " + err.Error()}, nil
+  }
+  s.tricarbNetIC = in.GetConfig()
   return &pb.Reply{Code: 0, Msg: ""}, nil
 }
 
 func (s *Server) ServerStart(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
-  if accessCode == "" {
-    accessCode = utils.GenerateAccessCode(32)
-    utils.UpdateString(ConfAccessKey, accessCode)
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.accessCode == "" {
+    s.accessCode = utils.GenerateAccessCode(32)
+  }
+  if err := s.store.Put(ConfAccessKey, s.accessCode); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to save access code, " + err.Error()}, nil
   }
 
-  var newServerIface = map[string]string{}
-  if tricarbPort != "" {
-    newServerIface["ListenPort"] = tricarbPort
+  var newServerIface = backend.Interface{}
+  if s.tricarbPort != "" {
+    port, err := strconv.Atoi(s.tricarbPort)
+    if err != nil {
+      return &pb.Reply{Code: 1, Msg: "failed to parse the configured port"}, nil
+    }
+    newServerIface.ListenPort = port
   } else {
-    newServerIface["ListenPort"] = strconv.Itoa(10000 + rand.Intn(9999))
+    newServerIface.ListenPort = 10000 + rand.Intn(9999)
+  }
+  if err := s.loadBackend(); err != nil {
+    return &pb.Reply{Code: 1, Msg: err.Error()}, nil
+  }
+  ch, err := s.begin()
+  if err != nil {
+    return errorReply("failed to begin", err), nil
   }
-  assignedCIDR, err := NewNetworkCIDR(tricarbCIDR, &addrPool)
+  // the leases of networks in use survive restarts of tricarbd
+  avoid, err := s.localPrefixes()
   if err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to create network"}, nil
+    s.log.Printf("warning: failed to read routes, the network may overlap them: %v\n", err)
   }
-  newServerIface["Address"] = assignedCIDR
-  println("check nic", tricarbNetIC)
-  newServerIface["LocalEth"] = tricarbNetIC
+  if _, err := s.ensureNetworks(s.addrPool, s.tricarbCIDR, avoid); err != nil {
+    return ch.fail(&pb.Reply{Code: 1, Msg: "failed to create network, " + err.Error()}), nil
+  }
+  for _, name := range s.groupNames() {
+    if _, err := s.ensureNetworks(s.groups[name].pool, s.groups[name].CIDR, avoid); err != nil {
+      return ch.fail(&pb.Reply{Code: 1, Msg: "failed to create network of pool " + name + ", " + err.Error()}), nil
+    }
+  }
+  newServerIface.Address = strings.Join(s.serverNetworks(), ", ")
+  newServerIface.LocalEth = s.tricarbNetIC
 
-  if be == nil {
-    be = backend.NewBackend(config.Backend())
+  if err := s.be.NewKeyPair(); err != nil {
+    return ch.fail(errorReply("failed to generate key pair", err)), nil
   }
-  if err := be.NewKeyPair(); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to generate key pair"}, err
+  if err := s.be.NewInterface(newServerIface); err != nil {
+    return ch.fail(errorReply("failed to create interface", err)), nil
   }
-  if err := be.NewInterface(newServerIface); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to create interface"}, err
+  // peers are synced into a running interface later on, the new address,
+  // port and keys only take effect with a restart
+  if s.virtualTapUp() {
+    if err := s.dumpConfigAndRestartVirtualTap(); err != nil {
+      return ch.fail(&pb.Reply{Code: 1, Msg: err.Error()}), nil
+    }
   }
 
-  fmt.Printf("Server starting on %v\n", newServerIface["ListenPort"])
-  return &pb.Reply{Code: 0, Msg: accessCode}, nil
+  s.setWorkingMode(TyServerMode)
+  s.log.Printf("Server starting on %v\n", newServerIface.ListenPort)
+  return &pb.Reply{Code: 0, Msg: s.accessCode}, nil
 }
 
 func (s *Server) ServerStop(ctx context.Context, in *pb.Request) (*pb.Reply, error) {
-  if err := be.DownInterface(confPath); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to down interface"}, nil
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.be == nil || s.workingMode != TyServerMode {
+    return &pb.Reply{Code: 1, Msg: "no server is running"}, nil
+  }
+  if err := s.be.DownInterface(s.confPath); err != nil {
+    return errorReply("failed to down interface", err), nil
   }
+  s.setWorkingMode(TyIdleMode)
   return &pb.Reply{Code: 0, Msg: ""}, nil
 }
 
 func (s *Server) ServerAttach(ctx context.Context, in *pb.PeerInfo) (*pb.AttachReply, error) {
-  if accessCode != in.GetAccessCode() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  pool, name, ok := s.poolFor(in.GetAccessCode())
+  if !ok {
     return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "invalid access code"}}, nil
   }
+  // a key holds addresses of one pool only, the code of another pool does
+  // not move it
+  if held, ok := s.leasedIn(strings.TrimSpace(in.GetPeerPublicKey())); ok && held != name {
+    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "peer is attached to another pool"}}, nil
+  }
 
-  if be == nil {
+  if s.be == nil {
     return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "no server was started"}}, nil
   }
+  caps, err := backend.Negotiate(s.be.Capabilities(), fromPbCapabilities(in.GetCapabilities()))
+  if err != nil {
+    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}}, nil
+  }
 
-  var newPeer = map[string]string{}
-  newPeer["PublicKey"] = in.GetPeerPublicKey()
-  dynamicIp, err := NewDynamicIpUnderCIDR(be, &addrPool)
+  networks := pool.Networks()
+  if network, prefix, ok := ipam.Overlap(networks, in.GetLocalPrefixes()); ok {
+    msg := fmt.Sprintf("network %v overlaps %v routed by the client, set another cidr on the server", network, prefix)
+    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: msg}}, nil
+  }
+
+  if in.GetTtl() < 0 {
+    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "invalid ttl"}}, nil
+  }
+
+  ch, err := s.begin()
+  if err != nil {
+    return &pb.AttachReply{Status: errorReply("failed to begin", err)}, nil
+  }
+  var newPeer = backend.Peer{}
+  newPeer.PublicKey = strings.TrimSpace(in.GetPeerPublicKey())
+  dynamicIps, err := pool.Acquire(newPeer.PublicKey, strings.TrimSpace(in.GetPeerName()))
   if err != nil {
-    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "failed to get dynamic ip address"}}, nil
+    return &pb.AttachReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to get dynamic ip address, " + err.Error()})}, nil
+  }
+  // attaching again renews the ttl, or drops it
+  var expires time.Time
+  if ttl := in.GetTtl(); ttl != 0 {
+    expires = time.Now().Add(time.Duration(ttl) * time.Second)
+  }
+  if err := pool.Expire(newPeer.PublicKey, expires); err != nil {
+    return &pb.AttachReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to set ttl, " + err.Error()})}, nil
+  }
+  assignedCIDRs := []string{}
+  for _, ip := range dynamicIps {
+    newPeer.AllowedIPs = append(newPeer.AllowedIPs, hostCIDR(ip))
+    assignedCIDRs = append(assignedCIDRs, assignedCIDR(ip, networks))
   }
-  newPeer["AllowedIPs"] = dynamicIp+"/32"
 
-  if err := be.AddPeer(newPeer); err != nil {
-    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: "failed to attach to client node"}}, err
+  if err := s.be.AddPeer(newPeer); err != nil {
+    return &pb.AttachReply{Status: ch.fail(errorReply("failed to attach to client node", err))}, nil
   }
 
-  if err := dumpConfigAndRestartVirtualTap(be); err != nil {
-    return &pb.AttachReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}}, nil
+  if err := s.dumpConfigAndSyncVirtualTap(); err != nil {
+    return &pb.AttachReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})}, nil
   }
   return &pb.AttachReply{
     Status:        &pb.Reply{Code: 0, Msg: ""},
-    AssignedCIDR:  dynamicIp+"/24",
-    SrvPublicKey:  be.PublicKey(),
-    SrvListenPort: be.Port(),
+    AssignedCIDR:  assignedCIDRs[0],
+    AssignedCIDRs: assignedCIDRs,
+    SrvPublicKey:  s.be.PublicKey(),
+    SrvListenPort: strconv.Itoa(s.be.Interface().ListenPort),
+    Capabilities:  toPbCapabilities(caps),
   }, nil
 }
 
 func (s *Server) ClientAttach(ctx context.Context, in *pb.ServerInfo) (*pb.Reply, error) {
-  if be == nil {
-    be = backend.NewBackend(config.Backend())
-  }
-
-  if err := be.NewKeyPair(); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to generate key pair"}, err
+  // the server is asked without holding the lock, see join
+  j, reply := s.stageAttach()
+  if reply != nil {
+    return reply, nil
   }
 
   // dynamic ip requesting from server
-  conn, err := grpc.Dial(in.GetHost()+":"+in.GetPort(), grpc.WithInsecure(), grpc.WithBlock())
+  conn, err := dialServer(in.GetHost() + ":" + in.GetPort())
   if err != nil {
-    log.Fatalf("failed to connect to server: %v", err)
+    return s.abortJoin(j, &pb.Reply{Code: 1, Msg: "failed to connect to server, " + err.Error()}), nil
   }
   defer conn.Close()
   c := pb.NewTricarbClient(conn)
@@ -209,52 +470,123 @@ func (s *Server) ClientAttach(ctx context.Context, in *pb.ServerInfo) (*pb.Reply
   defer cancel()
   r, err := c.ServerAttach(remoteCtx, &pb.PeerInfo{
     AccessCode: in.GetAccessCode(),
-    PeerPublicKey: be.PublicKey(),
+    PeerPublicKey: j.publicKey,
+    Capabilities: toPbCapabilities(j.caps),
+    PeerName: peerName(in.GetName()),
+    LocalPrefixes: j.prefixes,
+    Ttl: in.GetTtl(),
   })
   if err != nil {
-    log.Fatalf("failed to request to server: %v", err)
+    return s.abortJoin(j, &pb.Reply{Code: 1, Msg: "failed to request to server, " + err.Error()}), nil
   }
   if r.GetStatus().GetCode() != 0 {
-    return &pb.Reply{Code: 1, Msg: r.GetStatus().GetMsg()}, nil
+    return s.abortJoin(j, &pb.Reply{Code: 1, Msg: r.GetStatus().GetMsg()}), nil
   }
 
-  var newClientIface = map[string]string{}
-  newClientIface["Address"] = r.GetAssignedCIDR()
-  newClientIface["LocalEth"] = tricarbNetIC
-  if err := be.NewInterface(newClientIface); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to create interface"}, nil
+  reply = s.applyAttach(j, in, r)
+  if reply.GetCode() != 0 {
+    // the server holds an address for the new key, it is told to drop it
+    // again, the attach may have used up the time of remoteCtx
+    detachCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    d, err := c.ServerDetach(detachCtx, &pb.PeerInfo{AccessCode: in.GetAccessCode(), PeerPublicKey: j.publicKey})
+    if err != nil {
+      s.log.Printf("warning: failed to release the address on the server: %v\n", err)
+    } else if d.GetStatus().GetCode() != 0 {
+      s.log.Printf("warning: failed to release the address on the server: %v\n", d.GetStatus().GetMsg())
+    }
   }
+  return reply, nil
+}
 
-  var newPeer = map[string]string{}
-  newPeer["EndPointIp"] = in.GetHost()
-  newPeer["EndPointPort"] = r.GetSrvListenPort()
-  newPeer["PublicKey"] = r.GetSrvPublicKey()
-  _, ipNet, _ := net.ParseCIDR(r.GetAssignedCIDR())
-  newPeer["AllowedIPs"] = ipNet.String()
+// stageAttach stages the key pair of ClientAttach and takes what the server
+// is told about this node.
+func (s *Server) stageAttach() (*join, *pb.Reply) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err := s.loadBackend(); err != nil {
+    return nil, &pb.Reply{Code: 1, Msg: err.Error()}
+  }
+  prefixes, err := s.localPrefixes()
+  if err != nil {
+    s.log.Printf("warning: failed to read routes, the network may overlap them: %v\n", err)
+  }
+  j, reply := s.beginJoin()
+  if reply != nil {
+    return nil, reply
+  }
+  j.caps, j.prefixes = s.be.Capabilities(), prefixes
+  return j, nil
+}
 
-  if err := be.AddPeer(newPeer); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to attach to server node"}, nil
+// applyAttach sets up the interface with what the server assigned.
+func (s *Server) applyAttach(j *join, in *pb.ServerInfo, r *pb.AttachReply) *pb.Reply {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if reply := s.applyJoin(j); reply != nil {
+    return reply
+  }
+  ch := j.ch
+  // servers predating capabilities do not check the protocol
+  caps, err := backend.Negotiate(s.be.Capabilities(), fromPbCapabilities(r.GetCapabilities()))
+  if err != nil {
+    return ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})
   }
 
-  if err := dumpConfigAndRestartVirtualTap(be); err != nil {
-    return &pb.Reply{Code: 1, Msg: err.Error()}, nil
+  // servers predating dual-stack only assign one address
+  assignedCIDRs := r.GetAssignedCIDRs()
+  if len(assignedCIDRs) == 0 {
+    assignedCIDRs = []string{r.GetAssignedCIDR()}
+  }
+  // servers predating local prefixes do not check them
+  if network, prefix, ok := ipam.Overlap(assignedCIDRs, j.prefixes); ok {
+    return ch.fail(&pb.Reply{Code: 1, Msg: fmt.Sprintf("network %v of the server overlaps %v routed by this node", network, prefix)})
+  }
+  var newClientIface = backend.Interface{}
+  newClientIface.Address = strings.Join(assignedCIDRs, ", ")
+  newClientIface.LocalEth = s.tricarbNetIC
+  if err := s.be.NewInterface(newClientIface); err != nil {
+    return ch.fail(errorReply("failed to create interface", err))
   }
-  return &pb.Reply{Code: 0, Msg: ""}, nil
-}
 
-func (s *Server) ClientDetach(ctx context.Context, in *pb.ServerInfo) (*pb.Reply, error) {
-  if be == nil {
-    be = backend.NewBackend(config.Backend())
+  srvPort, err := strconv.Atoi(r.GetSrvListenPort())
+  if err != nil {
+    return ch.fail(&pb.Reply{Code: 1, Msg: "invalid listen port of server node"})
+  }
+  var newPeer = backend.Peer{}
+  newPeer.Endpoint = &backend.Endpoint{Host: in.GetHost(), Port: srvPort}
+  newPeer.PersistentKeepalive = 10
+  newPeer.PublicKey = r.GetSrvPublicKey()
+  for _, cidr := range assignedCIDRs {
+    _, ipNet, err := net.ParseCIDR(cidr)
+    if err != nil {
+      return ch.fail(&pb.Reply{Code: 1, Msg: "invalid address assigned by server node"})
+    }
+    newPeer.AllowedIPs = append(newPeer.AllowedIPs, ipNet.String())
   }
 
-  if be.PublicKey() == "" {
-    return &pb.Reply{Code: 1, Msg: "no client detected"}, nil
+  if err := s.be.AddPeer(newPeer); err != nil {
+    return ch.fail(errorReply("failed to attach to server node", err))
+  }
+
+  if err := s.dumpConfigAndRestartVirtualTap(); err != nil {
+    return ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})
+  }
+  s.setWorkingMode(TyClientMode)
+  return &pb.Reply{Code: 0, Msg: caps.String()}
+}
+
+func (s *Server) ClientDetach(ctx context.Context, in *pb.ServerInfo) (*pb.Reply, error) {
+  // the server is asked without holding the lock
+  be, publicKey, reply := s.stageDetach()
+  if reply != nil {
+    return reply, nil
   }
 
   // dynamic ip requesting from server
-  conn, err := grpc.Dial(in.GetHost()+":"+in.GetPort(), grpc.WithInsecure(), grpc.WithBlock())
+  conn, err := dialServer(in.GetHost() + ":" + in.GetPort())
   if err != nil {
-    log.Fatalf("failed to connect to server: %v", err)
+    return &pb.Reply{Code: 1, Msg: "failed to connect to server, " + err.Error()}, nil
   }
   defer conn.Close()
   c := pb.NewTricarbClient(conn)
@@ -263,49 +595,133 @@ func (s *Server) ClientDetach(ctx context.Context, in *pb.ServerInfo) (*pb.Reply
   defer cancel()
   r, err := c.ServerDetach(remoteCtx, &pb.PeerInfo{
     AccessCode: in.GetAccessCode(),
-    PeerPublicKey: be.PublicKey(),
+    PeerPublicKey: publicKey,
   })
   if err != nil {
-    log.Fatalf("failed to request to server: %v", err)
+    return &pb.Reply{Code: 1, Msg: "failed to request to server, " + err.Error()}, nil
   }
   if r.GetStatus().GetCode() != 0 {
     return &pb.Reply{Code: 1, Msg: r.GetStatus().GetMsg()}, nil
   }
 
-  if err := be.DelPeer(r.GetPeerPublicKey()); err != nil {
-    return &pb.Reply{Code: 1, Msg: "failed to detach server node"}, nil
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  // a node which attached again meanwhile keeps its new server
+  if s.be != be || s.be.PublicKey() != publicKey {
+    return &pb.Reply{Code: 1, Msg: "the node attached again while waiting for the server"}, nil
+  }
+  // the server dropped the peer already, there is nothing to roll back to
+  // and the reconciler retries a failed sync
+  if err := s.be.DelPeer(r.GetPeerPublicKey()); err != nil {
+    return errorReply("failed to detach server node", err), nil
   }
 
-  if err := dumpConfigAndRestartVirtualTap(be); err != nil {
+  if err := s.dumpConfigAndSyncVirtualTap(); err != nil {
     return &pb.Reply{Code: 1, Msg: err.Error()}, nil
   }
+  s.setWorkingMode(TyIdleMode)
   return &pb.Reply{Code: 0, Msg: ""}, nil
 
 }
 
+// stageDetach takes the backend and the key ClientDetach tells the server.
+func (s *Server) stageDetach() (backend.VpnBackend, string, *pb.Reply) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err := s.loadBackend(); err != nil {
+    return nil, "", &pb.Reply{Code: 1, Msg: err.Error()}
+  }
+  if s.be.PublicKey() == "" {
+    return nil, "", &pb.Reply{Code: 1, Msg: "no client detected"}
+  }
+  return s.be, s.be.PublicKey(), nil
+}
+
 func (s *Server) ServerDetach(ctx context.Context, in *pb.PeerInfo) (*pb.DetachReply, error) {
-  if accessCode != in.GetAccessCode() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  pool, name, ok := s.poolFor(in.GetAccessCode())
+  if !ok {
     return &pb.DetachReply{Status: &pb.Reply{Code: 1, Msg: "invalid access code"}}, nil
   }
+  // only the code of its own pool drops a peer
+  if held, ok := s.leasedIn(strings.TrimSpace(in.GetPeerPublicKey())); ok && held != name {
+    return &pb.DetachReply{Status: &pb.Reply{Code: 1, Msg: "peer is attached to another pool"}}, nil
+  }
 
-  if be == nil {
+  if s.be == nil {
     return &pb.DetachReply{Status: &pb.Reply{Code: 1, Msg: "no server was started"}}, nil
   }
 
-  if err := be.DelPeer(in.GetPeerPublicKey()); err != nil {
-    return &pb.DetachReply{Status: &pb.Reply{Code: 1, Msg: "failed to detach client node"}}, err
+  ch, err := s.begin()
+  if err != nil {
+    return &pb.DetachReply{Status: errorReply("failed to begin", err)}, nil
+  }
+  if err := s.be.DelPeer(in.GetPeerPublicKey()); err != nil {
+    return &pb.DetachReply{Status: ch.fail(errorReply("failed to detach client node", err))}, nil
+  }
+  if err := pool.Release(strings.TrimSpace(in.GetPeerPublicKey())); err != nil {
+    return &pb.DetachReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to release address, " + err.Error()})}, nil
   }
 
-  if err := dumpConfigAndRestartVirtualTap(be); err != nil {
-    return &pb.DetachReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}}, nil
+  if err := s.dumpConfigAndSyncVirtualTap(); err != nil {
+    return &pb.DetachReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})}, nil
   }
   return &pb.DetachReply{
     Status:        &pb.Reply{Code: 0, Msg: ""},
-    PeerPublicKey:  be.PublicKey(),
+    PeerPublicKey:  s.be.PublicKey(),
   }, nil
 }
 
-func NewNetworkCIDR(baseCIDR string, pool *map[uint32]bool) (string, error) {
+func (s *Server) AddReservation(ctx context.Context, in *pb.Reservation) (*pb.ReservationReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  pool, ok := s.poolNamed(strings.TrimSpace(in.GetPool()))
+  if !ok {
+    return &pb.ReservationReply{Status: &pb.Reply{Code: 1, Msg: "no pool " + in.GetPool()}}, nil
+  }
+  r, err := pool.Reserve(fromPbReservation(in))
+  if err != nil {
+    return &pb.ReservationReply{Status: &pb.Reply{Code: 1, Msg: "failed to reserve address, " + err.Error()}}, nil
+  }
+  return &pb.ReservationReply{Status: &pb.Reply{Code: 0, Msg: ""}, Reservation: toPbReservation(in.GetPool(), r)}, nil
+}
+
+func (s *Server) ListReservations(ctx context.Context, in *pb.Request) (*pb.ReservationsReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  reply := &pb.ReservationsReply{Status: &pb.Reply{Code: 0, Msg: ""}}
+  for _, name := range append([]string{DefaultPool}, s.groupNames()...) {
+    pool, _ := s.poolNamed(name)
+    for _, r := range pool.Reservations() {
+      reply.Reservations = append(reply.Reservations, toPbReservation(name, r))
+    }
+  }
+  return reply, nil
+}
+
+func (s *Server) DelReservation(ctx context.Context, in *pb.Reservation) (*pb.ReservationReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  pool, ok := s.poolNamed(strings.TrimSpace(in.GetPool()))
+  if !ok {
+    return &pb.ReservationReply{Status: &pb.Reply{Code: 1, Msg: "no pool " + in.GetPool()}}, nil
+  }
+  r, err := pool.Unreserve(strings.TrimSpace(in.GetPublicKey()), strings.TrimSpace(in.GetName()))
+  if err != nil {
+    return &pb.ReservationReply{Status: &pb.Reply{Code: 1, Msg: "failed to delete reservation, " + err.Error()}}, nil
+  }
+  return &pb.ReservationReply{Status: &pb.Reply{Code: 0, Msg: ""}, Reservation: toPbReservation(in.GetPool(), r)}, nil
+}
+
+// NewNetworkCIDR picks a random network under the base and returns it with
+// the first address as the server's, e.g. 10.20.30.1/24. An ipv6 base gets
+// a /64, fd00::/8 makes a unique local network as in RFC 4193. No base picks
+// an ipv4 /24.
+func NewNetworkCIDR(baseCIDR string) (string, error) {
+  if ip, ipNet, err := net.ParseCIDR(baseCIDR); err == nil && ip.To4() == nil {
+    return newNetworkCIDR6(ipNet), nil
+  }
   networkBits := uint32(0)
 
   if _, ipNet, err := net.ParseCIDR(baseCIDR); err != nil {
@@ -330,65 +746,96 @@ func NewNetworkCIDR(baseCIDR string, pool *map[uint32]bool) (string, error) {
   fullIp = fullIp | 0x1       // assigned 0x1 as server IP
   ipCIDR := IpUInt32ToAddr(fullIp)+"/"+strconv.Itoa(int(networkBits))
 
-  (*pool)[1] = false
-  for i := uint32(2); i <= (uint32(2) << (32 - networkBits)); i++ {
-    (*pool)[i] = true
-  }
-
   return ipCIDR, nil
 }
 
-func NewDynamicIpUnderCIDR(be backend.VpnBackend, pool *map[uint32]bool) (string, error) {
-  spNet := strings.Split(be.CIDR(), "/")
-
-  bits, _ := strconv.Atoi(spNet[1])
-  networkBits := uint32(bits)
-  rstHostBits := 32 - networkBits
-
-  networkMask := uint32(1)
-  for i := uint32(1); i < networkBits; i++ {
-    networkMask = networkMask << 1 | 0x1
+func newNetworkCIDR6(base *net.IPNet) string {
+  ones, _ := base.Mask.Size()
+  ip := make(net.IP, net.IPv6len)
+  copy(ip, base.IP)
+  // the L bit of fc00::/7, unique local addresses are fd00::/8
+  if ones < 8 && ip[0] & 0xfe == 0xfc {
+    ip[0], ones = 0xfd, 8
   }
-  networkMask = networkMask << (32 - networkBits)
-  rstHostMask := ^networkMask
-
-  network, err := IpAddrToUInt32(spNet[0])
-  if err != nil {
-    return "", err
+  for i := ones; i < 64; i++ {
+    ip[i/8] |= byte(rand.Intn(2)) << uint(7 - i%8)
+  }
+  if ones < 64 {
+    ones = 64
   }
-  networkNums := network & networkMask
-  peers := be.Peer().([]backend.Peer)
-  for _, p := range peers {
-    ipAddr := strings.Split(p.AllowedIps, "/")[0]
-    ip, err := IpAddrToUInt32(ipAddr)
+  if ones < 128 {
+    ip[15] |= 0x1       // assigned 0x1 as server IP
+  }
+  return ip.String()+"/"+strconv.Itoa(ones)
+}
+
+// checkCIDRs checks the bases of a pool, an ipv4 and an ipv6 one separated
+// by commas make a dual-stack pool.
+func (s *Server) checkCIDRs(cidrs string) error {
+  families := map[bool]bool{}
+  for _, base := range splitCIDRs(cidrs) {
+    ip, _, err := net.ParseCIDR(base)
     if err != nil {
-      return "", err
+      return fmt.Errorf("failed to parse the given CIDR %v", base)
     }
-    if (ip & networkMask) != networkNums {
-      continue
+    if families[ip.To4() != nil] {
+      return errors.New("only one CIDR per address family is supported")
     }
-    (*pool)[ip & rstHostMask] = false
+    families[ip.To4() != nil] = true
+  }
+  if families[false] && (s.loadBackend() != nil || !s.be.Capabilities().IPv6) {
+    return errors.New("backend " + s.backendName() + " does not support ipv6")
   }
+  return nil
+}
 
-  availableIp := uint32(1)
-  for i := 2; i < (2 << rstHostBits); i++ {
-    if (*pool)[uint32(i)] == true {
-      availableIp = uint32(i)
-      break
+func splitCIDRs(cidrs string) []string {
+  bases := []string{}
+  for _, base := range strings.Split(cidrs, ",") {
+    if base = strings.TrimSpace(base); base != "" {
+      bases = append(bases, base)
     }
   }
-  if availableIp == 1 {
-    return "", errors.New("failed to generate config")
+  return bases
+}
+
+// hostCIDR is the single address a server routes to a peer.
+func hostCIDR(ip string) string {
+  if strings.Contains(ip, ":") {
+    return ip+"/128"
   }
+  return ip+"/32"
+}
 
-  fullNet, err := IpAddrToUInt32(spNet[0])
-  if err != nil {
-    return "", err
+// assignedCIDR is the address a peer configures for its interface, with the
+// prefix length of the network it is in.
+func assignedCIDR(ip string, networks []string) string {
+  for _, network := range networks {
+    _, ipNet, err := net.ParseCIDR(network)
+    if err == nil && ipNet.Contains(net.ParseIP(ip)) {
+      ones, _ := ipNet.Mask.Size()
+      return ip+"/"+strconv.Itoa(ones)
+    }
   }
-  assignedIp := fullNet & networkMask | availableIp
-  ipAddr := IpUInt32ToAddr(assignedIp)
+  return hostCIDR(ip)
+}
 
-  return ipAddr, nil
+// newFreeNetworkCIDR picks random networks under the base until one does
+// not overlap the avoided prefixes.
+func newFreeNetworkCIDR(base string, avoid []string) (string, error) {
+  for i := 0; i < maxNetworkTries; i++ {
+    network, err := NewNetworkCIDR(base)
+    if err != nil {
+      return "", err
+    }
+    if _, _, ok := ipam.Overlap([]string{network}, avoid); !ok {
+      return network, nil
+    }
+  }
+  if base == "" {
+    base = "the default cidr"
+  }
+  return "", fmt.Errorf("every network tried under %v overlaps the routes of this node, set another cidr", base)
 }
 
 func IpUInt32ToAddr(ip uint32) string {
@@ -423,24 +870,128 @@ func IpAddrToUInt32(addr string) (uint32, error) {
  return ip, nil
 }
 
-//
-func dumpConfigAndRestartVirtualTap(be backend.VpnBackend) error {
-  conf, err := be.Config()
+// errorMsg keeps the short message and appends the failed step when the
+// backend reported one
+func errorMsg(msg string, err error) string {
+  var beErr *backend.Error
+  if errors.As(err, &beErr) {
+    msg += ", " + beErr.Error()
+  }
+  return msg
+}
+
+func errorReply(msg string, err error) *pb.Reply {
+  return &pb.Reply{Code: 1, Msg: errorMsg(msg, err)}
+}
+
+func toPbCapabilities(c backend.Capabilities) *pb.Capabilities {
+  return &pb.Capabilities{
+    Protocol:       c.Protocol,
+    Ipv6:           c.IPv6,
+    PresharedKey:   c.PresharedKey,
+    LivePeerUpdate: c.LivePeerUpdate,
+    L2:             c.L2,
+    Userspace:      c.Userspace,
+  }
+}
+
+func fromPbCapabilities(c *pb.Capabilities) backend.Capabilities {
+  return backend.Capabilities{
+    Protocol:       c.GetProtocol(),
+    IPv6:           c.GetIpv6(),
+    PresharedKey:   c.GetPresharedKey(),
+    LivePeerUpdate: c.GetLivePeerUpdate(),
+    L2:             c.GetL2(),
+    Userspace:      c.GetUserspace(),
+  }
+}
+
+// dialServer connects to the server node, it gives up after dialTimeout
+// instead of holding up the other operations.
+func dialServer(addr string) (*grpc.ClientConn, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+  defer cancel()
+  return grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+}
+
+// peerName defaults to the hostname, so a node re-attaching with a new key
+// pair gets the address reserved for its name.
+func peerName(name string) string {
+  if name != "" {
+    return name
+  }
+  hostname, _ := os.Hostname()
+  return hostname
+}
+
+// virtualTapUp asks backends which know better than the host's interface
+// list, like the in-memory fake backend
+func (s *Server) virtualTapUp() bool {
+  if u, ok := s.be.(interface{ IsUp(i string) bool }); ok {
+    return u.IsUp(s.confPath)
+  }
+  _, err := net.InterfaceByName(backend.IfaceName(s.confPath))
+  return err == nil
+}
+
+func toPbReservation(pool string, r ipam.Reservation) *pb.Reservation {
+  if pool == "" {
+    pool = DefaultPool
+  }
+  return &pb.Reservation{PublicKey: r.PublicKey, Name: r.Name, Addresses: r.Addresses, Pool: pool}
+}
+
+func fromPbReservation(r *pb.Reservation) ipam.Reservation {
+  return ipam.Reservation{
+    PublicKey: strings.TrimSpace(r.GetPublicKey()),
+    Name:      strings.TrimSpace(r.GetName()),
+    Addresses: splitCIDRs(strings.Join(r.GetAddresses(), ",")),
+  }
+}
+
+func (s *Server) dumpConfig() error {
+  conf, err := s.be.Config()
   if err != nil {
     return errors.New("failed to generate config")
   }
-  if err := ioutil.WriteFile(confPath, []byte(conf), 0600); err != nil {
-    fmt.Printf("%v", err)
+  if err := ioutil.WriteFile(s.confPath, []byte(conf), 0600); err != nil {
+    s.log.Printf("%v", err)
     return errors.New("failed to generate conf file")
   }
-  if err := utils.StdIOCmd("ifconfig", "wg"); err == nil {
-    if err := be.DownInterface(confPath); err != nil {
-      return errors.New("failed to down interface")
+  return nil
+}
+
+// dumpConfigAndRestartVirtualTap is for interface level changes (address,
+// port, keys), every tunnel of the interface is dropped on the way
+func (s *Server) dumpConfigAndRestartVirtualTap() error {
+  if err := s.dumpConfig(); err != nil {
+    return err
+  }
+  if s.virtualTapUp() {
+    if err := s.be.DownInterface(s.confPath); err != nil {
+      return errors.New(errorMsg("failed to down interface", err))
     }
   }
-  if err := be.UpInterface(confPath); err != nil {
-    return errors.New("failed to up interface")
+  if err := s.be.UpInterface(s.confPath); err != nil {
+    return errors.New(errorMsg("failed to up interface", err))
   }
   return nil
 }
 
+// dumpConfigAndSyncVirtualTap is for peer changes, a running interface is
+// updated in place so the tunnels of the other peers stay untouched
+func (s *Server) dumpConfigAndSyncVirtualTap() error {
+  if err := s.dumpConfig(); err != nil {
+    return err
+  }
+  if !s.virtualTapUp() {
+    if err := s.be.UpInterface(s.confPath); err != nil {
+      return errors.New(errorMsg("failed to up interface", err))
+    }
+    return nil
+  }
+  if err := s.be.SyncInterface(s.confPath); err != nil {
+    return errors.New(errorMsg("failed to sync interface", err))
+  }
+  return nil
+}
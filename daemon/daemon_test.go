@@ -1,8 +1,25 @@
 package daemon
 
 import (
+  "context"
+  "errors"
   "fmt"
+  "io/ioutil"
+  "log"
+  "net"
+  "path"
+  "reflect"
+  "strings"
+  "sync"
   "testing"
+  "time"
+
+  "google.golang.org/grpc"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+  "github.com/GreysTone/tricarboxylic/state"
+  "github.com/GreysTone/tricarboxylic/utils"
 )
 
 func TestIpUInt32ToAddr(t *testing.T) {
@@ -33,11 +50,562 @@ func TestIpAddrToUInt32(t *testing.T) {
 }
 
 func TestNewNetworkCIDR(t *testing.T) {
-  pool := map[uint32]bool{}
-  cidr, err := NewNetworkCIDR("", &pool)
+  cidr, err := NewNetworkCIDR("")
   if err != nil {
     t.Errorf("In: %v, Got error: %v", "\"\"", err)
   }
   fmt.Printf("[SUCC] Got network: %v\n", cidr)
 }
 
+// memConfig is a Config in memory.
+type memConfig map[string]string
+
+func (c memConfig) ReadString(key string) string {
+  return c[key]
+}
+
+func (c memConfig) UpdateString(key string, value string) error {
+  c[key] = value
+  return nil
+}
+
+// newFakeOptions is an isolated node on a fake backend, with its own store,
+// config and interface file.
+func newFakeOptions(t *testing.T) (Options, *backend.Fake) {
+  dir := t.TempDir()
+  store, err := state.OpenIsolated(path.Join(dir, state.FileName))
+  if err != nil {
+    t.Fatalf("state.OpenIsolated() got error %v", err)
+  }
+  t.Cleanup(func() { store.Close() })
+  fake := &backend.Fake{}
+  return Options{
+    Backend:  fake,
+    Store:    store,
+    Config:   memConfig{},
+    Logger:   log.New(ioutil.Discard, "", 0),
+    ConfPath: path.Join(dir, "wg.conf"),
+  }, fake
+}
+
+// newServer builds a Server which sees no routes besides the tunnel.
+func newServer(t *testing.T, opts Options) *Server {
+  s, err := New(opts)
+  if err != nil {
+    t.Fatalf("New() got error %v", err)
+  }
+  s.localPrefixes = func() ([]string, error) { return nil, nil }
+  return s
+}
+
+func newFakeServer(t *testing.T) (*Server, *backend.Fake) {
+  opts, fake := newFakeOptions(t)
+  return newServer(t, opts), fake
+}
+
+func newPublicKey(t *testing.T) string {
+  k, err := backend.GeneratePrivateKey()
+  if err != nil {
+    t.Fatalf("GeneratePrivateKey() got error %v", err)
+  }
+  return k.PublicKey().String()
+}
+
+func TestServerAttachDetach(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+
+  r, err := s.ServerStart(ctx, &pb.Request{Client: "test"})
+  if err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  if r.GetMsg() != s.accessCode {
+    t.Errorf("ServerStart() = %v; expected access code %v", r.GetMsg(), s.accessCode)
+  }
+
+  first, second := newPublicKey(t), newPublicKey(t)
+  a1, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: first})
+  if err != nil || a1.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a1, err)
+  }
+  a2, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: second})
+  if err != nil || a2.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a2, err)
+  }
+  if a1.GetAssignedCIDR() == a2.GetAssignedCIDR() {
+    t.Errorf("ServerAttach() assigned %v twice", a1.GetAssignedCIDR())
+  }
+  if a1.GetSrvPublicKey() != fake.PublicKey() {
+    t.Errorf("ServerAttach() = %v; expected server key %v", a1.GetSrvPublicKey(), fake.PublicKey())
+  }
+  // the first attach brings the interface up, the second only syncs it
+  if fake.Ups != 1 || fake.Syncs != 1 {
+    t.Errorf("after attach: ups %v, syncs %v; expected 1, 1", fake.Ups, fake.Syncs)
+  }
+
+  d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: first})
+  if err != nil || d.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerDetach() = %v, %v", d, err)
+  }
+  peers := fake.Peers()
+  if len(peers) != 1 || peers[0].PublicKey != second {
+    t.Errorf("after detach: peers %v; expected only %v", peers, second)
+  }
+  if fake.Ups != 1 || fake.Syncs != 2 {
+    t.Errorf("after detach: ups %v, syncs %v; expected 1, 2", fake.Ups, fake.Syncs)
+  }
+
+  r, err = s.ServerStop(ctx, &pb.Request{Client: "test"})
+  if err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStop() = %v, %v", r, err)
+  }
+  if fake.IsUp(s.confPath) {
+    t.Errorf("after stop: interface is still up")
+  }
+}
+
+// TestConcurrentAttachDetach is meant for go test -race, peers attach and
+// detach at the same time while the reaper, the reconciler and status run.
+func TestServerAttachAgain(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  key := newPublicKey(t)
+  a1, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key, Ttl: 60})
+  if err != nil || a1.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a1, err)
+  }
+  // renewing the ttl keeps the address and the one peer
+  a2, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key, Ttl: 120})
+  if err != nil || a2.GetStatus().GetCode() != 0 || a2.GetAssignedCIDR() != a1.GetAssignedCIDR() {
+    t.Fatalf("ServerAttach() again = %v, %v; expected %v", a2, err, a1.GetAssignedCIDR())
+  }
+  if peers := fake.Peers(); len(peers) != 1 {
+    t.Errorf("after attaching again: peers %v; expected one", peers)
+  }
+
+  if d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || d.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerDetach() = %v, %v", d, err)
+  }
+  if peers := fake.Peers(); len(peers) != 0 {
+    t.Errorf("after detach: peers %v; expected none", peers)
+  }
+}
+
+func TestClientAttachUnlocked(t *testing.T) {
+  srv, srvFake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := srv.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  // the server holds the attach until released
+  attaching, release := make(chan struct{}), make(chan struct{})
+  hold := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    if info.FullMethod == "/rpc.Tricarb/ServerAttach" {
+      close(attaching)
+      <-release
+    }
+    return handler(ctx, req)
+  }
+  lis, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  serve(t, srv, lis, grpc.UnaryInterceptor(hold))
+  _, port, _ := net.SplitHostPort(lis.Addr().String())
+
+  s, fake := newFakeServer(t)
+  info := &pb.ServerInfo{Host: "127.0.0.1", Port: port, AccessCode: srv.accessCode}
+  attached := make(chan *pb.Reply, 1)
+  go func() {
+    r, _ := s.ClientAttach(ctx, info)
+    attached <- r
+  }()
+  <-attaching
+  // the other operations go on while the server answers
+  done := make(chan struct{})
+  go func() {
+    s.Reconcile(false)
+    close(done)
+  }()
+  select {
+  case <-done:
+  case <-time.After(2 * time.Second):
+    t.Errorf("Reconcile() waited for the server to answer ClientAttach()")
+  }
+  close(release)
+  if r := <-attached; r.GetCode() != 0 {
+    t.Fatalf("ClientAttach() = %v", r)
+  }
+  if peers := fake.Peers(); len(peers) != 1 || peers[0].PublicKey != srvFake.PublicKey() || s.workingMode != TyClientMode {
+    t.Errorf("after ClientAttach(): peers %v, role %v; expected the server as client", peers, s.workingMode)
+  }
+  if peers := srvFake.Peers(); len(peers) != 1 || peers[0].PublicKey != fake.PublicKey() {
+    t.Errorf("after ClientAttach(): server peers %v; expected %v", peers, fake.PublicKey())
+  }
+
+  if r, err := s.ClientDetach(ctx, info); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ClientDetach() = %v, %v", r, err)
+  }
+  if len(fake.Peers()) != 0 || len(srvFake.Peers()) != 0 || s.workingMode != TyIdleMode {
+    t.Errorf("after ClientDetach(): peers %v, server peers %v, role %v", fake.Peers(), srvFake.Peers(), s.workingMode)
+  }
+}
+
+func TestConcurrentAttachDetach(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+
+  const n = 32
+  keys := []string{}
+  for i := 0; i < n; i++ {
+    keys = append(keys, newPublicKey(t))
+  }
+  var wg sync.WaitGroup
+  background := func() {
+    defer wg.Done()
+    s.Reap(time.Now())
+    s.Reconcile(true)
+    s.Status(ctx, &pb.Request{Client: "test"})
+    s.ListPeers(ctx, &pb.Request{Client: "test"})
+  }
+  addrs := make([]string, n)
+  for i, key := range keys {
+    wg.Add(2)
+    go func(i int, key string) {
+      defer wg.Done()
+      a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+      if err != nil || a.GetStatus().GetCode() != 0 {
+        t.Errorf("ServerAttach() = %v, %v", a, err)
+        return
+      }
+      addrs[i] = a.GetAssignedCIDR()
+    }(i, key)
+    go background()
+  }
+  wg.Wait()
+
+  seen := map[string]bool{}
+  for _, addr := range addrs {
+    if seen[addr] {
+      t.Errorf("ServerAttach() assigned %v twice", addr)
+    }
+    seen[addr] = true
+  }
+  if peers := fake.Peers(); len(peers) != n {
+    t.Errorf("after attach: %v peers; expected %v", len(peers), n)
+  }
+
+  for _, key := range keys {
+    wg.Add(2)
+    go func(key string) {
+      defer wg.Done()
+      d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+      if err != nil || d.GetStatus().GetCode() != 0 {
+        t.Errorf("ServerDetach() = %v, %v", d, err)
+      }
+    }(key)
+    go background()
+  }
+  wg.Wait()
+  if peers, leases := fake.Peers(), s.addrPool.Leases(); len(peers) != 0 || len(leases) != 0 {
+    t.Errorf("after detach: peers %v, leases %v; expected none", peers, leases)
+  }
+}
+
+func TestServerAttachRejected(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: "wrong", PeerPublicKey: newPublicKey(t)})
+  if err != nil || a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach(wrong access code) = %v, %v; expected failure", a, err)
+  }
+  a, err = s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: "not-a-key"})
+  if err != nil || a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach(invalid key) = %v, %v; expected failure", a, err)
+  }
+  if !strings.Contains(a.GetStatus().GetMsg(), backend.ErrInvalidKey.Error()) {
+    t.Errorf("ServerAttach(invalid key) = %v; expected the backend error", a.GetStatus().GetMsg())
+  }
+  if peers := fake.Peers(); len(peers) != 0 || fake.Ups != 0 {
+    t.Errorf("after rejected attaches: peers %v, ups %v; expected none", peers, fake.Ups)
+  }
+}
+
+func TestSetNetIC(t *testing.T) {
+  s, _ := newFakeServer(t)
+  runner := &utils.RecordRunner{Errors: map[string]error{"ifconfig": errors.New("no such device")}}
+  defer utils.SetRunner(utils.SetRunner(runner))
+
+  r, err := s.SetNetIC(context.Background(), &pb.ConfigRequest{Config: "eth9"})
+  if err == nil || r.GetCode() == 0 {
+    t.Errorf("SetNetIC(eth9) = %v, %v; expected failure", r, err)
+  }
+  if cmds := runner.Commands(); len(cmds) != 1 || cmds[0] != "ifconfig eth9" {
+    t.Errorf("SetNetIC(eth9) ran %v; expected [ifconfig eth9]", cmds)
+  }
+}
+
+func TestServerAttachProtocolMismatch(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{
+    AccessCode:    s.accessCode,
+    PeerPublicKey: newPublicKey(t),
+    Capabilities:  &pb.Capabilities{Protocol: backend.ProtoOpenVPN},
+  })
+  if err != nil || a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach(openvpn peer) = %v, %v; expected failure", a, err)
+  }
+  if len(fake.Peers()) != 0 {
+    t.Errorf("after rejected attach: peers %v; expected none", fake.Peers())
+  }
+
+  a, err = s.ServerAttach(ctx, &pb.PeerInfo{
+    AccessCode:    s.accessCode,
+    PeerPublicKey: newPublicKey(t),
+    Capabilities:  &pb.Capabilities{Protocol: backend.ProtoWireGuard, LivePeerUpdate: true, Userspace: true},
+  })
+  if err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach(wireguard peer) = %v, %v", a, err)
+  }
+  if caps := a.GetCapabilities(); !caps.GetLivePeerUpdate() || caps.GetUserspace() || caps.GetIpv6() {
+    t.Errorf("ServerAttach(wireguard peer) negotiated %v; expected live-peer-update only", caps)
+  }
+}
+
+func TestSetCIDRIPv6Unsupported(t *testing.T) {
+  s, fake := newFakeServer(t)
+  fake.Caps = backend.Capabilities{Protocol: backend.ProtoOpenVPN, Userspace: true}
+  r, err := s.SetCIDR(context.Background(), &pb.ConfigRequest{Config: "fd00::/64"})
+  if err != nil || r.GetCode() == 0 {
+    t.Errorf("SetCIDR(fd00::/64) = %v, %v; expected failure", r, err)
+  }
+}
+
+func TestSetCIDRWithPeers(t *testing.T) {
+  s, _ := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  key := newPublicKey(t)
+  if a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a, err)
+  }
+  networks := s.addrPool.Networks()
+  r, err := s.SetCIDR(ctx, &pb.ConfigRequest{Config: "10.99.0.0/16"})
+  if err != nil || r.GetCode() == 0 {
+    t.Errorf("SetCIDR() with an attached peer = %v, %v; expected failure", r, err)
+  }
+  if !reflect.DeepEqual(s.addrPool.Networks(), networks) || len(s.addrPool.Leases()) != 1 {
+    t.Errorf("after a refused SetCIDR(): networks %v, leases %v; expected %v kept", s.addrPool.Networks(), s.addrPool.Leases(), networks)
+  }
+
+  if d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || d.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerDetach() = %v, %v", d, err)
+  }
+  if r, err := s.SetCIDR(ctx, &pb.ConfigRequest{Config: "10.99.0.0/16"}); err != nil || r.GetCode() != 0 {
+    t.Errorf("SetCIDR() without peers = %v, %v", r, err)
+  }
+}
+
+func TestServerRestartKeepsLeases(t *testing.T) {
+  opts, _ := newFakeOptions(t)
+  s := newServer(t, opts)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  a1, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: newPublicKey(t)})
+  if err != nil || a1.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a1, err)
+  }
+
+  // tricarbd restarted, only the store is left
+  networks := s.addrPool.Networks()
+  s = newServer(t, opts)
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  if !reflect.DeepEqual(s.addrPool.Networks(), networks) {
+    t.Errorf("after restart: networks %v; expected %v", s.addrPool.Networks(), networks)
+  }
+  a2, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: newPublicKey(t)})
+  if err != nil || a2.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a2, err)
+  }
+  if a1.GetAssignedCIDR() == a2.GetAssignedCIDR() {
+    t.Errorf("after restart: assigned %v twice", a1.GetAssignedCIDR())
+  }
+}
+
+// TestServersAreIsolated runs two nodes in one process, e.g. a program
+// embedding both ends of a tunnel.
+func TestServersAreIsolated(t *testing.T) {
+  a, fakeA := newFakeServer(t)
+  b, fakeB := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := a.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  if a.accessCode == b.accessCode {
+    t.Errorf("both servers have access code %v", a.accessCode)
+  }
+  if r, _ := b.Status(ctx, &pb.Request{Client: "test"}); !strings.HasPrefix(r.GetMsg(), "role: idle\n") {
+    t.Errorf("Status() of the other server = %q; expected it idle", r.GetMsg())
+  }
+  key := newPublicKey(t)
+  if r, err := a.ServerAttach(ctx, &pb.PeerInfo{AccessCode: a.accessCode, PeerPublicKey: key}); err != nil || r.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", r, err)
+  }
+  if len(fakeA.Peers()) != 1 || len(fakeB.Peers()) != 0 || len(b.addrPool.Leases()) != 0 {
+    t.Errorf("peers %v, %v, leases of the other %v; expected the peer only on the first", fakeA.Peers(), fakeB.Peers(), b.addrPool.Leases())
+  }
+}
+
+func TestServerAttachReservation(t *testing.T) {
+  s, _ := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  rsv, err := s.AddReservation(ctx, &pb.Reservation{Name: "laptop"})
+  if err != nil || rsv.GetStatus().GetCode() != 0 {
+    t.Fatalf("AddReservation(laptop) = %v, %v", rsv, err)
+  }
+  expected := rsv.GetReservation().GetAddresses()[0]
+
+  // another peer attaching first does not take the reserved address
+  if a, _ := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: newPublicKey(t)}); strings.HasPrefix(a.GetAssignedCIDR(), expected+"/") {
+    t.Errorf("ServerAttach() assigned the reserved %v", expected)
+  }
+  // the laptop re-attaches with a new key pair and keeps its address
+  for i := 0; i < 2; i++ {
+    key := newPublicKey(t)
+    a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key, PeerName: "laptop"})
+    if err != nil || !strings.HasPrefix(a.GetAssignedCIDR(), expected+"/") {
+      t.Errorf("ServerAttach(laptop) = %v, %v; expected %v", a, err, expected)
+    }
+    if d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || d.GetStatus().GetCode() != 0 {
+      t.Fatalf("ServerDetach(laptop) = %v, %v", d, err)
+    }
+  }
+
+  l, err := s.ListReservations(ctx, &pb.Request{Client: "test"})
+  if err != nil || len(l.GetReservations()) != 1 {
+    t.Errorf("ListReservations() = %v, %v; expected the laptop", l, err)
+  }
+  if d, err := s.DelReservation(ctx, &pb.Reservation{Name: "laptop"}); err != nil || d.GetStatus().GetCode() != 0 {
+    t.Errorf("DelReservation(laptop) = %v, %v", d, err)
+  }
+  if d, err := s.DelReservation(ctx, &pb.Reservation{Name: "laptop"}); err != nil || d.GetStatus().GetCode() == 0 {
+    t.Errorf("DelReservation(laptop) again = %v, %v; expected failure", d, err)
+  }
+}
+
+func TestNewNetworkCIDR6(t *testing.T) {
+  for base, prefix := range map[string]string{
+    "fd00::/8":            "fd",
+    "fc00::/7":            "fd",
+    "fd12:3456:789a::/48": "fd12:3456:789a:",
+  } {
+    actual, err := NewNetworkCIDR(base)
+    if err != nil {
+      t.Fatalf("NewNetworkCIDR(%v) got error %v", base, err)
+    }
+    ip, ipNet, err := net.ParseCIDR(actual)
+    if err != nil || !strings.HasPrefix(actual, prefix) || !strings.HasSuffix(actual, "/64") {
+      t.Errorf("NewNetworkCIDR(%v) = %v; expected a /64 under %v", base, actual, base)
+      continue
+    }
+    server := ipNet.IP
+    server[15]++
+    if !ip.Equal(server) {
+      t.Errorf("NewNetworkCIDR(%v) = %v; expected the first address as the server's", base, actual)
+    }
+  }
+}
+
+func TestServerAttachDualStack(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.SetCIDR(ctx, &pb.ConfigRequest{Config: "10.0.0.0/8, fd00::/8"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("SetCIDR(10.0.0.0/8, fd00::/8) = %v, %v", r, err)
+  }
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  if addrs := fake.Interface().Addresses(); len(addrs) != 2 {
+    t.Errorf("ServerStart() configured %v; expected an ipv4 and an ipv6 address", addrs)
+  }
+
+  key := newPublicKey(t)
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+  if err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a, err)
+  }
+  cidrs := a.GetAssignedCIDRs()
+  if len(cidrs) != 2 || a.GetAssignedCIDR() != cidrs[0] || !strings.HasPrefix(cidrs[1], "fd") {
+    t.Errorf("ServerAttach() assigned %v, %v; expected an ipv4 and an ipv6 address", a.GetAssignedCIDR(), cidrs)
+  }
+  peers := fake.Peers()
+  if len(peers) != 1 || len(peers[0].AllowedIPs) != 2 || !strings.HasSuffix(peers[0].AllowedIPs[1], "/128") {
+    t.Errorf("after attach: peers %v; expected %v with a /32 and a /128", peers, key)
+  }
+}
+
+func TestServerAttachOverlap(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  s.tricarbCIDR = "10.0.0.0/20"
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  network := s.addrPool.Networks()[0]
+
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{
+    AccessCode:    s.accessCode,
+    PeerPublicKey: newPublicKey(t),
+    LocalPrefixes: []string{"192.168.1.0/24", network},
+  })
+  if err != nil || a.GetStatus().GetCode() == 0 || !strings.Contains(a.GetStatus().GetMsg(), "overlaps") {
+    t.Errorf("ServerAttach() of a client routing %v = %v, %v; expected an overlap", network, a, err)
+  }
+  if len(fake.Peers()) != 0 {
+    t.Errorf("after rejected attach: peers %v; expected none", fake.Peers())
+  }
+
+  // the real prefix length instead of a /24
+  a, err = s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: newPublicKey(t)})
+  if err != nil || !strings.HasSuffix(a.GetAssignedCIDR(), "/20") {
+    t.Errorf("ServerAttach() = %v, %v; expected an address in %v", a, err, network)
+  }
+}
+
+func TestServerStartAvoidsLocalRoutes(t *testing.T) {
+  s, _ := newFakeServer(t)
+  // the base leaves a single network to pick
+  s.tricarbCIDR = "fd12:3456:789a:1::/64"
+  s.localPrefixes = func() ([]string, error) { return []string{"fd12:3456:789a::/48"}, nil }
+  r, err := s.ServerStart(context.Background(), &pb.Request{Client: "test"})
+  if err != nil || r.GetCode() == 0 || !strings.Contains(r.GetMsg(), "overlaps") {
+    t.Errorf("ServerStart() = %v, %v; expected an overlap with the local routes", r, err)
+  }
+  if networks := s.addrPool.Networks(); len(networks) != 0 {
+    t.Errorf("after failed start: networks %v; expected none", networks)
+  }
+}
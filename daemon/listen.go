@@ -0,0 +1,77 @@
+package daemon
+
+import (
+  "context"
+  "net"
+  "os"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+// peerMethods are the RPCs of the public address, those a client node calls
+// on a server node to join and leave. Everything else changes this node and
+// is only served on the admin socket.
+var peerMethods = map[string]bool{
+  "/rpc.Tricarb/ServerAttach": true,
+  "/rpc.Tricarb/ServerDetach": true,
+}
+
+// PeerOnly is the interceptor of the public address, it refuses every RPC
+// but joining and leaving.
+func PeerOnly(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+  if !peerMethods[info.FullMethod] {
+    return nil, status.Errorf(codes.PermissionDenied, "%v is only served on the admin socket", info.FullMethod)
+  }
+  return handler(ctx, req)
+}
+
+// ListenAdmin listens on the unix socket of the admin API. Only its owner
+// may open the socket, and a connection is only accepted from root or the
+// user tricarbd runs as, whatever the mode of the file.
+func (s *Server) ListenAdmin(file string) (net.Listener, error) {
+  // left behind by a tricarbd which did not stop cleanly, a running one
+  // holds the state store and New already failed
+  if fi, err := os.Lstat(file); err == nil && fi.Mode()&os.ModeSocket != 0 {
+    if err := os.Remove(file); err != nil {
+      return nil, err
+    }
+  }
+  lis, err := net.Listen("unix", file)
+  if err != nil {
+    return nil, err
+  }
+  if err := os.Chmod(file, 0600); err != nil {
+    lis.Close()
+    return nil, err
+  }
+  return &adminListener{Listener: lis, s: s}, nil
+}
+
+// adminListener drops the connections of other users.
+type adminListener struct {
+  net.Listener
+  s *Server
+}
+
+func (l *adminListener) Accept() (net.Conn, error) {
+  for {
+    conn, err := l.Listener.Accept()
+    if err != nil {
+      return nil, err
+    }
+    cred, err := utils.PeerCred(conn)
+    if err == nil && (cred.Uid == 0 || int(cred.Uid) == os.Geteuid()) {
+      return conn, nil
+    }
+    if err != nil {
+      l.s.log.Printf("warning: refused an admin connection: %v\n", err)
+    } else {
+      l.s.log.Printf("warning: refused an admin connection of uid %v\n", cred.Uid)
+    }
+    conn.Close()
+  }
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+  "context"
+  "errors"
+  "net"
+  "os"
+  "path"
+  "testing"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  "github.com/GreysTone/tricarboxylic/client"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+// serve serves s on lis until the test ends.
+func serve(t *testing.T, s *Server, lis net.Listener, opts ...grpc.ServerOption) {
+  g := grpc.NewServer(opts...)
+  pb.RegisterTricarbServer(g, s)
+  go g.Serve(lis)
+  t.Cleanup(g.Stop)
+}
+
+func dialClient(t *testing.T, addr string) *client.Client {
+  c, err := client.Dial(client.Options{Addr: addr})
+  if err != nil {
+    t.Fatalf("Dial(%v) got error %v", addr, err)
+  }
+  t.Cleanup(func() { c.Close() })
+  return c
+}
+
+func TestListenAdmin(t *testing.T) {
+  s, _ := newFakeServer(t)
+  file := path.Join(t.TempDir(), "tricarbd.sock")
+
+  // a socket left behind is replaced
+  stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: file, Net: "unix"})
+  if err != nil {
+    t.Fatalf("ListenUnix() got error %v", err)
+  }
+  stale.SetUnlinkOnClose(false)
+  stale.Close()
+
+  lis, err := s.ListenAdmin(file)
+  if err != nil {
+    t.Fatalf("ListenAdmin(%v) got error %v", file, err)
+  }
+  if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+    t.Errorf("admin socket mode %v, %v; expected 0600", fi.Mode().Perm(), err)
+  }
+  serve(t, s, lis)
+
+  c := dialClient(t, "unix://"+file)
+  if _, err := c.StartServer(context.Background()); err != nil {
+    t.Errorf("StartServer() on the admin socket got error %v", err)
+  }
+}
+
+func TestPublicOnlyJoins(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  lis, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen() got error %v", err)
+  }
+  serve(t, s, lis, grpc.UnaryInterceptor(PeerOnly))
+  c := dialClient(t, lis.Addr().String())
+
+  err = c.StopServer(ctx)
+  if status.Code(errors.Unwrap(err)) != codes.PermissionDenied {
+    t.Errorf("StopServer() on the public address got error %v; expected it denied", err)
+  }
+  if s.workingMode != TyServerMode {
+    t.Errorf("after a denied stop: role %v; expected server", s.workingMode)
+  }
+
+  key := newPublicKey(t)
+  a, err := c.RPC().ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+  if err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() on the public address = %v, %v", a, err)
+  }
+  d, err := c.RPC().ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+  if err != nil || d.GetStatus().GetCode() != 0 || len(fake.Peers()) != 0 {
+    t.Errorf("ServerDetach() on the public address = %v, %v; peers %v", d, err, fake.Peers())
+  }
+}
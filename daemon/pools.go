@@ -0,0 +1,289 @@
+package daemon
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+
+  "github.com/GreysTone/tricarboxylic/ipam"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+const (
+  ConfPoolsKey = "pools"
+
+  // the pool of tricarbCIDR and accessCode
+  DefaultPool = "default"
+)
+
+var (
+  poolName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
+
+// group is a named pool with its own base CIDR and access code, the access
+// code a peer attaches with decides which networks its addresses come from
+// so firewall rules can match a group by subnet.
+type group struct {
+  CIDR   string
+  Access string
+  pool   *ipam.Pool
+}
+
+// loadGroups reads the named pools from the state store.
+func (s *Server) loadGroups() error {
+  saved := map[string]*group{}
+  if _, err := s.store.Get(ConfPoolsKey, &saved); err != nil {
+    return err
+  }
+  for name, g := range saved {
+    pool, err := ipam.New(s.newPoolStore(name))
+    if err != nil {
+      return fmt.Errorf("pool %v: %w", name, err)
+    }
+    g.pool = pool
+    s.groups[name] = g
+  }
+  return nil
+}
+
+func (s *Server) saveGroups() error {
+  return s.store.Put(ConfPoolsKey, s.groups)
+}
+
+// poolFor returns the pool of the access code and its name.
+func (s *Server) poolFor(access string) (*ipam.Pool, string, bool) {
+  if access == s.accessCode {
+    return s.addrPool, DefaultPool, true
+  }
+  for name, g := range s.groups {
+    if g.Access == access {
+      return g.pool, name, true
+    }
+  }
+  return nil, "", false
+}
+
+// leasedIn returns the name of the pool holding a lease of the public key.
+func (s *Server) leasedIn(publicKey string) (string, bool) {
+  if _, ok := s.addrPool.Lease(publicKey); ok {
+    return DefaultPool, true
+  }
+  for name, g := range s.groups {
+    if _, ok := g.pool.Lease(publicKey); ok {
+      return name, true
+    }
+  }
+  return "", false
+}
+
+// poolNamed returns the pool of the name, empty is the default one.
+func (s *Server) poolNamed(name string) (*ipam.Pool, bool) {
+  if name == "" || name == DefaultPool {
+    return s.addrPool, true
+  }
+  g, ok := s.groups[name]
+  if !ok {
+    return nil, false
+  }
+  return g.pool, true
+}
+
+func (s *Server) groupNames() []string {
+  names := []string{}
+  for name := range s.groups {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// serverNetworks are the networks of every pool, the server holds the first
+// address of each.
+func (s *Server) serverNetworks() []string {
+  networks := s.addrPool.Networks()
+  for _, name := range s.groupNames() {
+    networks = append(networks, s.groups[name].pool.Networks()...)
+  }
+  return networks
+}
+
+// ensureNetworks picks the networks of a pool without any, avoiding the
+// routes of this node and the networks of the other pools.
+func (s *Server) ensureNetworks(pool *ipam.Pool, cidrs string, avoid []string) ([]string, error) {
+  if networks := pool.Networks(); len(networks) != 0 {
+    return networks, nil
+  }
+  bases := splitCIDRs(cidrs)
+  if len(bases) == 0 {
+    // a random ipv4 /24
+    bases = []string{""}
+  }
+  avoid = append(append([]string{}, avoid...), s.serverNetworks()...)
+  networks := []string{}
+  for _, base := range bases {
+    network, err := newFreeNetworkCIDR(base, avoid)
+    if err != nil {
+      return nil, err
+    }
+    networks = append(networks, network)
+    avoid = append(avoid, network)
+  }
+  if err := pool.Reset(networks...); err != nil {
+    return nil, err
+  }
+  return networks, nil
+}
+
+// serverStarted tells whether the networks were picked, the pools added
+// afterwards get theirs right away.
+func (s *Server) serverStarted() bool {
+  return len(s.addrPool.Networks()) != 0
+}
+
+// refuseRestart refuses to change the addresses of a running server while
+// peers are attached, the interface restarts to apply them and the tunnels
+// of the peers drop. A stopped server or one without peers takes the change.
+func (s *Server) refuseRestart(change string) *pb.Reply {
+  if s.be == nil || !s.serverStarted() || !s.virtualTapUp() {
+    return nil
+  }
+  n := len(s.addrPool.Leases())
+  for _, g := range s.groups {
+    n += len(g.pool.Leases())
+  }
+  if n == 0 {
+    return nil
+  }
+  return &pb.Reply{Code: 1, Msg: fmt.Sprintf("%v restarts the interface of the server and %v peers are attached, detach them or stop the server first", change, n)}
+}
+
+// updateServerAddress gives the running server an address in each network.
+func (s *Server) updateServerAddress() error {
+  iface := s.be.Interface()
+  iface.Address = strings.Join(s.serverNetworks(), ", ")
+  if err := s.be.NewInterface(iface); err != nil {
+    return errors.New(errorMsg("failed to update interface", err))
+  }
+  if s.virtualTapUp() {
+    return s.dumpConfigAndRestartVirtualTap()
+  }
+  return s.dumpConfig()
+}
+
+// AddPool gives a started server a network in the new pool right away, a
+// running interface restarts for its new address. It is refused while peers
+// are attached, see refuseRestart.
+func (s *Server) AddPool(ctx context.Context, in *pb.Pool) (*pb.PoolReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  name := strings.TrimSpace(in.GetName())
+  if !poolName.MatchString(name) || name == DefaultPool {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: "invalid pool name, lower case letters, digits and dashes"}}, nil
+  }
+  if _, ok := s.groups[name]; ok {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: "pool " + name + " exists"}}, nil
+  }
+  cidr := strings.TrimSpace(in.GetCidr())
+  if err := s.checkCIDRs(cidr); err != nil {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}}, nil
+  }
+  if r := s.refuseRestart("adding a pool"); r != nil {
+    return &pb.PoolReply{Status: r}, nil
+  }
+
+  ch, err := s.begin()
+  if err != nil {
+    return &pb.PoolReply{Status: errorReply("failed to begin", err)}, nil
+  }
+  pool, err := ipam.New(s.newPoolStore(name))
+  if err == nil {
+    ch.track(pool)
+    // the state left by a deleted pool of the same name
+    err = pool.Reset()
+  }
+  if err != nil {
+    return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to create pool, " + err.Error()})}, nil
+  }
+  g := &group{CIDR: cidr, Access: utils.GenerateAccessCode(32), pool: pool}
+  if s.serverStarted() {
+    avoid, err := s.localPrefixes()
+    if err != nil {
+      s.log.Printf("warning: failed to read routes, the network may overlap them: %v\n", err)
+    }
+    if _, err := s.ensureNetworks(pool, cidr, avoid); err != nil {
+      return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to create network, " + err.Error()})}, nil
+    }
+  }
+  s.groups[name] = g
+  if err := s.saveGroups(); err != nil {
+    return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to save pool, " + err.Error()})}, nil
+  }
+  if s.serverStarted() && s.be != nil {
+    if err := s.updateServerAddress(); err != nil {
+      return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})}, nil
+    }
+  }
+  return &pb.PoolReply{Status: &pb.Reply{Code: 0, Msg: ""}, Pool: toPbPool(name, g)}, nil
+}
+
+func (s *Server) ListPools(ctx context.Context, in *pb.Request) (*pb.PoolsReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  reply := &pb.PoolsReply{Status: &pb.Reply{Code: 0, Msg: ""}}
+  reply.Pools = append(reply.Pools, toPbPool(DefaultPool, &group{CIDR: s.tricarbCIDR, Access: s.accessCode, pool: s.addrPool}))
+  for _, name := range s.groupNames() {
+    reply.Pools = append(reply.Pools, toPbPool(name, s.groups[name]))
+  }
+  return reply, nil
+}
+
+// DelPool refuses a pool with peers, they lose their addresses otherwise. A
+// running interface restarts to drop the address of the pool, so it is
+// refused while peers of other pools are attached as well.
+func (s *Server) DelPool(ctx context.Context, in *pb.Pool) (*pb.PoolReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  name := strings.TrimSpace(in.GetName())
+  g, ok := s.groups[name]
+  if !ok {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: "no pool " + name}}, nil
+  }
+  if n := len(g.pool.Leases()); n != 0 {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: fmt.Sprintf("pool %v has %v peers, detach them first", name, n)}}, nil
+  }
+  if r := s.refuseRestart("deleting a pool"); r != nil {
+    return &pb.PoolReply{Status: r}, nil
+  }
+  reply := toPbPool(name, g)
+  ch, err := s.begin()
+  if err != nil {
+    return &pb.PoolReply{Status: errorReply("failed to begin", err)}, nil
+  }
+  if err := g.pool.Reset(); err != nil {
+    return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to reset pool, " + err.Error()})}, nil
+  }
+  delete(s.groups, name)
+  if err := s.saveGroups(); err != nil {
+    return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: "failed to save pools, " + err.Error()})}, nil
+  }
+  if s.serverStarted() && s.be != nil {
+    if err := s.updateServerAddress(); err != nil {
+      return &pb.PoolReply{Status: ch.fail(&pb.Reply{Code: 1, Msg: err.Error()})}, nil
+    }
+  }
+  return &pb.PoolReply{Status: &pb.Reply{Code: 0, Msg: ""}, Pool: reply}, nil
+}
+
+func toPbPool(name string, g *group) *pb.Pool {
+  return &pb.Pool{
+    Name:       name,
+    Cidr:       g.CIDR,
+    AccessCode: g.Access,
+    Networks:   g.pool.Networks(),
+    Peers:      uint32(len(g.pool.Leases())),
+  }
+}
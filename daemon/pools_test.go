@@ -0,0 +1,185 @@
+package daemon
+
+import (
+  "context"
+  "net"
+  "strings"
+  "testing"
+
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+func inNetwork(t *testing.T, cidr string, network string) bool {
+  ip, _, err := net.ParseCIDR(cidr)
+  if err != nil {
+    t.Fatalf("ParseCIDR(%v) got error %v", cidr, err)
+  }
+  _, ipNet, _ := net.ParseCIDR(network)
+  return ipNet.Contains(ip)
+}
+
+func mustPoolReply(r *pb.PoolReply, err error) *pb.PoolReply {
+  if err != nil {
+    return &pb.PoolReply{Status: &pb.Reply{Code: 1, Msg: err.Error()}}
+  }
+  return r
+}
+
+func TestPools(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  laptops, err := s.AddPool(ctx, &pb.Pool{Name: "laptops", Cidr: "10.0.0.0/16"})
+  if err != nil || laptops.GetStatus().GetCode() != 0 {
+    t.Fatalf("AddPool(laptops) = %v, %v", laptops, err)
+  }
+  if r, _ := s.AddPool(ctx, &pb.Pool{Name: "laptops"}); r.GetStatus().GetCode() == 0 {
+    t.Errorf("AddPool(laptops) again succeeded; expected failure")
+  }
+  if r, _ := s.AddPool(ctx, &pb.Pool{Name: DefaultPool}); r.GetStatus().GetCode() == 0 {
+    t.Errorf("AddPool(%v) succeeded; expected failure", DefaultPool)
+  }
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  // a pool added to a running server gets its network right away
+  guests, err := s.AddPool(ctx, &pb.Pool{Name: "guests"})
+  if err != nil || guests.GetStatus().GetCode() != 0 || len(guests.GetPool().GetNetworks()) != 1 {
+    t.Fatalf("AddPool(guests) = %v, %v; expected a network", guests, err)
+  }
+
+  l, err := s.ListPools(ctx, &pb.Request{Client: "test"})
+  if err != nil || len(l.GetPools()) != 3 {
+    t.Fatalf("ListPools() = %v, %v; expected default, guests and laptops", l, err)
+  }
+  networks := map[string]string{}
+  for _, p := range l.GetPools() {
+    networks[p.GetName()] = p.GetNetworks()[0]
+  }
+  if addrs := fake.Interface().Addresses(); len(addrs) != 3 {
+    t.Errorf("server addresses %v; expected one in each pool", addrs)
+  }
+
+  keys := map[string]string{}
+  for name, access := range map[string]string{
+    DefaultPool: s.accessCode,
+    "laptops":   laptops.GetPool().GetAccessCode(),
+    "guests":    guests.GetPool().GetAccessCode(),
+  } {
+    key := newPublicKey(t)
+    keys[name] = key
+    a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: access, PeerPublicKey: key})
+    if err != nil || a.GetStatus().GetCode() != 0 || !inNetwork(t, a.GetAssignedCIDR(), networks[name]) {
+      t.Errorf("ServerAttach(%v) = %v, %v; expected an address in %v", name, a, err, networks[name])
+    }
+  }
+  if a, _ := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: "bogus", PeerPublicKey: newPublicKey(t)}); a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach(bogus) succeeded; expected an invalid access code")
+  }
+
+  if r, _ := s.DelPool(ctx, &pb.Pool{Name: "guests"}); r.GetStatus().GetCode() == 0 || !strings.Contains(r.GetStatus().GetMsg(), "peers") {
+    t.Errorf("DelPool(guests) = %v; expected a refusal with peers", r)
+  }
+  if d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: guests.GetPool().GetAccessCode(), PeerPublicKey: keys["guests"]}); err != nil || d.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerDetach(guests) = %v, %v", d, err)
+  }
+  // the interface restarts for its addresses, the other peers would drop
+  for _, r := range []*pb.PoolReply{
+    mustPoolReply(s.DelPool(ctx, &pb.Pool{Name: "guests"})),
+    mustPoolReply(s.AddPool(ctx, &pb.Pool{Name: "printers"})),
+  } {
+    if r.GetStatus().GetCode() == 0 || !strings.Contains(r.GetStatus().GetMsg(), "restarts") {
+      t.Errorf("pool change of a server with peers = %v; expected a refusal", r)
+    }
+  }
+  if r, err := s.ServerStop(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStop() = %v, %v", r, err)
+  }
+  if r, err := s.DelPool(ctx, &pb.Pool{Name: "guests"}); err != nil || r.GetStatus().GetCode() != 0 {
+    t.Errorf("DelPool(guests) of a stopped server = %v, %v", r, err)
+  }
+  if addrs := fake.Interface().Addresses(); len(addrs) != 2 {
+    t.Errorf("after delete: server addresses %v; expected two", addrs)
+  }
+  if a, _ := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: guests.GetPool().GetAccessCode(), PeerPublicKey: newPublicKey(t)}); a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach() with the access code of a deleted pool succeeded")
+  }
+}
+
+func TestPoolReservation(t *testing.T) {
+  s, _ := newFakeServer(t)
+  ctx := context.Background()
+  s.AddPool(ctx, &pb.Pool{Name: "servers"})
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  if r, _ := s.AddReservation(ctx, &pb.Reservation{Name: "db", Pool: "nope"}); r.GetStatus().GetCode() == 0 {
+    t.Errorf("AddReservation() in a missing pool succeeded")
+  }
+  r, err := s.AddReservation(ctx, &pb.Reservation{Name: "db", Pool: "servers"})
+  if err != nil || r.GetStatus().GetCode() != 0 {
+    t.Fatalf("AddReservation(db) = %v, %v", r, err)
+  }
+  l, _ := s.ListReservations(ctx, &pb.Request{Client: "test"})
+  if len(l.GetReservations()) != 1 || l.GetReservations()[0].GetPool() != "servers" {
+    t.Errorf("ListReservations() = %v; expected db in servers", l)
+  }
+}
+
+func TestPoolOfPeer(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  guests, err := s.AddPool(ctx, &pb.Pool{Name: "guests"})
+  if err != nil || guests.GetStatus().GetCode() != 0 {
+    t.Fatalf("AddPool(guests) = %v, %v", guests, err)
+  }
+  key := newPublicKey(t)
+  if a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach(%v) = %v, %v", DefaultPool, a, err)
+  }
+
+  // the code of another pool neither leases a second address nor detaches
+  if a, _ := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: guests.GetPool().GetAccessCode(), PeerPublicKey: key}); a.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerAttach(guests) of a peer in %v succeeded", DefaultPool)
+  }
+  if d, _ := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: guests.GetPool().GetAccessCode(), PeerPublicKey: key}); d.GetStatus().GetCode() == 0 {
+    t.Errorf("ServerDetach(guests) of a peer in %v succeeded", DefaultPool)
+  }
+  if _, ok := s.groups["guests"].pool.Lease(key); ok {
+    t.Errorf("peer in %v got a lease in guests", DefaultPool)
+  }
+  if _, ok := s.addrPool.Lease(key); !ok || len(fake.Peers()) != 1 {
+    t.Errorf("after refusals: lease %v, peers %v; expected the peer kept", ok, fake.Peers())
+  }
+
+  if d, err := s.ServerDetach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || d.GetStatus().GetCode() != 0 || len(fake.Peers()) != 0 {
+    t.Errorf("ServerDetach(%v) = %v, %v; peers %v", DefaultPool, d, err, fake.Peers())
+  }
+}
+
+func TestAddPoolRollback(t *testing.T) {
+  s, _ := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  // the routes of the host leave no free network
+  s.localPrefixes = func() ([]string, error) { return []string{"0.0.0.0/1", "128.0.0.0/1"}, nil }
+  r, err := s.AddPool(ctx, &pb.Pool{Name: "guests", Cidr: "10.50.0.0/24"})
+  if err != nil || r.GetStatus().GetCode() == 0 || !strings.Contains(r.GetStatus().GetMsg(), "rolled back") {
+    t.Fatalf("AddPool(guests) = %v, %v; expected a failure rolled back", r, err)
+  }
+  if _, ok := s.groups["guests"]; ok {
+    t.Errorf("after a failed AddPool(): pools %v; expected no guests", s.groupNames())
+  }
+  if st, err := s.newPoolStore("guests").Load(); err != nil || len(st.Networks) != 0 {
+    t.Errorf("after a failed AddPool(): stored pool %v, %v; expected nothing", st, err)
+  }
+
+  s.localPrefixes = func() ([]string, error) { return nil, nil }
+  if r, err := s.AddPool(ctx, &pb.Pool{Name: "guests", Cidr: "10.50.0.0/24"}); err != nil || r.GetStatus().GetCode() != 0 {
+    t.Errorf("AddPool(guests) again = %v, %v", r, err)
+  }
+}
@@ -0,0 +1,177 @@
+package daemon
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  "github.com/GreysTone/tricarboxylic/ipam"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+const (
+  ConfStaleKey = "default.stale"
+
+  // ReapInterval is how often tricarbd looks for expired and stale peers
+  ReapInterval = time.Minute
+  // live peers complete a handshake at least every 2 minutes, a shorter
+  // stale period would drop them
+  minStaleAfter = 3 * time.Minute
+)
+
+// parseStale reads the stale period, "0" and empty disable it.
+func parseStale(s string) (time.Duration, error) {
+  if s == "" {
+    return 0, nil
+  }
+  d, err := time.ParseDuration(s)
+  if err != nil {
+    return 0, err
+  }
+  if d != 0 && d < minStaleAfter {
+    return 0, fmt.Errorf("stale period below %v", minStaleAfter)
+  }
+  return d, nil
+}
+
+func (s *Server) SetStale(ctx context.Context, in *pb.ConfigRequest) (*pb.Reply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  d, err := parseStale(strings.TrimSpace(in.GetConfig()))
+  if err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to parse the given period, " + err.Error()}, nil
+  }
+  if err := s.conf.UpdateString(ConfStaleKey, d.String()); err != nil {
+    return &pb.Reply{Code: 1, Msg: "failed to save the given period, " + err.Error()}, nil
+  }
+  s.staleAfter = d
+  return &pb.Reply{Code: 0, Msg: ""}, nil
+}
+
+// RunReaper reaps every interval, it never returns.
+func (s *Server) RunReaper(interval time.Duration) {
+  for range time.Tick(interval) {
+    dropped, err := s.Reap(time.Now())
+    for _, key := range dropped {
+      s.log.Printf("Reaped peer %v\n", key)
+    }
+    if err != nil {
+      s.log.Printf("warning: failed to reap peers: %v\n", err)
+    }
+  }
+}
+
+// Reap drops the peers whose lease expired before now and, with a stale
+// period set, those without a handshake for that long, their addresses go
+// back to the pool. Peers which never completed a handshake count from the
+// time they attached. It returns the public keys of the dropped peers.
+func (s *Server) Reap(now time.Time) ([]string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.be == nil {
+    return nil, nil
+  }
+  stats := s.peerStats()
+  dropped := []string{}
+  var err error
+  for _, name := range append([]string{DefaultPool}, s.groupNames()...) {
+    pool, _ := s.poolNamed(name)
+    for _, l := range pool.Leases() {
+      if !l.Expired(now) && !s.stale(l, stats, now) {
+        continue
+      }
+      if err = s.be.DelPeer(l.PublicKey); err != nil {
+        err = errors.New(errorMsg("failed to drop peer "+l.PublicKey, err))
+        break
+      }
+      if err = pool.Release(l.PublicKey); err != nil {
+        err = fmt.Errorf("failed to release address of %v, %w", l.PublicKey, err)
+        break
+      }
+      dropped = append(dropped, l.PublicKey)
+    }
+    if err != nil {
+      break
+    }
+  }
+  // the peers dropped so far are gone from the config either way, a
+  // stopped server only gets its config file and stays down
+  if len(dropped) != 0 {
+    sync := s.dumpConfig
+    if s.workingMode == TyServerMode {
+      sync = s.dumpConfigAndSyncVirtualTap
+    }
+    if syncErr := sync(); syncErr != nil && err == nil {
+      err = syncErr
+    }
+  }
+  return dropped, err
+}
+
+func (s *Server) ListPeers(ctx context.Context, in *pb.Request) (*pb.PeersReply, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  reply := &pb.PeersReply{Status: &pb.Reply{Code: 0, Msg: ""}}
+  stats := s.peerStats()
+  for _, name := range append([]string{DefaultPool}, s.groupNames()...) {
+    pool, _ := s.poolNamed(name)
+    for _, l := range pool.Leases() {
+      stat := stats[l.PublicKey]
+      reply.Peers = append(reply.Peers, &pb.PeerStatus{
+        PublicKey:     l.PublicKey,
+        Name:          l.Name,
+        Pool:          name,
+        Addresses:     l.Addresses,
+        Attached:      unixSeconds(l.Attached),
+        Expires:       unixSeconds(l.Expires),
+        LastHandshake: unixSeconds(stat.LastHandshake),
+        RxBytes:       stat.RxBytes,
+        TxBytes:       stat.TxBytes,
+      })
+    }
+  }
+  return reply, nil
+}
+
+// peerStats asks a running interface of a backend reporting them, peers
+// missing from the result are unknown to the interface.
+func (s *Server) peerStats() map[string]backend.PeerStat {
+  stats := map[string]backend.PeerStat{}
+  r, ok := s.be.(backend.StatsReporter)
+  if !ok || !s.virtualTapUp() {
+    return stats
+  }
+  list, err := r.PeerStats(s.confPath)
+  if err != nil {
+    s.log.Printf("warning: failed to read peer stats: %v\n", err)
+    return stats
+  }
+  for _, stat := range list {
+    stats[stat.PublicKey] = stat
+  }
+  return stats
+}
+
+// stale needs the interface to know the peer, nothing is stale while the
+// interface is down.
+func (s *Server) stale(l ipam.Lease, stats map[string]backend.PeerStat, now time.Time) bool {
+  stat, ok := stats[l.PublicKey]
+  if s.staleAfter == 0 || !ok {
+    return false
+  }
+  last := stat.LastHandshake
+  if last.IsZero() {
+    last = l.Attached
+  }
+  return !last.IsZero() && now.Sub(last) > s.staleAfter
+}
+
+func unixSeconds(t time.Time) int64 {
+  if t.IsZero() {
+    return 0
+  }
+  return t.Unix()
+}
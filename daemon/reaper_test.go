@@ -0,0 +1,91 @@
+package daemon
+
+import (
+  "context"
+  "reflect"
+  "testing"
+  "time"
+
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+func TestReap(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  now := time.Now()
+  keys := []string{newPublicKey(t), newPublicKey(t), newPublicKey(t)}
+  for i, key := range keys {
+    // only the first one has a ttl
+    in := &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}
+    if i == 0 {
+      in.Ttl = 60
+    }
+    if r, err := s.ServerAttach(ctx, in); err != nil || r.GetStatus().GetCode() != 0 {
+      t.Fatalf("ServerAttach() = %v, %v", r, err)
+    }
+  }
+  l, _ := s.ListPeers(ctx, &pb.Request{Client: "test"})
+  if peers := l.GetPeers(); len(peers) != 3 || peers[0].GetExpires() < now.Unix()+59 || peers[1].GetExpires() != 0 {
+    t.Errorf("ListPeers() = %v; expected the first peer to expire in 60s", peers)
+  }
+
+  reap := func(at time.Time, expected []string) {
+    t.Helper()
+    dropped, err := s.Reap(at)
+    if err != nil || !reflect.DeepEqual(dropped, expected) {
+      t.Errorf("Reap(%v) = %v, %v; expected %v", at.Sub(now), dropped, err, expected)
+    }
+  }
+  reap(now, []string{})
+  syncs := fake.Syncs
+  reap(now.Add(2*time.Minute), keys[:1])
+  if len(fake.Peers()) != 2 || len(s.addrPool.Leases()) != 2 || fake.Syncs != syncs+1 {
+    t.Errorf("after reap: peers %v, leases %v, syncs %v; expected 2, 2, %v", fake.Peers(), s.addrPool.Leases(), fake.Syncs, syncs+1)
+  }
+
+  // the third peer never completed a handshake and counts from its attach
+  if r, _ := s.SetStale(ctx, &pb.ConfigRequest{Config: "1m"}); r.GetCode() == 0 {
+    t.Errorf("SetStale(1m) succeeded; expected live peers to be safe")
+  }
+  s.staleAfter = 5 * time.Minute
+  fake.Handshakes = map[string]time.Time{keys[1]: now.Add(2 * time.Minute)}
+  reap(now.Add(6*time.Minute), keys[2:])
+  reap(now.Add(8*time.Minute), keys[1:2])
+
+  // an interface which is down knows no handshakes
+  if _, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: keys[0]}); err != nil {
+    t.Fatalf("ServerAttach() got error %v", err)
+  }
+  fake.DownInterface(s.confPath)
+  reap(now.Add(time.Hour), []string{})
+}
+
+func TestReapStopped(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  key := newPublicKey(t)
+  if r, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key, Ttl: 60}); err != nil || r.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", r, err)
+  }
+  if r, err := s.ServerStop(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStop() = %v, %v", r, err)
+  }
+
+  // the lease is released, the stopped server stays down
+  dropped, err := s.Reap(time.Now().Add(time.Hour))
+  if err != nil || !reflect.DeepEqual(dropped, []string{key}) {
+    t.Errorf("Reap() = %v, %v; expected %v", dropped, err, key)
+  }
+  if fake.IsUp(s.confPath) || s.workingMode != TyIdleMode {
+    t.Errorf("after reap: up %v, role %v; expected a stopped server", fake.IsUp(s.confPath), s.workingMode)
+  }
+  if len(s.addrPool.Leases()) != 0 || len(fake.Peers()) != 0 {
+    t.Errorf("after reap: leases %v, peers %v; expected none", s.addrPool.Leases(), fake.Peers())
+  }
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+  "context"
+  "fmt"
+  "net"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+const (
+  // ReconcileInterval is how often tricarbd compares the device with the
+  // config
+  ReconcileInterval = 30 * time.Second
+)
+
+// RunReconciler repairs drift every interval, it never returns.
+func (s *Server) RunReconciler(interval time.Duration) {
+  for range time.Tick(interval) {
+    found, err := s.Reconcile(true)
+    for _, d := range found {
+      s.log.Printf("Repaired drift: %v\n", d)
+    }
+    if err != nil {
+      s.log.Printf("warning: failed to reconcile: %v\n", err)
+    }
+  }
+}
+
+// Reconcile compares the interface and peers of the backend, those kept in
+// the state store, with the live device, e.g. after `wg set` or `ip link del`
+// by hand. With repair the device is brought back in line, a changed key or
+// port takes a restart and anything else a sync. Only a server or client
+// has a device to compare, backends which can not be inspected only tell
+// whether the interface is up.
+func (s *Server) Reconcile(repair bool) ([]string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.be == nil || s.workingMode == TyIdleMode {
+    s.drift, s.driftChecked = nil, time.Time{}
+    return nil, nil
+  }
+  found, restart, err := s.diffDevice()
+  if err != nil {
+    return nil, err
+  }
+  s.drift, s.driftChecked = found, time.Now()
+  if !repair || len(found) == 0 {
+    return found, nil
+  }
+  if restart {
+    return found, s.dumpConfigAndRestartVirtualTap()
+  }
+  return found, s.dumpConfigAndSyncVirtualTap()
+}
+
+func (s *Server) Drift(ctx context.Context, in *pb.DriftRequest) (*pb.DriftReply, error) {
+  found, err := s.Reconcile(in.GetRepair())
+  if err != nil {
+    return &pb.DriftReply{Status: errorReply("failed to reconcile", err), Differences: found}, nil
+  }
+  return &pb.DriftReply{
+    Status:      &pb.Reply{Code: 0, Msg: ""},
+    Differences: found,
+    Repaired:    in.GetRepair() && len(found) != 0,
+  }, nil
+}
+
+// diffDevice tells what differs and whether repairing it takes a restart.
+func (s *Server) diffDevice() ([]string, bool, error) {
+  name := backend.IfaceName(s.confPath)
+  if !s.virtualTapUp() {
+    return []string{"interface " + name + " is down"}, false, nil
+  }
+  in, ok := s.be.(backend.Inspector)
+  if !ok {
+    return []string{}, false, nil
+  }
+  dev, err := in.Inspect(s.confPath)
+  if err != nil {
+    return nil, false, err
+  }
+
+  found := []string{}
+  restart := false
+  if dev.PublicKey != s.be.PublicKey() {
+    found = append(found, fmt.Sprintf("interface %v has public key %v, expected %v", name, dev.PublicKey, s.be.PublicKey()))
+    restart = true
+  }
+  // clients listen on a random port
+  if iface := s.be.Interface(); iface.IsServer() && dev.ListenPort != iface.ListenPort {
+    found = append(found, fmt.Sprintf("interface %v listens on %v, expected %v", name, dev.ListenPort, iface.ListenPort))
+    restart = true
+  }
+
+  live := map[string]backend.PeerStat{}
+  for _, p := range dev.Peers {
+    live[p.PublicKey] = p
+  }
+  for _, p := range s.be.Peers() {
+    l, ok := live[p.PublicKey]
+    if !ok {
+      found = append(found, "peer "+p.PublicKey+" is missing")
+      continue
+    }
+    delete(live, p.PublicKey)
+    if want, got := normalizeCIDRs(p.AllowedIPs), normalizeCIDRs(l.AllowedIPs); want != got {
+      found = append(found, fmt.Sprintf("peer %v allows %v, expected %v", p.PublicKey, got, want))
+    }
+  }
+  unknown := []string{}
+  for key := range live {
+    unknown = append(unknown, key)
+  }
+  sort.Strings(unknown)
+  for _, key := range unknown {
+    found = append(found, "peer "+key+" is not configured")
+  }
+  return found, restart, nil
+}
+
+// normalizeCIDRs renders the networks sorted, e.g. for comparing the
+// allowed ips a device reports with those configured.
+func normalizeCIDRs(cidrs []string) string {
+  networks := []string{}
+  for _, cidr := range cidrs {
+    if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil {
+      cidr = ipNet.String()
+    }
+    networks = append(networks, cidr)
+  }
+  sort.Strings(networks)
+  return strings.Join(networks, ", ")
+}
+
+// driftStatus is the drift part of Status, empty before the first check.
+func (s *Server) driftStatus() string {
+  if s.driftChecked.IsZero() {
+    return ""
+  }
+  if len(s.drift) == 0 {
+    return "drift: none\n"
+  }
+  status := ""
+  for _, d := range s.drift {
+    status += "drift: " + d + "\n"
+  }
+  return status
+}
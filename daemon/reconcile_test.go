@@ -0,0 +1,68 @@
+package daemon
+
+import (
+  "context"
+  "strings"
+  "testing"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+func TestReconcile(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if found, err := s.Reconcile(true); err != nil || len(found) != 0 {
+    t.Errorf("Reconcile() of an idle node = %v, %v; expected nothing to compare", found, err)
+  }
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  keys := []string{newPublicKey(t), newPublicKey(t)}
+  for _, key := range keys {
+    if r, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || r.GetStatus().GetCode() != 0 {
+      t.Fatalf("ServerAttach() = %v, %v", r, err)
+    }
+  }
+  if found, err := s.Reconcile(false); err != nil || len(found) != 0 {
+    t.Errorf("Reconcile() = %v, %v; expected no drift", found, err)
+  }
+
+  // `wg set` by hand: a peer removed, one added and one with other ips
+  peers := fake.Peers()
+  stranger := newPublicKey(t)
+  fake.SetLivePeers([]backend.Peer{
+    {PublicKey: peers[1].PublicKey, AllowedIPs: []string{"192.168.0.1/32"}},
+    {PublicKey: stranger, AllowedIPs: []string{"192.168.0.2/32"}},
+  })
+  d, err := s.Drift(ctx, &pb.DriftRequest{})
+  if err != nil || d.GetStatus().GetCode() != 0 || len(d.GetDifferences()) != 3 || d.GetRepaired() {
+    t.Fatalf("Drift() = %v, %v; expected 3 differences", d, err)
+  }
+  for i, expected := range []string{peers[0].PublicKey + " is missing", peers[1].PublicKey + " allows 192.168.0.1/32", stranger + " is not configured"} {
+    if !strings.Contains(d.GetDifferences()[i], expected) {
+      t.Errorf("Drift() = %v; expected %q", d.GetDifferences()[i], expected)
+    }
+  }
+  if r, _ := s.Status(ctx, &pb.Request{Client: "test"}); !strings.Contains(r.GetMsg(), "drift: peer "+stranger) {
+    t.Errorf("Status() = %q; expected the drift", r.GetMsg())
+  }
+
+  syncs := fake.Syncs
+  if d, err := s.Drift(ctx, &pb.DriftRequest{Repair: true}); err != nil || !d.GetRepaired() || fake.Syncs != syncs+1 {
+    t.Errorf("Drift(repair) = %v, %v, syncs %v; expected a sync", d, err, fake.Syncs)
+  }
+  if found, err := s.Reconcile(false); err != nil || len(found) != 0 {
+    t.Errorf("after repair: Reconcile() = %v, %v; expected no drift", found, err)
+  }
+
+  // `ip link del` by hand
+  fake.DownInterface(s.confPath)
+  ups := fake.Ups
+  if found, err := s.Reconcile(true); err != nil || len(found) != 1 || fake.Ups != ups+1 {
+    t.Errorf("Reconcile() of a deleted link = %v, %v, ups %v; expected it up again", found, err, fake.Ups)
+  }
+  if r, _ := s.Status(ctx, &pb.Request{Client: "test"}); !strings.Contains(r.GetMsg(), "drift: interface") {
+    t.Errorf("Status() = %q; expected the link drift", r.GetMsg())
+  }
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+  "errors"
+  "net"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  "github.com/GreysTone/tricarboxylic/ipam"
+)
+
+// Recover brings back the last run after tricarbd restarted, e.g. after a
+// reboot: the backend loads its interface and peers, persisted peers
+// without a lease claim their addresses, and the tunnel comes back up if
+// the node was a server or a client. An idle node only loads the backend.
+func (s *Server) Recover() error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err := s.loadBackend(); err != nil {
+    return err
+  }
+  switch s.workingMode {
+  case TyServerMode:
+    s.claimPeers()
+  case TyClientMode:
+  default:
+    return nil
+  }
+  // a tunnel which outlived tricarbd is synced instead
+  return s.dumpConfigAndSyncVirtualTap()
+}
+
+// loadBackend creates the backend named in the config on first use, with the
+// store, settings and logger of the server, and loads what it persisted.
+func (s *Server) loadBackend() error {
+  if s.be != nil {
+    return nil
+  }
+  b := backend.NewBackend(s.backendName(), backend.Env{Store: s.store, Settings: s.conf, Logger: s.log})
+  if b == nil {
+    return errors.New("not supported backend: " + s.backendName())
+  }
+  if l, ok := b.(backend.Loader); ok {
+    if err := l.Load(); err != nil {
+      return errors.New(errorMsg("failed to load backend "+s.backendName(), err))
+    }
+  }
+  s.be = b
+  return nil
+}
+
+// setWorkingMode records the role for the next start, the tunnel is set up
+// already so failing to save it is only a warning.
+func (s *Server) setWorkingMode(mode string) {
+  if err := s.store.Put(ConfModeKey, mode); err != nil {
+    s.log.Printf("warning: failed to save role %v: %v\n", mode, err)
+  }
+  s.workingMode = mode
+}
+
+// claimPeers records the addresses of the backend's peers in the pool of
+// their network, the leases of peers attached before the pools kept them
+// are rebuilt that way. Addresses held by another peer are reported only.
+func (s *Server) claimPeers() {
+  for _, p := range s.be.Peers() {
+    for _, cidr := range p.AllowedIPs {
+      ip, _, err := net.ParseCIDR(cidr)
+      if err != nil {
+        continue
+      }
+      for _, name := range append([]string{DefaultPool}, s.groupNames()...) {
+        pool, _ := s.poolNamed(name)
+        err := pool.Claim(p.PublicKey, ip.String())
+        if errors.Is(err, ipam.ErrOutside) {
+          continue
+        }
+        if err != nil {
+          s.log.Printf("warning: peer %v keeps %v without a lease: %v\n", p.PublicKey, ip, err)
+        }
+        break
+      }
+    }
+  }
+}
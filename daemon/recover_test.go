@@ -0,0 +1,66 @@
+package daemon
+
+import (
+  "context"
+  "strings"
+  "testing"
+
+  "github.com/GreysTone/tricarboxylic/ipam"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+func TestRecover(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+  key := newPublicKey(t)
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+  if err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a, err)
+  }
+  if r, _ := s.Status(ctx, &pb.Request{Client: "test"}); !strings.HasPrefix(r.GetMsg(), "role: server\n") {
+    t.Errorf("Status() = %q; expected the server role", r.GetMsg())
+  }
+
+  // rebooted with the peer but not its lease, e.g. attached before leases
+  // were kept
+  networks := s.addrPool.Networks()
+  s.addrPool, _ = ipam.New(&ipam.MemoryStore{})
+  if err := s.addrPool.Reset(networks...); err != nil {
+    t.Fatalf("Reset(%v) got error %v", networks, err)
+  }
+  fake.DownInterface(s.confPath)
+  ups := fake.Ups
+  if err := s.Recover(); err != nil {
+    t.Fatalf("Recover() got error %v", err)
+  }
+  if fake.Ups != ups+1 {
+    t.Errorf("after recover: ups %v; expected %v", fake.Ups, ups+1)
+  }
+  leases := s.addrPool.Leases()
+  if len(leases) != 1 || leases[0].PublicKey != key || leases[0].Addresses[0]+"/24" != a.GetAssignedCIDR() {
+    t.Errorf("after recover: leases %v; expected %v for %v", leases, a.GetAssignedCIDR(), key)
+  }
+
+  // a stopped server stays down
+  if r, err := s.ServerStop(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStop() = %v, %v", r, err)
+  }
+  if err := s.Recover(); err != nil || fake.IsUp(s.confPath) {
+    t.Errorf("Recover() of an idle node = %v, up %v; expected it to stay down", err, fake.IsUp(s.confPath))
+  }
+  if r, _ := s.ServerStop(ctx, &pb.Request{Client: "test"}); r.GetCode() == 0 {
+    t.Errorf("ServerStop() of an idle node succeeded")
+  }
+}
+
+func TestServerStopWithoutBackend(t *testing.T) {
+  s, _ := newFakeServer(t)
+  s.be = nil
+  r, err := s.ServerStop(context.Background(), &pb.Request{Client: "test"})
+  if err != nil || r.GetCode() == 0 {
+    t.Errorf("ServerStop() = %v, %v; expected no server running", r, err)
+  }
+}
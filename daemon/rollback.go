@@ -0,0 +1,217 @@
+package daemon
+
+import (
+  "reflect"
+  "strings"
+
+  "github.com/GreysTone/tricarboxylic/backend"
+  "github.com/GreysTone/tricarboxylic/ipam"
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+// change is what an operation may touch, taken before it changes anything:
+// the config of the backend, the address pools and the running interface.
+// An operation which fails half way rolls back to it, instead of leaving
+// e.g. a peer in the config of an interface which did not come up.
+type change struct {
+  s *Server
+  // loaded tells whether there was a backend, snap is nil for backends
+  // which can not restore their config
+  loaded bool
+  snap   backend.Snapshot
+  iface  backend.Interface
+  key    string
+  up     bool
+  mode   string
+  groups map[string]*group
+  pools  map[*ipam.Pool]ipam.State
+}
+
+// begin takes the change of an operation, without a backend only the pools
+// are taken.
+func (s *Server) begin() (*change, error) {
+  c := &change{
+    s:      s,
+    mode:   s.workingMode,
+    groups: map[string]*group{},
+    pools:  map[*ipam.Pool]ipam.State{s.addrPool: s.addrPool.State()},
+  }
+  for name, g := range s.groups {
+    c.groups[name] = g
+    c.pools[g.pool] = g.pool.State()
+  }
+  if s.be == nil {
+    return c, nil
+  }
+  c.loaded = true
+  c.iface, c.key, c.up = s.be.Interface(), s.be.PublicKey(), s.virtualTapUp()
+  if sn, ok := s.be.(backend.Snapshotter); ok {
+    snap, err := sn.Snapshot()
+    if err != nil {
+      return nil, err
+    }
+    c.snap = snap
+  }
+  return c, nil
+}
+
+// track takes a pool the operation created, its store is put back as well.
+func (c *change) track(pool *ipam.Pool) {
+  c.pools[pool] = pool.State()
+}
+
+// fail rolls back and tells what in the message of the reply.
+func (c *change) fail(r *pb.Reply) *pb.Reply {
+  undone, failed := c.rollback()
+  if len(undone) != 0 {
+    r.Msg += ", rolled back " + strings.Join(undone, ", ")
+  }
+  if len(failed) != 0 {
+    r.Msg += ", failed to roll back " + strings.Join(failed, ", ")
+  }
+  return r
+}
+
+// rollback returns what was put back and what could not be.
+func (c *change) rollback() ([]string, []string) {
+  s := c.s
+  undone, failed := []string{}, []string{}
+  note := func(what string, err error) {
+    if err != nil {
+      failed = append(failed, what+" ("+err.Error()+")")
+    } else {
+      undone = append(undone, what)
+    }
+  }
+  var err error
+  for pool, st := range c.pools {
+    if err = pool.Restore(st); err != nil {
+      break
+    }
+  }
+  s.groups = c.groups
+  if err == nil {
+    err = s.saveGroups()
+  }
+  note("the addresses", err)
+
+  if c.loaded {
+    c.rollbackBackend(note)
+  }
+  if s.workingMode != c.mode {
+    s.setWorkingMode(c.mode)
+  }
+  return undone, failed
+}
+
+// rollbackBackend puts back the config of the backend and the interface.
+func (c *change) rollbackBackend(note func(string, error)) {
+  s := c.s
+  // the running interface only restarts for changes a sync can not apply
+  restart := !s.virtualTapUp() || s.be.Interface() != c.iface || s.be.PublicKey() != c.key
+  if c.snap != nil {
+    note("the config", s.be.(backend.Snapshotter).Restore(c.snap))
+  }
+
+  switch {
+  case c.up && restart:
+    note("the interface", s.dumpConfigAndRestartVirtualTap())
+  case c.up:
+    note("the peers of the interface", s.dumpConfigAndSyncVirtualTap())
+  case s.virtualTapUp():
+    note("the interface", s.be.DownInterface(s.confPath))
+  default:
+    // the interface stays down, only its config file is put back
+    if err := s.dumpConfig(); err != nil {
+      note("the config file", err)
+    }
+  }
+}
+
+// join is a client attach waiting for the server node, the lock is not held
+// meanwhile so the other operations go on. The new key pair is staged, the
+// backend keeps the old one until the server answered and the attach goes
+// on only if the node did not change in between.
+type join struct {
+  ch        *change
+  be        backend.VpnBackend
+  publicKey string
+  caps      backend.Capabilities
+  prefixes  []string
+  // staged is the backend with the new key pair, nil for backends which
+  // can not restore their config, those hold the new key pair right away
+  staged backend.Snapshot
+}
+
+// beginJoin stages a new key pair, it is called with the lock held.
+func (s *Server) beginJoin() (*join, *pb.Reply) {
+  ch, err := s.begin()
+  if err != nil {
+    return nil, errorReply("failed to begin", err)
+  }
+  if err := s.be.NewKeyPair(); err != nil {
+    return nil, ch.fail(errorReply("failed to generate key pair", err))
+  }
+  j := &join{ch: ch, be: s.be, publicKey: s.be.PublicKey()}
+  if sn, ok := s.be.(backend.Snapshotter); ok && ch.snap != nil {
+    staged, err := sn.Snapshot()
+    if err == nil {
+      j.staged = staged
+      err = sn.Restore(ch.snap)
+    }
+    if err != nil {
+      return nil, ch.fail(errorReply("failed to stage key pair", err))
+    }
+  }
+  return j, nil
+}
+
+// changed tells whether another operation changed the node since the join
+// began, it is called with the lock held.
+func (s *Server) changed(j *join) bool {
+  if s.be != j.be || s.workingMode != j.ch.mode || len(s.groups) != len(j.ch.groups) {
+    return true
+  }
+  for name, g := range s.groups {
+    if j.ch.groups[name] != g {
+      return true
+    }
+  }
+  // rolling back puts back the pools as well
+  for pool, st := range j.ch.pools {
+    if !reflect.DeepEqual(pool.State(), st) {
+      return true
+    }
+  }
+  if j.staged == nil {
+    return s.be.PublicKey() != j.publicKey
+  }
+  snap, err := s.be.(backend.Snapshotter).Snapshot()
+  return err != nil || !reflect.DeepEqual(snap, j.ch.snap)
+}
+
+// applyJoin puts the staged key pair in place, it is called with the lock
+// held.
+func (s *Server) applyJoin(j *join) *pb.Reply {
+  if s.changed(j) {
+    return &pb.Reply{Code: 1, Msg: "the node changed while waiting for the server, try again"}
+  }
+  if j.staged == nil {
+    return nil
+  }
+  if err := s.be.(backend.Snapshotter).Restore(j.staged); err != nil {
+    return j.ch.fail(errorReply("failed to apply key pair", err))
+  }
+  return nil
+}
+
+// abortJoin rolls back a join the server refused, unless another operation
+// changed the node meanwhile.
+func (s *Server) abortJoin(j *join, r *pb.Reply) *pb.Reply {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.changed(j) {
+    return r
+  }
+  return j.ch.fail(r)
+}
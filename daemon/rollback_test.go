@@ -0,0 +1,52 @@
+package daemon
+
+import (
+  "context"
+  "errors"
+  "reflect"
+  "strings"
+  "testing"
+
+  pb "github.com/GreysTone/tricarboxylic/rpc"
+)
+
+func TestRollback(t *testing.T) {
+  s, fake := newFakeServer(t)
+  ctx := context.Background()
+  if r, err := s.ServerStart(ctx, &pb.Request{Client: "test"}); err != nil || r.GetCode() != 0 {
+    t.Fatalf("ServerStart() = %v, %v", r, err)
+  }
+
+  // the first peer brings the interface up, which fails
+  fake.FailUp = errors.New("no link")
+  key := newPublicKey(t)
+  a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key})
+  if err != nil || a.GetStatus().GetCode() == 0 || !strings.Contains(a.GetStatus().GetMsg(), "rolled back") {
+    t.Fatalf("ServerAttach() = %v, %v; expected it rolled back", a, err)
+  }
+  if peers, leases := fake.Peers(), s.addrPool.Leases(); len(peers) != 0 || len(leases) != 0 {
+    t.Errorf("after rollback: peers %v, leases %v; expected none", peers, leases)
+  }
+
+  fake.FailUp = nil
+  if a, err := s.ServerAttach(ctx, &pb.PeerInfo{AccessCode: s.accessCode, PeerPublicKey: key}); err != nil || a.GetStatus().GetCode() != 0 {
+    t.Fatalf("ServerAttach() = %v, %v", a, err)
+  }
+
+  // a restart with a new key pair which does not come up again
+  serverKey, iface, peers := fake.PublicKey(), fake.Interface(), fake.Peers()
+  fake.FailUp = errors.New("no link")
+  r, err := s.ServerStart(ctx, &pb.Request{Client: "test"})
+  if err != nil || r.GetCode() == 0 {
+    t.Fatalf("ServerStart() = %v, %v; expected it to fail", r, err)
+  }
+  if !strings.Contains(r.GetMsg(), "rolled back the addresses, the config") || !strings.Contains(r.GetMsg(), "failed to roll back the interface") {
+    t.Errorf("ServerStart() = %q; expected the config rolled back but not the interface", r.GetMsg())
+  }
+  if fake.PublicKey() != serverKey || fake.Interface() != iface || !reflect.DeepEqual(fake.Peers(), peers) {
+    t.Errorf("after rollback: key %v, interface %v, peers %v; expected %v, %v, %v", fake.PublicKey(), fake.Interface(), fake.Peers(), serverKey, iface, peers)
+  }
+  if leases := s.addrPool.Leases(); len(leases) != 1 || leases[0].PublicKey != key {
+    t.Errorf("after rollback: leases %v; expected the one of %v", leases, key)
+  }
+}
@@ -0,0 +1,121 @@
+// Package allocator hands out ordinals 0..size-1, the ipam pool maps them to
+// the host addresses of a network.
+package allocator
+
+import (
+  "errors"
+  "fmt"
+  "math/bits"
+)
+
+var (
+  ErrFull       = errors.New("allocator is full")
+  ErrOutOfRange = errors.New("ordinal out of range")
+  ErrAllocated  = errors.New("ordinal already allocated")
+)
+
+// Bitmap keeps one bit per ordinal and a second level with one bit per full
+// word, so finding a free ordinal skips 4096 allocated ordinals per step.
+// The hint remembers below which word everything is allocated, allocating
+// the lowest free ordinal is O(1) amortized. A /8 network takes about 2MB.
+type Bitmap struct {
+  size  uint64
+  used  uint64
+  words []uint64
+  full  []uint64
+  hint  uint64
+}
+
+// New returns an empty bitmap for size ordinals.
+func New(size uint64) *Bitmap {
+  n := (size + 63) / 64
+  b := &Bitmap{
+    size:  size,
+    words: make([]uint64, n),
+    full:  make([]uint64, (n+63)/64),
+  }
+  // the bits past size in the last word are never free
+  if rest := size % 64; rest != 0 {
+    b.words[n-1] = ^uint64(0) << rest
+  }
+  return b
+}
+
+func (b *Bitmap) Size() uint64 {
+  return b.size
+}
+
+// Used is the number of allocated ordinals.
+func (b *Bitmap) Used() uint64 {
+  return b.used
+}
+
+func (b *Bitmap) Has(i uint64) bool {
+  if i >= b.size {
+    return false
+  }
+  return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// Allocate returns the lowest free ordinal.
+func (b *Bitmap) Allocate() (uint64, error) {
+  for f := b.hint / 64; f < uint64(len(b.full)); f++ {
+    free := ^b.full[f]
+    if f == b.hint/64 {
+      // the words below the hint are full
+      free &= ^uint64(0) << (b.hint % 64)
+    }
+    if free == 0 {
+      continue
+    }
+    w := f*64 + uint64(bits.TrailingZeros64(free))
+    if w >= uint64(len(b.words)) {
+      break
+    }
+    b.hint = w
+    i := w*64 + uint64(bits.TrailingZeros64(^b.words[w]))
+    b.set(i)
+    return i, nil
+  }
+  b.hint = uint64(len(b.words))
+  return 0, ErrFull
+}
+
+// Mark allocates the given ordinal, e.g. a reserved one or one loaded from
+// a store.
+func (b *Bitmap) Mark(i uint64) error {
+  if i >= b.size {
+    return fmt.Errorf("%w: %v", ErrOutOfRange, i)
+  }
+  if b.Has(i) {
+    return fmt.Errorf("%w: %v", ErrAllocated, i)
+  }
+  b.set(i)
+  return nil
+}
+
+// Release frees the ordinal, releasing a free one does nothing.
+func (b *Bitmap) Release(i uint64) {
+  if !b.Has(i) {
+    return
+  }
+  w := i / 64
+  b.words[w] &^= 1 << (i % 64)
+  b.full[w/64] &^= 1 << (w % 64)
+  b.used--
+  if w < b.hint {
+    b.hint = w
+  }
+}
+
+func (b *Bitmap) set(i uint64) {
+  w := i / 64
+  b.words[w] |= 1 << (i % 64)
+  b.used++
+  if b.words[w] == ^uint64(0) {
+    b.full[w/64] |= 1 << (w % 64)
+    if w == b.hint {
+      b.hint = w + 1
+    }
+  }
+}
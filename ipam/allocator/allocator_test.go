@@ -0,0 +1,96 @@
+package allocator
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestAllocateLowest(t *testing.T) {
+  b := New(130)
+  for expected := uint64(0); expected < 130; expected++ {
+    i, err := b.Allocate()
+    if err != nil || i != expected {
+      t.Fatalf("Allocate() = %v, %v; expected %v", i, err, expected)
+    }
+  }
+  if i, err := b.Allocate(); !errors.Is(err, ErrFull) {
+    t.Errorf("Allocate() = %v, %v; expected %v", i, err, ErrFull)
+  }
+
+  b.Release(100)
+  b.Release(3)
+  b.Release(3)
+  if b.Used() != 128 {
+    t.Errorf("Used() = %v; expected 128", b.Used())
+  }
+  for _, expected := range []uint64{3, 100} {
+    if i, err := b.Allocate(); err != nil || i != expected {
+      t.Errorf("Allocate() = %v, %v; expected the released %v", i, err, expected)
+    }
+  }
+}
+
+func TestMark(t *testing.T) {
+  b := New(10)
+  if err := b.Mark(0); err != nil {
+    t.Fatalf("Mark(0) got error %v", err)
+  }
+  if err := b.Mark(0); !errors.Is(err, ErrAllocated) {
+    t.Errorf("Mark(0) = %v; expected %v", err, ErrAllocated)
+  }
+  if err := b.Mark(10); !errors.Is(err, ErrOutOfRange) {
+    t.Errorf("Mark(10) = %v; expected %v", err, ErrOutOfRange)
+  }
+  if i, err := b.Allocate(); err != nil || i != 1 {
+    t.Errorf("Allocate() = %v, %v; expected 1", i, err)
+  }
+}
+
+func TestAllocateSkipsFullWords(t *testing.T) {
+  // a /16 with everything but the last host allocated
+  b := New(1 << 16)
+  for i := uint64(0); i < 1<<16-1; i++ {
+    b.Mark(i)
+  }
+  b.hint = 0
+  if i, err := b.Allocate(); err != nil || i != 1<<16-1 {
+    t.Errorf("Allocate() = %v, %v; expected %v", i, err, 1<<16-1)
+  }
+}
+
+// BenchmarkAllocate attaches a peer to a /8 server which already has 100k
+func BenchmarkAllocate(b *testing.B) {
+  a := New(1 << 24)
+  for i := 0; i < 100000; i++ {
+    a.Allocate()
+  }
+  b.ResetTimer()
+  for n := 0; n < b.N; n++ {
+    i, err := a.Allocate()
+    if err != nil {
+      b.Fatal(err)
+    }
+    a.Release(i)
+  }
+}
+
+// BenchmarkAllocateRelease churns peers in the middle of a crowded /8
+func BenchmarkAllocateRelease(b *testing.B) {
+  a := New(1 << 24)
+  for i := 0; i < 1<<23; i++ {
+    a.Allocate()
+  }
+  b.ResetTimer()
+  for n := 0; n < b.N; n++ {
+    a.Release(uint64(n*7919) % (1 << 23))
+    if _, err := a.Allocate(); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkNew(b *testing.B) {
+  for n := 0; n < b.N; n++ {
+    New(1 << 24)
+  }
+}
@@ -0,0 +1,620 @@
+package ipam
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "net"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/GreysTone/tricarboxylic/ipam/allocator"
+)
+
+var (
+  ErrNoNetwork = errors.New("no network")
+  ErrExhausted = errors.New("no free address")
+  ErrInUse     = errors.New("address in use")
+  ErrOutside   = errors.New("address outside of the network")
+  ErrReserved  = errors.New("reservation exists")
+  ErrNotFound  = errors.New("reservation not found")
+  ErrNoLease   = errors.New("no lease")
+)
+
+const (
+  // a /8 takes a 2MB bitmap
+  minPrefixLen = 8
+  // the host part of an ipv6 network is the low 64 bits
+  minPrefixLen6 = 64
+  // only the first 65536 addresses of an ipv6 network are handed out
+  maxHostBits6 = 16
+)
+
+// Pool hands out the addresses of the server's networks to peers, at most
+// one ipv4 and one ipv6 network. A dual-stack peer holds one address of
+// each. The pool is the only record of which public key holds which
+// address, every change goes to the store first so a restarted tricarbd
+// never hands out an address twice.
+//
+// Reserved addresses are only handed out to the peer they are reserved for,
+// reservations outside of the current networks are kept but ignored.
+type Pool struct {
+  mu           sync.Mutex
+  store        Store
+  subnets      []*subnet
+  byKey        map[string]Lease
+  byAddr       map[string]string
+  reservations []Reservation
+}
+
+// subnet is one network of the pool, network is the CIDR of the server,
+// e.g. 10.20.30.1/24.
+type subnet struct {
+  network string
+  ipNet   *net.IPNet
+  server  net.IP
+  alloc   *allocator.Bitmap
+}
+
+// New loads the pool from the store.
+func New(store Store) (*Pool, error) {
+  state, err := store.Load()
+  if err != nil {
+    return nil, err
+  }
+  p := &Pool{store: store}
+  if err := p.restore(state); err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+// State returns the networks, leases and reservations of the pool, Restore
+// takes them back.
+func (p *Pool) State() State {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return State{Networks: p.networks(), Leases: p.leases(), Reservations: append([]Reservation{}, p.reservations...)}
+}
+
+// Restore replaces the pool with the state, e.g. one taken before an
+// operation which failed.
+func (p *Pool) Restore(state State) error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if err := p.restore(state); err != nil {
+    return err
+  }
+  return p.save()
+}
+
+func (p *Pool) restore(state State) error {
+  p.reservations = state.Reservations
+  if err := p.reset(state.Networks); err != nil {
+    return err
+  }
+  for _, l := range state.Leases {
+    for _, addr := range l.Addresses {
+      s, ip := p.subnetOf(addr)
+      if s == nil {
+        return fmt.Errorf("%w: lease %v of %v", ErrOutside, addr, l.PublicKey)
+      }
+      // reserved addresses are marked already
+      if err := s.alloc.Mark(s.ordinal(ip)); err != nil && !p.isReserved(addr) {
+        return fmt.Errorf("%w: lease %v of %v", ErrInUse, addr, l.PublicKey)
+      }
+      p.byAddr[addr] = l.PublicKey
+    }
+    if l.Attached.IsZero() {
+      // leases predating attach times count from now on
+      l.Attached = time.Now()
+    }
+    p.byKey[l.PublicKey] = l
+  }
+  return nil
+}
+
+// Networks returns the CIDRs of the server, the ipv4 one first. They are
+// empty before the first Reset.
+func (p *Pool) Networks() []string {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return p.networks()
+}
+
+// Reset switches to new networks and drops every lease, no networks leave
+// the pool empty.
+func (p *Pool) Reset(networks ...string) error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if err := p.reset(networks); err != nil {
+    return err
+  }
+  return p.save()
+}
+
+// Acquire returns the addresses held by the public key, the addresses
+// reserved for the public key or the name, or leases the lowest free one of
+// each network.
+func (p *Pool) Acquire(publicKey string, name string) ([]string, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if len(p.subnets) == 0 {
+    return nil, ErrNoNetwork
+  }
+  if l, ok := p.byKey[publicKey]; ok {
+    return append([]string{}, l.Addresses...), nil
+  }
+
+  r, reserved := p.reservationFor(publicKey, name)
+  addrs := []string{}
+  allocated := map[*subnet]uint64{}
+  for _, s := range p.subnets {
+    if addr := addressIn(r.Addresses, s); reserved && addr != "" {
+      if holder, ok := p.byAddr[addr]; ok {
+        p.releaseAll(allocated)
+        return nil, fmt.Errorf("%w: %v is reserved for %v but held by %v", ErrInUse, addr, r, holder)
+      }
+      addrs = append(addrs, addr)
+      continue
+    }
+    ord, err := s.alloc.Allocate()
+    if err != nil {
+      p.releaseAll(allocated)
+      return nil, fmt.Errorf("%w in %v", ErrExhausted, s.network)
+    }
+    allocated[s] = ord
+    addrs = append(addrs, s.address(ord))
+  }
+  if err := p.lease(Lease{PublicKey: publicKey, Name: name, Addresses: addrs, Attached: time.Now()}); err != nil {
+    p.releaseAll(allocated)
+    return nil, err
+  }
+  return append([]string{}, addrs...), nil
+}
+
+// Claim records an address a peer already holds, e.g. a peer configured
+// before the pool existed. A dual-stack peer claims each address on its own.
+func (p *Pool) Claim(publicKey string, addr string) error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  s, ip, err := p.hostIP(addr)
+  if err != nil {
+    return err
+  }
+  addr = ip.String()
+  if holder, ok := p.byAddr[addr]; ok {
+    if holder == publicKey {
+      return nil
+    }
+    return fmt.Errorf("%w: %v", ErrInUse, addr)
+  }
+  l, ok := p.byKey[publicKey]
+  if ok && addressIn(l.Addresses, s) != "" {
+    return fmt.Errorf("%w: %v already holds an address in %v", ErrInUse, publicKey, s.network)
+  }
+  if p.isReserved(addr) {
+    return fmt.Errorf("%w: %v is reserved", ErrInUse, addr)
+  }
+  ord := s.ordinal(ip)
+  if err := s.alloc.Mark(ord); err != nil {
+    return fmt.Errorf("%w: %v", ErrOutside, addr)
+  }
+  if !ok {
+    l = Lease{PublicKey: publicKey, Attached: time.Now()}
+  }
+  prev := l
+  l.Addresses = append(append([]string{}, l.Addresses...), addr)
+  delete(p.byKey, publicKey)
+  if err := p.lease(l); err != nil {
+    if ok {
+      p.byKey[publicKey] = prev
+      for _, a := range prev.Addresses {
+        p.byAddr[a] = publicKey
+      }
+    }
+    s.alloc.Release(ord)
+    return err
+  }
+  return nil
+}
+
+// Release frees the addresses of the public key, releasing a key without a
+// lease is fine. Reserved addresses stay reserved.
+func (p *Pool) Release(publicKey string) error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  l, ok := p.byKey[publicKey]
+  if !ok {
+    return nil
+  }
+  p.unlease(l)
+  if err := p.save(); err != nil {
+    p.byKey[publicKey] = l
+    for _, addr := range l.Addresses {
+      p.byAddr[addr] = publicKey
+    }
+    return err
+  }
+  for _, addr := range l.Addresses {
+    if s, ip := p.subnetOf(addr); s != nil && !p.isReserved(addr) {
+      s.alloc.Release(s.ordinal(ip))
+    }
+  }
+  return nil
+}
+
+// Expire sets when the lease of the public key expires, zero keeps it until
+// it is released.
+func (p *Pool) Expire(publicKey string, at time.Time) error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  l, ok := p.byKey[publicKey]
+  if !ok {
+    return fmt.Errorf("%w: %v", ErrNoLease, publicKey)
+  }
+  prev := l
+  l.Expires = at
+  p.byKey[publicKey] = l
+  if err := p.save(); err != nil {
+    p.byKey[publicKey] = prev
+    return err
+  }
+  return nil
+}
+
+// Lease returns the lease of the public key.
+func (p *Pool) Lease(publicKey string) (Lease, bool) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  l, ok := p.byKey[publicKey]
+  return l, ok
+}
+
+// Leases returns the leases ordered by address.
+func (p *Pool) Leases() []Lease {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return p.leases()
+}
+
+// Reserve keeps addresses for the public key or the name of a peer, one in
+// each network. Networks without a given address get the lowest free one
+// reserved, reserving the addresses a peer holds right now makes them
+// sticky.
+func (p *Pool) Reserve(r Reservation) (Reservation, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if r.PublicKey == "" && r.Name == "" {
+    return Reservation{}, errors.New("reservation needs a public key or a name")
+  }
+  for _, other := range p.reservations {
+    if (r.PublicKey != "" && other.PublicKey == r.PublicKey) || (r.Name != "" && other.Name == r.Name) {
+      return Reservation{}, fmt.Errorf("%w: %v", ErrReserved, other)
+    }
+  }
+  if len(p.subnets) == 0 {
+    return Reservation{}, ErrNoNetwork
+  }
+
+  given := map[*subnet]net.IP{}
+  for _, addr := range r.Addresses {
+    s, ip, err := p.hostIP(addr)
+    if err != nil {
+      return Reservation{}, err
+    }
+    if _, ok := given[s]; ok {
+      return Reservation{}, fmt.Errorf("%w: more than one address in %v", ErrInUse, s.network)
+    }
+    if p.isReserved(ip.String()) {
+      return Reservation{}, fmt.Errorf("%w: %v is reserved", ErrInUse, ip)
+    }
+    if holder, ok := p.byAddr[ip.String()]; ok {
+      l := p.byKey[holder]
+      if (r.PublicKey == "" || l.PublicKey != r.PublicKey) && (r.Name == "" || l.Name != r.Name) {
+        return Reservation{}, fmt.Errorf("%w: %v is held by %v", ErrInUse, ip, holder)
+      }
+    }
+    given[s] = ip
+  }
+
+  r.Addresses = []string{}
+  marked := map[*subnet]uint64{}
+  for _, s := range p.subnets {
+    if ip, ok := given[s]; ok {
+      if _, held := p.byAddr[ip.String()]; !held {
+        if err := s.alloc.Mark(s.ordinal(ip)); err != nil {
+          p.releaseAll(marked)
+          return Reservation{}, fmt.Errorf("%w: %v", ErrOutside, ip)
+        }
+        marked[s] = s.ordinal(ip)
+      }
+      r.Addresses = append(r.Addresses, ip.String())
+      continue
+    }
+    ord, err := s.alloc.Allocate()
+    if err != nil {
+      p.releaseAll(marked)
+      return Reservation{}, fmt.Errorf("%w in %v", ErrExhausted, s.network)
+    }
+    marked[s] = ord
+    r.Addresses = append(r.Addresses, s.address(ord))
+  }
+
+  p.reservations = append(p.reservations, r)
+  if err := p.save(); err != nil {
+    p.reservations = p.reservations[:len(p.reservations)-1]
+    p.releaseAll(marked)
+    return Reservation{}, err
+  }
+  return r, nil
+}
+
+// Unreserve deletes the reservation of the public key or the name, a peer
+// holding the addresses keeps them until it is released.
+func (p *Pool) Unreserve(publicKey string, name string) (Reservation, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  for i, r := range p.reservations {
+    if (publicKey == "" || r.PublicKey != publicKey) && (name == "" || r.Name != name) {
+      continue
+    }
+    prev := p.reservations
+    p.reservations = append(append([]Reservation{}, prev[:i]...), prev[i+1:]...)
+    if err := p.save(); err != nil {
+      p.reservations = prev
+      return Reservation{}, err
+    }
+    for _, addr := range r.Addresses {
+      if _, ok := p.byAddr[addr]; ok {
+        continue
+      }
+      if s, ip := p.subnetOf(addr); s != nil {
+        s.alloc.Release(s.ordinal(ip))
+      }
+    }
+    return r, nil
+  }
+  return Reservation{}, ErrNotFound
+}
+
+// Reservations returns the reservations in the order they were made.
+func (p *Pool) Reservations() []Reservation {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return append([]Reservation{}, p.reservations...)
+}
+
+func (p *Pool) reset(networks []string) error {
+  subnets := []*subnet{}
+  for _, network := range networks {
+    network = strings.TrimSpace(network)
+    if network == "" {
+      continue
+    }
+    s, err := newSubnet(network)
+    if err != nil {
+      return err
+    }
+    for _, other := range subnets {
+      if other.isIPv4() == s.isIPv4() {
+        return fmt.Errorf("%v and %v: only one network per address family is supported", other.network, network)
+      }
+    }
+    subnets = append(subnets, s)
+  }
+  sort.SliceStable(subnets, func(i, j int) bool {
+    return subnets[i].isIPv4() && !subnets[j].isIPv4()
+  })
+
+  p.subnets = subnets
+  p.byKey = map[string]Lease{}
+  p.byAddr = map[string]string{}
+  for _, r := range p.reservations {
+    for _, addr := range r.Addresses {
+      if s, ip := p.subnetOf(addr); s != nil {
+        s.alloc.Mark(s.ordinal(ip))
+      }
+    }
+  }
+  return nil
+}
+
+func newSubnet(network string) (*subnet, error) {
+  ip, ipNet, err := net.ParseCIDR(network)
+  if err != nil {
+    return nil, err
+  }
+  ones, bits := ipNet.Mask.Size()
+  hostBits := bits - ones
+  if ip4 := ip.To4(); ip4 != nil {
+    if ones < minPrefixLen {
+      return nil, fmt.Errorf("%v: ipv4 networks larger than /%v are not supported", network, minPrefixLen)
+    }
+    ip, ipNet.IP = ip4, ipNet.IP.To4()
+  } else {
+    if ones < minPrefixLen6 {
+      return nil, fmt.Errorf("%v: ipv6 networks larger than /%v are not supported", network, minPrefixLen6)
+    }
+    if hostBits > maxHostBits6 {
+      hostBits = maxHostBits6
+    }
+  }
+
+  s := &subnet{network: network, ipNet: ipNet, server: ip}
+  size := uint64(1) << uint(hostBits)
+  s.alloc = allocator.New(size)
+  // the server may sit past the addresses handed out in a large ipv6 network
+  s.alloc.Mark(s.ordinal(ip))
+  // the first address is the network address in ipv4 and the subnet-router
+  // anycast address in ipv6, only ipv4 has a broadcast address. /31, /32,
+  // /127 and /128 have neither.
+  if size >= 4 {
+    s.alloc.Mark(0)
+    if s.isIPv4() {
+      s.alloc.Mark(size - 1)
+    }
+  }
+  return s, nil
+}
+
+func (p *Pool) lease(l Lease) error {
+  p.byKey[l.PublicKey] = l
+  for _, addr := range l.Addresses {
+    p.byAddr[addr] = l.PublicKey
+  }
+  if err := p.save(); err != nil {
+    p.unlease(l)
+    return err
+  }
+  return nil
+}
+
+func (p *Pool) unlease(l Lease) {
+  delete(p.byKey, l.PublicKey)
+  for _, addr := range l.Addresses {
+    delete(p.byAddr, addr)
+  }
+}
+
+func (p *Pool) releaseAll(ords map[*subnet]uint64) {
+  for s, ord := range ords {
+    s.alloc.Release(ord)
+  }
+}
+
+func (p *Pool) save() error {
+  return p.store.Save(State{Networks: p.networks(), Leases: p.leases(), Reservations: p.reservations})
+}
+
+func (p *Pool) networks() []string {
+  networks := []string{}
+  for _, s := range p.subnets {
+    networks = append(networks, s.network)
+  }
+  return networks
+}
+
+func (p *Pool) leases() []Lease {
+  leases := []Lease{}
+  for _, l := range p.byKey {
+    leases = append(leases, l)
+  }
+  sort.Slice(leases, func(i, j int) bool {
+    return bytes.Compare(firstIP(leases[i].Addresses), firstIP(leases[j].Addresses)) < 0
+  })
+  return leases
+}
+
+// reservationFor prefers the reservation of the public key over the one of
+// the name, the latter only matches if it is not bound to another key.
+func (p *Pool) reservationFor(publicKey string, name string) (Reservation, bool) {
+  for _, r := range p.reservations {
+    if publicKey != "" && r.PublicKey == publicKey && p.inNetworks(r.Addresses) {
+      return r, true
+    }
+  }
+  if name == "" {
+    return Reservation{}, false
+  }
+  for _, r := range p.reservations {
+    if r.Name == name && r.PublicKey == "" && p.inNetworks(r.Addresses) {
+      return r, true
+    }
+  }
+  return Reservation{}, false
+}
+
+func (p *Pool) isReserved(addr string) bool {
+  if s, _ := p.subnetOf(addr); s == nil {
+    return false
+  }
+  for _, r := range p.reservations {
+    for _, a := range r.Addresses {
+      if a == addr {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func (p *Pool) inNetworks(addrs []string) bool {
+  for _, addr := range addrs {
+    if s, _ := p.subnetOf(addr); s != nil {
+      return true
+    }
+  }
+  return false
+}
+
+func (p *Pool) subnetOf(addr string) (*subnet, net.IP) {
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    return nil, nil
+  }
+  for _, s := range p.subnets {
+    if s.ipNet.Contains(ip) {
+      if s.isIPv4() {
+        ip = ip.To4()
+      }
+      return s, ip
+    }
+  }
+  return nil, nil
+}
+
+// hostIP parses an address a peer may hold.
+func (p *Pool) hostIP(addr string) (*subnet, net.IP, error) {
+  if len(p.subnets) == 0 {
+    return nil, nil, ErrNoNetwork
+  }
+  s, ip := p.subnetOf(addr)
+  if s == nil || ip.Equal(s.server) || s.ordinal(ip) >= s.alloc.Size() {
+    return nil, nil, fmt.Errorf("%w: %v", ErrOutside, addr)
+  }
+  return s, ip, nil
+}
+
+func (s *subnet) isIPv4() bool {
+  return len(s.ipNet.IP) == net.IPv4len
+}
+
+// ordinal is the offset of the ip in the network, the networks are small
+// enough for the offset to fit the low 32 or 64 bits.
+func (s *subnet) ordinal(ip net.IP) uint64 {
+  if s.isIPv4() {
+    return uint64(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(s.ipNet.IP))
+  }
+  return binary.BigEndian.Uint64(ip.To16()[8:]) - binary.BigEndian.Uint64(s.ipNet.IP[8:])
+}
+
+func (s *subnet) address(ord uint64) string {
+  ip := make(net.IP, len(s.ipNet.IP))
+  copy(ip, s.ipNet.IP)
+  if s.isIPv4() {
+    binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(ord))
+  } else {
+    binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(ip[8:])+ord)
+  }
+  return ip.String()
+}
+
+func addressIn(addrs []string, s *subnet) string {
+  for _, addr := range addrs {
+    if ip := net.ParseIP(addr); ip != nil && s.ipNet.Contains(ip) {
+      return addr
+    }
+  }
+  return ""
+}
+
+func firstIP(addrs []string) net.IP {
+  if len(addrs) == 0 {
+    return nil
+  }
+  return net.ParseIP(addrs[0]).To16()
+}
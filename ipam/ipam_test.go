@@ -0,0 +1,274 @@
+package ipam
+
+import (
+  "errors"
+  "reflect"
+  "testing"
+  "time"
+)
+
+func newPool(t *testing.T, store Store, networks ...string) *Pool {
+  p, err := New(store)
+  if err != nil {
+    t.Fatalf("New() got error %v", err)
+  }
+  if len(networks) != 0 {
+    if err := p.Reset(networks...); err != nil {
+      t.Fatalf("Reset(%v) got error %v", networks, err)
+    }
+  }
+  return p
+}
+
+func acquire(t *testing.T, p *Pool, key string, name string) string {
+  addrs, err := p.Acquire(key, name)
+  if err != nil {
+    t.Fatalf("Acquire(%v, %v) got error %v", key, name, err)
+  }
+  return addrs[0]
+}
+
+func TestAcquire(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "10.1.2.1/24")
+  for _, key := range []string{"a", "b"} {
+    actual := acquire(t, p, key, "")
+    // a key keeps its address
+    if again := acquire(t, p, key, ""); actual != again {
+      t.Errorf("Acquire(%v) = %v, then %v; expected the same address", key, actual, again)
+    }
+  }
+  leases := p.Leases()
+  if len(leases) != 2 || leases[0].Addresses[0] != "10.1.2.2" || leases[1].Addresses[0] != "10.1.2.3" {
+    t.Errorf("Leases() = %v; expected 10.1.2.2 and 10.1.2.3", leases)
+  }
+}
+
+func TestAcquireSkipsServer(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "10.1.2.2/30")
+  if addr := acquire(t, p, "a", ""); addr != "10.1.2.1" {
+    t.Errorf("Acquire(a) = %v; expected 10.1.2.1", addr)
+  }
+  if addrs, err := p.Acquire("b", ""); !errors.Is(err, ErrExhausted) {
+    t.Errorf("Acquire(b) = %v, %v; expected %v", addrs, err, ErrExhausted)
+  }
+  if err := p.Release("a"); err != nil {
+    t.Fatalf("Release(a) got error %v", err)
+  }
+  if addr := acquire(t, p, "b", ""); addr != "10.1.2.1" {
+    t.Errorf("Acquire(b) = %v; expected the released 10.1.2.1", addr)
+  }
+}
+
+func TestAcquireIPv6(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "fd12:3456:789a:1::1/64")
+  // ::0 is the subnet-router anycast address and ::1 the server
+  if addr := acquire(t, p, "a", ""); addr != "fd12:3456:789a:1::2" {
+    t.Errorf("Acquire(a) = %v; expected fd12:3456:789a:1::2", addr)
+  }
+  if err := p.Claim("b", "fd12:3456:789a:1::ffff"); err != nil {
+    t.Errorf("Claim(b, fd12:3456:789a:1::ffff) got error %v", err)
+  }
+  // past the addresses handed out
+  if err := p.Claim("c", "fd12:3456:789a:1::1:0"); !errors.Is(err, ErrOutside) {
+    t.Errorf("Claim(c, fd12:3456:789a:1::1:0) = %v; expected %v", err, ErrOutside)
+  }
+  if err := p.Reset("fd00::/48"); err == nil {
+    t.Errorf("Reset(fd00::/48) succeeded; expected networks up to /64 only")
+  }
+}
+
+func TestAcquireDualStack(t *testing.T) {
+  store := &MemoryStore{}
+  p := newPool(t, store, "fd12:3456:789a:1::1/64", "10.1.2.1/24")
+  if networks := p.Networks(); !reflect.DeepEqual(networks, []string{"10.1.2.1/24", "fd12:3456:789a:1::1/64"}) {
+    t.Errorf("Networks() = %v; expected the ipv4 network first", networks)
+  }
+  addrs, err := p.Acquire("a", "")
+  expected := []string{"10.1.2.2", "fd12:3456:789a:1::2"}
+  if err != nil || !reflect.DeepEqual(addrs, expected) {
+    t.Errorf("Acquire(a) = %v, %v; expected %v", addrs, err, expected)
+  }
+
+  // a peer configured before the ipv6 network claims the ipv4 address first
+  if err := p.Claim("b", "10.1.2.9"); err != nil {
+    t.Fatalf("Claim(b, 10.1.2.9) got error %v", err)
+  }
+  if err := p.Claim("b", "fd12:3456:789a:1::9"); err != nil {
+    t.Errorf("Claim(b, fd12:3456:789a:1::9) got error %v", err)
+  }
+  if err := p.Claim("b", "10.1.2.10"); !errors.Is(err, ErrInUse) {
+    t.Errorf("Claim(b, 10.1.2.10) = %v; expected %v", err, ErrInUse)
+  }
+
+  p = newPool(t, store)
+  if again, _ := p.Acquire("a", ""); !reflect.DeepEqual(again, expected) {
+    t.Errorf("after restart: Acquire(a) = %v; expected %v", again, expected)
+  }
+  if err := p.Reset("10.1.2.1/24", "10.2.0.1/16"); err == nil {
+    t.Errorf("Reset() of two ipv4 networks succeeded; expected one per family")
+  }
+}
+
+func TestPersistence(t *testing.T) {
+  store := &MemoryStore{}
+  p := newPool(t, store, "10.1.2.1/24")
+  first := acquire(t, p, "a", "")
+
+  // tricarbd restarted
+  p = newPool(t, store)
+  if networks := p.Networks(); len(networks) != 1 || networks[0] != "10.1.2.1/24" {
+    t.Errorf("Networks() = %v; expected 10.1.2.1/24", networks)
+  }
+  if addr := acquire(t, p, "a", ""); addr != first {
+    t.Errorf("Acquire(a) = %v; expected the lease %v", addr, first)
+  }
+  if addr := acquire(t, p, "b", ""); addr == first {
+    t.Errorf("Acquire(b) = %v; handed out twice", addr)
+  }
+}
+
+func TestClaim(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "10.1.2.1/24")
+  if err := p.Claim("a", "10.1.2.9"); err != nil {
+    t.Fatalf("Claim(a, 10.1.2.9) got error %v", err)
+  }
+  if err := p.Claim("b", "10.1.2.9"); !errors.Is(err, ErrInUse) {
+    t.Errorf("Claim(b, 10.1.2.9) = %v; expected %v", err, ErrInUse)
+  }
+  for _, addr := range []string{"10.1.3.9", "10.1.2.1", "bogus"} {
+    if err := p.Claim("c", addr); !errors.Is(err, ErrOutside) {
+      t.Errorf("Claim(c, %v) = %v; expected %v", addr, err, ErrOutside)
+    }
+  }
+}
+
+func TestExpire(t *testing.T) {
+  store := &MemoryStore{}
+  p := newPool(t, store, "10.1.2.1/24")
+  acquire(t, p, "a", "")
+  acquire(t, p, "b", "")
+  at := time.Unix(1700000000, 0)
+  if err := p.Expire("a", at); err != nil {
+    t.Fatalf("Expire(a) got error %v", err)
+  }
+  if err := p.Expire("c", at); !errors.Is(err, ErrNoLease) {
+    t.Errorf("Expire(c) = %v; expected %v", err, ErrNoLease)
+  }
+
+  // tricarbd restarted
+  p = newPool(t, store)
+  leases := p.Leases()
+  if len(leases) != 2 || !leases[0].Expires.Equal(at) || !leases[1].Expires.IsZero() {
+    t.Fatalf("Leases() = %v; expected a to expire at %v", leases, at)
+  }
+  if leases[0].Expired(at) || !leases[0].Expired(at.Add(time.Second)) {
+    t.Errorf("Expired() of %v wrong around %v", leases[0], at)
+  }
+  if leases[1].Expired(at.Add(time.Hour)) {
+    t.Errorf("Expired() of %v; expected never", leases[1])
+  }
+  if leases[0].Attached.IsZero() {
+    t.Errorf("Leases() = %v; expected an attach time", leases)
+  }
+}
+
+func TestRestore(t *testing.T) {
+  store := &MemoryStore{}
+  p := newPool(t, store, "10.1.2.1/24")
+  a := acquire(t, p, "a", "")
+  saved := p.State()
+  acquire(t, p, "b", "")
+  if err := p.Reset("10.9.9.1/24"); err != nil {
+    t.Fatalf("Reset() got error %v", err)
+  }
+
+  if err := p.Restore(saved); err != nil {
+    t.Fatalf("Restore() got error %v", err)
+  }
+  if !reflect.DeepEqual(p.State(), saved) {
+    t.Errorf("State() = %v; expected %v", p.State(), saved)
+  }
+  // the address of b is free again, the one of a is not
+  if actual := acquire(t, p, "c", ""); actual == a {
+    t.Errorf("Acquire(c) = %v; expected another address than a's", actual)
+  }
+  if p = newPool(t, store); len(p.Leases()) != 2 {
+    t.Errorf("after restart: leases %v; expected a and c", p.Leases())
+  }
+}
+
+func TestReservation(t *testing.T) {
+  store := &MemoryStore{}
+  p := newPool(t, store, "10.1.2.1/24")
+  r, err := p.Reserve(Reservation{Name: "laptop", Addresses: []string{"10.1.2.2"}})
+  if err != nil {
+    t.Fatalf("Reserve(laptop) got error %v", err)
+  }
+  if _, err := p.Reserve(Reservation{Name: "laptop"}); !errors.Is(err, ErrReserved) {
+    t.Errorf("Reserve(laptop) again = %v; expected %v", err, ErrReserved)
+  }
+  if _, err := p.Reserve(Reservation{Name: "phone", Addresses: []string{"10.1.2.2"}}); !errors.Is(err, ErrInUse) {
+    t.Errorf("Reserve(phone, 10.1.2.2) = %v; expected %v", err, ErrInUse)
+  }
+
+  // the reserved address is skipped for others and kept over detach and
+  // re-attach with a new key
+  if addr := acquire(t, p, "a", "desktop"); addr != "10.1.2.3" {
+    t.Errorf("Acquire(a, desktop) = %v; expected 10.1.2.3", addr)
+  }
+  if addr := acquire(t, p, "b", "laptop"); addr != r.Addresses[0] {
+    t.Errorf("Acquire(b, laptop) = %v; expected the reserved %v", addr, r.Addresses[0])
+  }
+  p.Release("b")
+  if addr := acquire(t, p, "c", ""); addr != "10.1.2.4" {
+    t.Errorf("Acquire(c) = %v; expected 10.1.2.4", addr)
+  }
+  p = newPool(t, store)
+  if addr := acquire(t, p, "d", "laptop"); addr != r.Addresses[0] {
+    t.Errorf("after restart: Acquire(d, laptop) = %v; expected the reserved %v", addr, r.Addresses[0])
+  }
+}
+
+func TestReserveSticky(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "10.1.2.1/24")
+  acquire(t, p, "a", "")
+  addr := acquire(t, p, "b", "")
+
+  r, err := p.Reserve(Reservation{PublicKey: "b"})
+  if err != nil || r.Addresses[0] != "10.1.2.4" {
+    t.Errorf("Reserve(b) = %v, %v; expected the lowest free 10.1.2.4", r, err)
+  }
+  p.Unreserve("b", "")
+  if r, err = p.Reserve(Reservation{PublicKey: "b", Addresses: []string{addr}}); err != nil {
+    t.Errorf("Reserve(b, %v) got error %v; expected the held address to become sticky", addr, err)
+  }
+  if _, err := p.Reserve(Reservation{PublicKey: "c", Addresses: []string{"10.1.2.2"}}); !errors.Is(err, ErrInUse) {
+    t.Errorf("Reserve(c, 10.1.2.2) = %v; expected %v", err, ErrInUse)
+  }
+
+  if _, err := p.Unreserve("", "nobody"); !errors.Is(err, ErrNotFound) {
+    t.Errorf("Unreserve(nobody) = %v; expected %v", err, ErrNotFound)
+  }
+  if _, err := p.Unreserve("b", ""); err != nil {
+    t.Errorf("Unreserve(b) got error %v", err)
+  }
+  if len(p.Reservations()) != 0 {
+    t.Errorf("Reservations() = %v; expected none", p.Reservations())
+  }
+}
+
+func TestReserveDualStack(t *testing.T) {
+  p := newPool(t, &MemoryStore{}, "10.1.2.1/24", "fd12:3456:789a:1::1/64")
+  // the ipv6 address is picked when only the ipv4 one is given
+  r, err := p.Reserve(Reservation{Name: "laptop", Addresses: []string{"10.1.2.9"}})
+  expected := []string{"10.1.2.9", "fd12:3456:789a:1::2"}
+  if err != nil || !reflect.DeepEqual(r.Addresses, expected) {
+    t.Errorf("Reserve(laptop, 10.1.2.9) = %v, %v; expected %v", r, err, expected)
+  }
+  if addrs, _ := p.Acquire("a", "laptop"); !reflect.DeepEqual(addrs, expected) {
+    t.Errorf("Acquire(a, laptop) = %v; expected %v", addrs, expected)
+  }
+  if _, err := p.Reserve(Reservation{Name: "phone", Addresses: []string{"10.1.2.10", "10.1.2.11"}}); !errors.Is(err, ErrInUse) {
+    t.Errorf("Reserve(phone) of two ipv4 addresses = %v; expected %v", err, ErrInUse)
+  }
+}
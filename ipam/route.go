@@ -0,0 +1,136 @@
+package ipam
+
+import (
+  "bufio"
+  "encoding/binary"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+)
+
+const (
+  procRoute     = "/proc/net/route"
+  procIPv6Route = "/proc/net/ipv6_route"
+  // routes the kernel adds for the addresses of the host itself
+  rtfLocal = 0x80000000
+)
+
+// LocalPrefixes returns the prefixes routed by the host, a network for the
+// tunnel must not overlap them or the host loses the route to them. Default,
+// link-local, multicast and loopback routes are left out, so are the routes
+// of the exclude interfaces, e.g. the tunnel itself.
+func LocalPrefixes(exclude ...string) ([]string, error) {
+  skip := map[string]bool{"lo": true}
+  for _, iface := range exclude {
+    skip[iface] = true
+  }
+  prefixes := []string{}
+  for _, table := range []struct {
+    path  string
+    parse func(io.Reader, map[string]bool) ([]string, error)
+  }{
+    {procRoute, parseRoute},
+    {procIPv6Route, parseIPv6Route},
+  } {
+    f, err := os.Open(table.path)
+    if os.IsNotExist(err) {
+      // no ipv6 or not linux
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    routes, err := table.parse(f, skip)
+    f.Close()
+    if err != nil {
+      return nil, fmt.Errorf("%v: %w", table.path, err)
+    }
+    prefixes = append(prefixes, routes...)
+  }
+  return prefixes, nil
+}
+
+// Overlap returns the first pair of overlapping prefixes from a and b,
+// unparsable prefixes overlap nothing.
+func Overlap(a []string, b []string) (string, string, bool) {
+  for _, x := range a {
+    _, xNet, err := net.ParseCIDR(x)
+    if err != nil {
+      continue
+    }
+    for _, y := range b {
+      _, yNet, err := net.ParseCIDR(y)
+      if err != nil {
+        continue
+      }
+      if xNet.Contains(yNet.IP) || yNet.Contains(xNet.IP) {
+        return x, y, true
+      }
+    }
+  }
+  return "", "", false
+}
+
+// parseRoute reads /proc/net/route, destination and mask are little endian
+// hex.
+func parseRoute(r io.Reader, skip map[string]bool) ([]string, error) {
+  prefixes := []string{}
+  scanner := bufio.NewScanner(r)
+  for first := true; scanner.Scan(); first = false {
+    fields := strings.Fields(scanner.Text())
+    if first || len(fields) < 8 || skip[fields[0]] {
+      continue
+    }
+    dst, err := strconv.ParseUint(fields[1], 16, 32)
+    if err != nil {
+      return nil, err
+    }
+    mask, err := strconv.ParseUint(fields[7], 16, 32)
+    if err != nil {
+      return nil, err
+    }
+    ipNet := &net.IPNet{IP: make(net.IP, net.IPv4len), Mask: make(net.IPMask, net.IPv4len)}
+    binary.LittleEndian.PutUint32(ipNet.IP, uint32(dst))
+    binary.LittleEndian.PutUint32(ipNet.Mask, uint32(mask))
+    if ones, _ := ipNet.Mask.Size(); ones == 0 || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsMulticast() {
+      continue
+    }
+    prefixes = append(prefixes, ipNet.String())
+  }
+  return prefixes, scanner.Err()
+}
+
+// parseIPv6Route reads /proc/net/ipv6_route, destination and prefix length
+// come first and the interface last.
+func parseIPv6Route(r io.Reader, skip map[string]bool) ([]string, error) {
+  prefixes := []string{}
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) < 10 || skip[fields[9]] {
+      continue
+    }
+    dst, err := hex.DecodeString(fields[0])
+    if err != nil || len(dst) != net.IPv6len {
+      return nil, fmt.Errorf("invalid destination %v", fields[0])
+    }
+    ones, err := strconv.ParseUint(fields[1], 16, 8)
+    if err != nil {
+      return nil, err
+    }
+    flags, err := strconv.ParseUint(fields[8], 16, 32)
+    if err != nil {
+      return nil, err
+    }
+    ip := net.IP(dst)
+    if ones == 0 || flags&rtfLocal != 0 || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+      continue
+    }
+    prefixes = append(prefixes, (&net.IPNet{IP: ip, Mask: net.CIDRMask(int(ones), 128)}).String())
+  }
+  return prefixes, scanner.Err()
+}
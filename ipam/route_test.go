@@ -0,0 +1,54 @@
+package ipam
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseRoute(t *testing.T) {
+  table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	010200C0	0003	0	0	0	00000000	0	0	0
+eth0	000200C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	0000FEA9	00000000	0001	0	0	1000	0000FFFF	0	0	0
+eth0	000000E0	00000000	0001	0	0	0	000000F0	0	0	0
+wg0	00020A0A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`
+  actual, err := parseRoute(strings.NewReader(table), map[string]bool{"wg0": true})
+  expected := []string{"192.0.2.0/24", "172.17.0.0/16"}
+  if err != nil || !reflect.DeepEqual(actual, expected) {
+    t.Errorf("parseRoute() = %v, %v; expected %v", actual, err, expected)
+  }
+}
+
+func TestParseIPv6Route(t *testing.T) {
+  table := `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000002 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo
+fd000000000000000000000000000002 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001     eth0
+ff000000000000000000000000000000 08 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000004 00000000 00000001     eth0
+`
+  actual, err := parseIPv6Route(strings.NewReader(table), map[string]bool{"lo": true})
+  expected := []string{"fd00::/64"}
+  if err != nil || !reflect.DeepEqual(actual, expected) {
+    t.Errorf("parseIPv6Route() = %v, %v; expected %v", actual, err, expected)
+  }
+}
+
+func TestOverlap(t *testing.T) {
+  local := []string{"192.168.1.0/24", "10.0.0.0/8", "fd00::/64"}
+  for network, expected := range map[string]string{
+    "10.20.30.1/24":    "10.0.0.0/8",
+    "192.168.0.1/16":   "192.168.1.0/24",
+    "fd00::1/64":       "fd00::/64",
+    "172.16.0.1/24":    "",
+    "fd00:0:0:1::1/64": "",
+  } {
+    _, actual, ok := Overlap([]string{network}, local)
+    if actual != expected || ok != (expected != "") {
+      t.Errorf("Overlap(%v) = %v, %v; expected %v", network, actual, ok, expected)
+    }
+  }
+}
@@ -0,0 +1,196 @@
+package ipam
+
+import (
+  "sync"
+  "time"
+
+  "github.com/GreysTone/tricarboxylic/state"
+)
+
+const (
+  stateKey = "ipam"
+)
+
+// Lease is the addresses held by the peer with the public key, one in each
+// network. Name is the one the peer attached with, Attached when it got the
+// addresses and Expires when it loses them, zero is never.
+type Lease struct {
+  PublicKey string
+  Name      string
+  Addresses []string
+  Attached  time.Time
+  Expires   time.Time
+}
+
+// Expired tells whether the lease expired before now, it is held until it
+// is released.
+func (l Lease) Expired(now time.Time) bool {
+  return !l.Expires.IsZero() && l.Expires.Before(now)
+}
+
+// Reservation keeps addresses for the peer with the public key or the
+// name, at least one of them is set.
+type Reservation struct {
+  PublicKey string
+  Name      string
+  Addresses []string
+}
+
+func (r Reservation) String() string {
+  if r.Name != "" {
+    return r.Name
+  }
+  return r.PublicKey
+}
+
+// State is what a Store persists, Networks are the CIDRs of the server,
+// e.g. 10.20.30.1/24 and fd12:3456:789a:1::1/64.
+type State struct {
+  Networks     []string
+  Leases       []Lease
+  Reservations []Reservation
+}
+
+// Store persists the state of a Pool, every change is saved before the
+// Pool returns.
+type Store interface {
+  Load() (State, error)
+  Save(State) error
+}
+
+// stateRecord also reads the single Network and Address of configs written
+// before dual-stack.
+type stateRecord struct {
+  Network      string `json:",omitempty"`
+  Networks     []string
+  Leases       []addressRecord
+  Reservations []addressRecord
+}
+
+// addressRecord keeps the times of a lease as unix seconds, zero is unset.
+type addressRecord struct {
+  PublicKey string
+  Name      string
+  Address   string `json:",omitempty"`
+  Addresses []string
+  Attached  int64
+  Expires   int64
+}
+
+func (r addressRecord) addresses() []string {
+  if len(r.Addresses) == 0 && r.Address != "" {
+    return []string{r.Address}
+  }
+  return r.Addresses
+}
+
+// StateStore keeps the state in the state store next to the backends'
+// peers, nil Store is the default one. Pool names the pool of a group,
+// empty is the default one.
+type StateStore struct {
+  Store *state.Store
+  Pool  string
+}
+
+func (s StateStore) key() string {
+  if s.Pool == "" {
+    return stateKey
+  }
+  return stateKey + "_" + s.Pool
+}
+
+func (s StateStore) Load() (State, error) {
+  var record stateRecord
+  if _, err := s.get(s.key(), &record); err != nil {
+    return State{}, err
+  }
+  st := State{Networks: record.Networks}
+  if len(st.Networks) == 0 && record.Network != "" {
+    st.Networks = []string{record.Network}
+  }
+  for _, l := range record.Leases {
+    st.Leases = append(st.Leases, Lease{
+      PublicKey: l.PublicKey,
+      Name:      l.Name,
+      Addresses: l.addresses(),
+      Attached:  fromUnix(l.Attached),
+      Expires:   fromUnix(l.Expires),
+    })
+  }
+  for _, r := range record.Reservations {
+    st.Reservations = append(st.Reservations, Reservation{PublicKey: r.PublicKey, Name: r.Name, Addresses: r.addresses()})
+  }
+  return st, nil
+}
+
+func (s StateStore) Save(st State) error {
+  record := stateRecord{
+    Networks:     st.Networks,
+    Leases:       []addressRecord{},
+    Reservations: []addressRecord{},
+  }
+  for _, l := range st.Leases {
+    record.Leases = append(record.Leases, addressRecord{
+      PublicKey: l.PublicKey,
+      Name:      l.Name,
+      Addresses: l.Addresses,
+      Attached:  toUnix(l.Attached),
+      Expires:   toUnix(l.Expires),
+    })
+  }
+  for _, r := range st.Reservations {
+    record.Reservations = append(record.Reservations, addressRecord{PublicKey: r.PublicKey, Name: r.Name, Addresses: r.Addresses})
+  }
+  if s.Store != nil {
+    return s.Store.Put(s.key(), record)
+  }
+  return state.Put(s.key(), record)
+}
+
+func (s StateStore) get(key string, v interface{}) (bool, error) {
+  if s.Store != nil {
+    return s.Store.Get(key, v)
+  }
+  return state.Get(key, v)
+}
+
+func toUnix(t time.Time) int64 {
+  if t.IsZero() {
+    return 0
+  }
+  return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+  if sec == 0 {
+    return time.Time{}
+  }
+  return time.Unix(sec, 0)
+}
+
+// MemoryStore keeps the state in memory, for tests.
+type MemoryStore struct {
+  mu    sync.Mutex
+  state State
+}
+
+func (s *MemoryStore) Load() (State, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return State{
+    Networks:     append([]string{}, s.state.Networks...),
+    Leases:       append([]Lease{}, s.state.Leases...),
+    Reservations: append([]Reservation{}, s.state.Reservations...),
+  }, nil
+}
+
+func (s *MemoryStore) Save(state State) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.state = State{
+    Networks:     append([]string{}, state.Networks...),
+    Leases:       append([]Lease{}, state.Leases...),
+    Reservations: append([]Reservation{}, state.Reservations...),
+  }
+  return nil
+}
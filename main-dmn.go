@@ -3,27 +3,54 @@ package main
 import (
   "fmt"
   "log"
+  "math/rand"
   "net"
+  "time"
 
   "google.golang.org/grpc"
 
+  "github.com/GreysTone/tricarboxylic/config"
   "github.com/GreysTone/tricarboxylic/daemon"
   pb "github.com/GreysTone/tricarboxylic/rpc"
-)
-
-const (
-  port = ":50101"
+  "github.com/GreysTone/tricarboxylic/utils"
 )
 
 func main() {
-  lis, err := net.Listen("tcp", port)
+  // random ports and networks differ between runs
+  rand.Seed(time.Now().UnixNano())
+  if err := utils.LoadConfig(); err != nil {
+    log.Fatalf("failed to read config: %v", err)
+  }
+  srv, err := daemon.New(daemon.Options{})
+  if err != nil {
+    log.Fatalf("failed to load state: %v", err)
+  }
+  socket, addr := config.AdminSocket(), config.PublicAddr()
+  adminLis, err := srv.ListenAdmin(socket)
   if err != nil {
     log.Fatalf("failed to listen: %v", err)
   }
-  fmt.Printf("Server listening on: %v\n", port)
-  s := grpc.NewServer()
-  pb.RegisterTricarbServer(s, &daemon.Server{})
-  if err := s.Serve(lis); err != nil {
-    log.Fatalf("faled to serve: %v", err)
+  publicLis, err := net.Listen("tcp", addr)
+  if err != nil {
+    log.Fatalf("failed to listen: %v", err)
+  }
+  fmt.Printf("Admin API listening on: %v\n", socket)
+  fmt.Printf("Peers join on: %v\n", addr)
+  admin := grpc.NewServer()
+  public := grpc.NewServer(grpc.UnaryInterceptor(daemon.PeerOnly))
+  if err := srv.Recover(); err != nil {
+    fmt.Printf("warning: failed to recover the last run: %v\n", err)
+  }
+  pb.RegisterTricarbServer(admin, srv)
+  pb.RegisterTricarbServer(public, srv)
+  go srv.RunReaper(daemon.ReapInterval)
+  go srv.RunReconciler(daemon.ReconcileInterval)
+  go func() {
+    if err := public.Serve(publicLis); err != nil {
+      log.Fatalf("failed to serve: %v", err)
+    }
+  }()
+  if err := admin.Serve(adminLis); err != nil {
+    log.Fatalf("failed to serve: %v", err)
   }
 }
@@ -0,0 +1,140 @@
+package state
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "strconv"
+
+  bolt "go.etcd.io/bbolt"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+var (
+  ErrSchema = errors.New("state schema newer than this tricarbd")
+
+  // migrations[i] brings the schema from version i to i+1, each one runs
+  // in its own transaction and may read what config.yaml kept
+  migrations = []func(tx *Tx, legacy func(string) interface{}) error{
+    importConfig,
+  }
+
+  // legacyKeys are what tricarbd kept in config.yaml before the store, the
+  // pools add the state of their address pools
+  legacyKeys = []string{
+    "wg.iface", "wg.peers",
+    "ovpn.iface", "ovpn.peers",
+    "ipsec.iface", "ipsec.peers",
+    "ipam", "pools", "access", "default.mode",
+  }
+  // readLegacy reads config.yaml and forgetLegacy removes the imported keys
+  // from it, tests replace them
+  readLegacy   = utils.Read
+  forgetLegacy = utils.Delete
+)
+
+// migrate runs the migrations the store has not seen yet, a store written by
+// a newer tricarbd is refused.
+func (s *Store) migrate() error {
+  for {
+    done := false
+    err := s.db.Update(func(tx *bolt.Tx) error {
+      if _, err := tx.CreateBucketIfNotExists(bucketMeta); err != nil {
+        return err
+      }
+      if _, err := tx.CreateBucketIfNotExists(bucketState); err != nil {
+        return err
+      }
+      version, err := schemaVersion(tx)
+      if err != nil {
+        return err
+      }
+      if version > len(migrations) {
+        return fmt.Errorf("%w: %v", ErrSchema, version)
+      }
+      if version == len(migrations) {
+        done = true
+        return nil
+      }
+      if err := migrations[version](&Tx{tx: tx}, s.legacy); err != nil {
+        return fmt.Errorf("migrate to schema %v: %w", version+1, err)
+      }
+      return tx.Bucket(bucketMeta).Put(keySchema, []byte(strconv.Itoa(version+1)))
+    })
+    if err != nil || done {
+      return err
+    }
+  }
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+  raw := tx.Bucket(bucketMeta).Get(keySchema)
+  if raw == nil {
+    return 0, nil
+  }
+  return strconv.Atoi(string(raw))
+}
+
+// importConfig is schema 1, it copies the state out of config.yaml. The
+// keys are removed from there once the store has them, see dropLegacy.
+func importConfig(tx *Tx, legacy func(string) interface{}) error {
+  keys := importedKeys(legacy)
+  for _, key := range keys {
+    if err := tx.Put(key, legacy(key)); err != nil {
+      return err
+    }
+  }
+  if len(keys) == 0 {
+    return nil
+  }
+  raw, err := json.Marshal(keys)
+  if err != nil {
+    return err
+  }
+  return tx.tx.Bucket(bucketMeta).Put(keyLegacy, raw)
+}
+
+// importedKeys are the legacy keys config.yaml holds.
+func importedKeys(legacy func(string) interface{}) []string {
+  keys := append([]string{}, legacyKeys...)
+  if pools, ok := legacy("pools").(map[string]interface{}); ok {
+    for name := range pools {
+      keys = append(keys, "ipam_"+name)
+    }
+  }
+  set := []string{}
+  for _, key := range keys {
+    if legacy(key) != nil {
+      set = append(set, key)
+    }
+  }
+  return set
+}
+
+// dropLegacy removes what importConfig copied from config.yaml, the secrets
+// must not stay behind in a file users edit and share. The import records
+// its keys in the store, they are removed once and the record goes with them.
+// A failed removal keeps the record, the next open retries it.
+func (s *Store) dropLegacy() error {
+  if s.forget == nil {
+    return nil
+  }
+  var keys []string
+  err := s.db.View(func(tx *bolt.Tx) error {
+    raw := tx.Bucket(bucketMeta).Get(keyLegacy)
+    if raw == nil {
+      return nil
+    }
+    return json.Unmarshal(raw, &keys)
+  })
+  if err != nil || len(keys) == 0 {
+    return err
+  }
+  if err := s.forget(keys...); err != nil {
+    return fmt.Errorf("remove the imported state from config.yaml: %w", err)
+  }
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return tx.Bucket(bucketMeta).Delete(keyLegacy)
+  })
+}
@@ -0,0 +1,191 @@
+package state
+
+import (
+  "encoding/json"
+  "fmt"
+  "path"
+  "sync"
+  "time"
+
+  bolt "go.etcd.io/bbolt"
+
+  "github.com/GreysTone/tricarboxylic/utils"
+)
+
+const (
+  // FileName is the store next to config.yaml
+  FileName = "state.db"
+
+  // a second tricarbd waits that long for the lock before giving up
+  openTimeout = time.Second
+)
+
+var (
+  bucketMeta  = []byte("meta")
+  bucketState = []byte("state")
+  keySchema   = []byte("schema")
+  // keyLegacy lists the keys imported from config.yaml until they are
+  // removed from there
+  keyLegacy = []byte("legacy")
+
+  defaultOnce  sync.Once
+  defaultStore *Store
+  defaultErr   error
+)
+
+// Store keeps what tricarbd changes itself, the interface and peers of the
+// backends, the leases, pools and secrets, in a single file. Each Update is
+// one transaction, a failed or interrupted one leaves nothing behind.
+// config.yaml only keeps the settings a user edits.
+//
+// Values are JSON under the keys config.yaml used before the store, e.g.
+// wg.iface.
+type Store struct {
+  db *bolt.DB
+  // legacy reads what config.yaml kept for the first migration, forget
+  // removes it from there
+  legacy func(key string) interface{}
+  forget func(keys ...string) error
+}
+
+// Tx reads and writes the values of one transaction.
+type Tx struct {
+  tx *bolt.Tx
+}
+
+// Open opens or creates the store at path and migrates it to the current
+// schema, a new store takes over the state kept in config.yaml.
+func Open(path string) (*Store, error) {
+  return open(path, func(key string) interface{} { return readLegacy(key) },
+    func(keys ...string) error { return forgetLegacy(keys...) })
+}
+
+// OpenIsolated is Open for a store which is not tricarbd's, e.g. of a Server
+// embedded in another program or of a test, a new one starts empty.
+func OpenIsolated(path string) (*Store, error) {
+  return open(path, func(string) interface{} { return nil }, nil)
+}
+
+func open(path string, legacy func(string) interface{}, forget func(...string) error) (*Store, error) {
+  db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+  if err != nil {
+    return nil, fmt.Errorf("open %v: %w", path, err)
+  }
+  s := &Store{db: db, legacy: legacy, forget: forget}
+  if err := s.migrate(); err != nil {
+    db.Close()
+    return nil, err
+  }
+  if err := s.dropLegacy(); err != nil {
+    db.Close()
+    return nil, err
+  }
+  return s, nil
+}
+
+// Default is the store next to config.yaml, it is opened on first use and
+// stays open.
+func Default() (*Store, error) {
+  defaultOnce.Do(func() {
+    defaultStore, defaultErr = Open(path.Join(utils.ConfigDir(), FileName))
+  })
+  return defaultStore, defaultErr
+}
+
+// Get reads the key from the default store, it tells whether the key is set.
+func Get(key string, v interface{}) (bool, error) {
+  s, err := Default()
+  if err != nil {
+    return false, err
+  }
+  return s.Get(key, v)
+}
+
+// Put writes the key to the default store.
+func Put(key string, v interface{}) error {
+  s, err := Default()
+  if err != nil {
+    return err
+  }
+  return s.Put(key, v)
+}
+
+// Update runs fn in one transaction of the default store.
+func Update(fn func(*Tx) error) error {
+  s, err := Default()
+  if err != nil {
+    return err
+  }
+  return s.Update(fn)
+}
+
+func (s *Store) Close() error {
+  return s.db.Close()
+}
+
+// View runs fn in a read-only transaction.
+func (s *Store) View(fn func(*Tx) error) error {
+  return s.db.View(func(tx *bolt.Tx) error {
+    return fn(&Tx{tx: tx})
+  })
+}
+
+// Update runs fn in a read-write transaction, an error from fn rolls back
+// every write of it.
+func (s *Store) Update(fn func(*Tx) error) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return fn(&Tx{tx: tx})
+  })
+}
+
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+  var ok bool
+  err := s.View(func(tx *Tx) error {
+    var err error
+    ok, err = tx.Get(key, v)
+    return err
+  })
+  return ok, err
+}
+
+func (s *Store) Put(key string, v interface{}) error {
+  return s.Update(func(tx *Tx) error {
+    return tx.Put(key, v)
+  })
+}
+
+// Version is the schema of the store.
+func (s *Store) Version() (int, error) {
+  var version int
+  err := s.View(func(tx *Tx) error {
+    var err error
+    version, err = schemaVersion(tx.tx)
+    return err
+  })
+  return version, err
+}
+
+// Get decodes the value of the key into v, v is left alone if the key is
+// not set.
+func (t *Tx) Get(key string, v interface{}) (bool, error) {
+  raw := t.tx.Bucket(bucketState).Get([]byte(key))
+  if raw == nil {
+    return false, nil
+  }
+  if err := json.Unmarshal(raw, v); err != nil {
+    return true, fmt.Errorf("state %v: %w", key, err)
+  }
+  return true, nil
+}
+
+func (t *Tx) Put(key string, v interface{}) error {
+  raw, err := json.Marshal(v)
+  if err != nil {
+    return fmt.Errorf("state %v: %w", key, err)
+  }
+  return t.tx.Bucket(bucketState).Put([]byte(key), raw)
+}
+
+func (t *Tx) Delete(key string) error {
+  return t.tx.Bucket(bucketState).Delete([]byte(key))
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+  "errors"
+  "path"
+  "reflect"
+  "testing"
+
+  bolt "go.etcd.io/bbolt"
+)
+
+func openStore(t *testing.T, file string) *Store {
+  s, err := Open(file)
+  if err != nil {
+    t.Fatalf("Open(%v) got error %v", file, err)
+  }
+  return s
+}
+
+// setLegacy replaces what config.yaml holds for the test.
+func setLegacy(t *testing.T, legacy map[string]interface{}) {
+  read, forget := readLegacy, forgetLegacy
+  readLegacy = func(key string) interface{} { return legacy[key] }
+  forgetLegacy = func(keys ...string) error {
+    for _, key := range keys {
+      delete(legacy, key)
+    }
+    return nil
+  }
+  t.Cleanup(func() { readLegacy, forgetLegacy = read, forget })
+}
+
+func TestPutGet(t *testing.T) {
+  setLegacy(t, nil)
+  file := path.Join(t.TempDir(), FileName)
+  s := openStore(t, file)
+  if v, err := s.Version(); err != nil || v != len(migrations) {
+    t.Errorf("Version() = %v, %v; expected %v", v, err, len(migrations))
+  }
+  var mode string
+  if ok, err := s.Get("default.mode", &mode); ok || err != nil {
+    t.Errorf("Get() of an unset key = %v, %v; expected false", ok, err)
+  }
+  peers := []string{"a", "b"}
+  if err := s.Put("wg.peers", peers); err != nil {
+    t.Fatalf("Put() got error %v", err)
+  }
+  s.Close()
+
+  // what was written survives a restart
+  s = openStore(t, file)
+  defer s.Close()
+  var actual []string
+  if ok, err := s.Get("wg.peers", &actual); !ok || err != nil || !reflect.DeepEqual(actual, peers) {
+    t.Errorf("Get() = %v, %v, %v; expected %v", actual, ok, err, peers)
+  }
+}
+
+func TestUpdateRollsBack(t *testing.T) {
+  setLegacy(t, nil)
+  s := openStore(t, path.Join(t.TempDir(), FileName))
+  defer s.Close()
+  if err := s.Put("wg.iface", "old"); err != nil {
+    t.Fatalf("Put() got error %v", err)
+  }
+  failed := errors.New("failed")
+  err := s.Update(func(tx *Tx) error {
+    if err := tx.Put("wg.iface", "new"); err != nil {
+      return err
+    }
+    if err := tx.Put("wg.peers", []string{"a"}); err != nil {
+      return err
+    }
+    return failed
+  })
+  if !errors.Is(err, failed) {
+    t.Errorf("Update() got error %v; expected %v", err, failed)
+  }
+  var iface string
+  if _, err := s.Get("wg.iface", &iface); err != nil || iface != "old" {
+    t.Errorf("Get(wg.iface) = %v, %v; expected the value before the update", iface, err)
+  }
+  if ok, _ := s.Get("wg.peers", &[]string{}); ok {
+    t.Errorf("Get(wg.peers) found a value of a failed update")
+  }
+}
+
+func TestImportConfig(t *testing.T) {
+  legacy := map[string]interface{}{
+    "wg.iface":     map[string]interface{}{"publickey": "key"},
+    "default.mode": "server",
+    "pools":        map[string]interface{}{"laptops": map[string]interface{}{"cidr": "10.0.0.0/8"}},
+    "ipam_laptops": map[string]interface{}{"networks": []interface{}{"10.1.2.1/24"}},
+  }
+  setLegacy(t, legacy)
+
+  file := path.Join(t.TempDir(), FileName)
+  s := openStore(t, file)
+  var mode string
+  if _, err := s.Get("default.mode", &mode); err != nil || mode != "server" {
+    t.Errorf("Get(default.mode) = %v, %v; expected server", mode, err)
+  }
+  var networks struct{ Networks []string }
+  if _, err := s.Get("ipam_laptops", &networks); err != nil || len(networks.Networks) != 1 {
+    t.Errorf("Get(ipam_laptops) = %v, %v; expected the pool's network", networks, err)
+  }
+  if len(legacy) != 0 {
+    t.Errorf("after import: config.yaml keeps %v; expected the imported keys removed", legacy)
+  }
+  s.Close()
+
+  // config.yaml is only read once
+  legacy["default.mode"] = "client"
+  s = openStore(t, file)
+  defer s.Close()
+  if _, err := s.Get("default.mode", &mode); err != nil || mode != "server" {
+    t.Errorf("after reopening: Get(default.mode) = %v, %v; expected server", mode, err)
+  }
+  if legacy["default.mode"] != "client" {
+    t.Errorf("after reopening: config.yaml keeps %v; expected the key set later left alone", legacy)
+  }
+}
+
+func TestDropLegacyRetries(t *testing.T) {
+  legacy := map[string]interface{}{"default.mode": "server"}
+  setLegacy(t, legacy)
+  forget := forgetLegacy
+  forgetLegacy = func(keys ...string) error { return errors.New("read-only") }
+
+  file := path.Join(t.TempDir(), FileName)
+  if _, err := Open(file); err == nil {
+    t.Fatalf("Open() with a read-only config.yaml got no error")
+  }
+  if len(legacy) != 1 {
+    t.Fatalf("after failed removal: config.yaml keeps %v; expected the key", legacy)
+  }
+
+  forgetLegacy = forget
+  s := openStore(t, file)
+  defer s.Close()
+  if len(legacy) != 0 {
+    t.Errorf("after reopening: config.yaml keeps %v; expected the imported keys removed", legacy)
+  }
+  var mode string
+  if _, err := s.Get("default.mode", &mode); err != nil || mode != "server" {
+    t.Errorf("Get(default.mode) = %v, %v; expected server", mode, err)
+  }
+}
+
+func TestOpenIsolated(t *testing.T) {
+  setLegacy(t, map[string]interface{}{"default.mode": "server"})
+  s, err := OpenIsolated(path.Join(t.TempDir(), FileName))
+  if err != nil {
+    t.Fatalf("OpenIsolated() got error %v", err)
+  }
+  defer s.Close()
+  if ok, err := s.Get("default.mode", new(string)); ok || err != nil {
+    t.Errorf("Get(default.mode) = %v, %v; expected nothing imported", ok, err)
+  }
+}
+
+func TestNewerSchema(t *testing.T) {
+  setLegacy(t, nil)
+  file := path.Join(t.TempDir(), FileName)
+  s := openStore(t, file)
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    return tx.Bucket(bucketMeta).Put(keySchema, []byte("99"))
+  })
+  if err != nil {
+    t.Fatalf("writing schema got error %v", err)
+  }
+  s.Close()
+  if _, err := Open(file); !errors.Is(err, ErrSchema) {
+    t.Errorf("Open() of a newer schema got error %v; expected %v", err, ErrSchema)
+  }
+}
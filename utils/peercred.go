@@ -0,0 +1,29 @@
+package utils
+
+import (
+  "errors"
+  "net"
+  "syscall"
+)
+
+// PeerCred is the process on the other end of a unix socket, as the kernel
+// tells it.
+func PeerCred(conn net.Conn) (*syscall.Ucred, error) {
+  uc, ok := conn.(*net.UnixConn)
+  if !ok {
+    return nil, errors.New("not a unix socket")
+  }
+  raw, err := uc.SyscallConn()
+  if err != nil {
+    return nil, err
+  }
+  var cred *syscall.Ucred
+  var credErr error
+  err = raw.Control(func(fd uintptr) {
+    cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return cred, credErr
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+  "os"
+  "os/exec"
+  "strings"
+  "sync"
+)
+
+// Runner executes the external commands of tricarb, tests swap it through
+// SetRunner so nothing needs root or the VPN tools to be installed.
+type Runner interface {
+  // Run runs the command attached to the standard streams of tricarb.
+  Run(cmd string, args ...string) error
+  // Output runs the command and returns its standard output.
+  Output(stdin string, cmd string, args ...string) ([]byte, error)
+}
+
+var (
+  runnerMu sync.RWMutex
+  runner   Runner = ExecRunner{}
+)
+
+// SetRunner replaces the runner and returns the previous one.
+func SetRunner(r Runner) Runner {
+  runnerMu.Lock()
+  defer runnerMu.Unlock()
+  prev := runner
+  runner = r
+  return prev
+}
+
+func currentRunner() Runner {
+  runnerMu.RLock()
+  defer runnerMu.RUnlock()
+  return runner
+}
+
+// ExecRunner runs the commands for real.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd string, args ...string) error {
+  c := exec.Command(cmd, args...)
+  c.Stdin = os.Stdin
+  c.Stdout = os.Stdout
+  c.Stderr = os.Stderr
+  return c.Run()
+}
+
+func (ExecRunner) Output(stdin string, cmd string, args ...string) ([]byte, error) {
+  c := exec.Command(cmd, args...)
+  if stdin != "" {
+    c.Stdin = strings.NewReader(stdin)
+  }
+  return c.Output()
+}
+
+// RecordRunner only records the command lines. Errors and outputs are looked
+// up by the full command line first and by the command name second.
+type RecordRunner struct {
+  Errors  map[string]error
+  Outputs map[string][]byte
+
+  mu       sync.Mutex
+  commands []string
+}
+
+func (r *RecordRunner) Run(cmd string, args ...string) error {
+  _, err := r.Output("", cmd, args...)
+  return err
+}
+
+func (r *RecordRunner) Output(stdin string, cmd string, args ...string) ([]byte, error) {
+  line := strings.Join(append([]string{cmd}, args...), " ")
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.commands = append(r.commands, line)
+  for _, key := range []string{line, cmd} {
+    if err, ok := r.Errors[key]; ok {
+      return nil, err
+    }
+    if out, ok := r.Outputs[key]; ok {
+      return out, nil
+    }
+  }
+  return []byte{}, nil
+}
+
+// Commands returns the command lines run so far.
+func (r *RecordRunner) Commands() []string {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return append([]string{}, r.commands...)
+}
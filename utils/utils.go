@@ -1,14 +1,15 @@
 package utils
 
 import (
+  "crypto/rand"
   "errors"
   "fmt"
-  "math/rand"
+  "math/big"
   "os"
-  "os/exec"
   "os/user"
+  "path"
   "strings"
-  "time"
+  "sync"
 
   "github.com/spf13/cast"
   "github.com/spf13/viper"
@@ -21,30 +22,55 @@ const (
 
 var (
   viper_ = viper.New()
+  // configDir holds config.yaml, the state store sits next to it
+  configDir string
+  // config.yaml is read on first use instead of on import
+  loadOnce sync.Once
+  loadErr  error
+  // writes of config.yaml replace the whole file
+  writeMu sync.Mutex
 )
 
-func init() {
-  rand.Seed(time.Now().UnixNano())
-
-  viper_.SetConfigName("config")
-  configDir := os.Getenv("TRICARB_CONFIG")
-  if configDir == "" {
-    curUser, err := user.Current()
-    if err != nil {
-      panic("unable to access current user's home directory")
+// LoadConfig reads config.yaml from $TRICARB_CONFIG or the home directory
+// and tells why it could not. The other functions read it on first use,
+// without one every key is unset.
+func LoadConfig() error {
+  loadOnce.Do(func() {
+    configDir = os.Getenv("TRICARB_CONFIG")
+    if configDir == "" {
+      curUser, err := user.Current()
+      if err != nil {
+        loadErr = errors.New("unable to access current user's home directory")
+        return
+      }
+      configDir = curUser.HomeDir
     }
-    configDir = curUser.HomeDir
-  }
-  viper_.AddConfigPath(configDir)
-  viper_.SetConfigType("yaml")
+    viper_.SetConfigName("config")
+    viper_.AddConfigPath(configDir)
+    viper_.SetConfigType("yaml")
+
+    viper_.AutomaticEnv()
+    loadErr = viper_.ReadInConfig()
+  })
+  return loadErr
+}
 
-  viper_.AutomaticEnv()
-  if err := viper_.ReadInConfig(); err != nil {
-    panic(err)
+func ConfigDir() string {
+  LoadConfig()
+  return configDir
+}
+
+// Read returns the raw value of the key, nil if it is not set.
+func Read(key string) interface{} {
+  LoadConfig()
+  if viper_.IsSet(key) {
+    return viper_.Get(key)
   }
+  return nil
 }
 
 func ReadString(key string) string {
+  LoadConfig()
   if viper_.IsSet(key) {
     log.Info("load config :: " + key)
     if ret := viper_.Get(key); ret != nil {
@@ -56,14 +82,12 @@ func ReadString(key string) string {
   return ""
 }
 
-func UpdateString(key string, context string) {
-  viper_.Set(key, context)
-  if err := viper_.WriteConfig(); err != nil {
-    panic(err)
-  }
+func UpdateString(key string, context string) error {
+  return update(key, context)
 }
 
 func ReadMap(key string) map[string]interface{} {
+  LoadConfig()
   if viper_.IsSet(key) {
     log.Info("load config :: " + key)
     if ret := viper_.Get(key); ret != nil {
@@ -75,14 +99,12 @@ func ReadMap(key string) map[string]interface{} {
   return map[string]interface{}{}
 }
 
-func UpdateMap(key string, context map[string]interface{}) {
-  viper_.Set(key, context)
-  if err := viper_.WriteConfig(); err != nil {
-    panic(err)
-  }
+func UpdateMap(key string, context map[string]interface{}) error {
+  return update(key, context)
 }
 
 func ReadArray(key string) []interface{} {
+  LoadConfig()
   if viper_.IsSet(key) {
     log.Info("load config :: " + key)
     if ret := viper_.Get(key); ret != nil {
@@ -94,11 +116,92 @@ func ReadArray(key string) []interface{} {
   return []interface{}{}
 }
 
-func UpdateArray(key string, context []interface{}) {
-  viper_.Set(key, context)
-  if err := viper_.WriteConfig(); err != nil {
-    panic(err)
+func UpdateArray(key string, context []interface{}) error {
+  return update(key, context)
+}
+
+// update writes config.yaml to a new file first and renames it, a failed
+// write leaves the old one in place.
+func update(key string, value interface{}) error {
+  if err := LoadConfig(); err != nil {
+    return err
+  }
+  writeMu.Lock()
+  defer writeMu.Unlock()
+  viper_.Set(key, value)
+  return write(viper_)
+}
+
+// Delete removes the keys from config.yaml, keys which are not set are
+// skipped. Viper cannot unset a key, the file is read again by a viper
+// without the environment, so the overrides do not end up in the file, and
+// written without them.
+func Delete(keys ...string) error {
+  LoadConfig()
+  writeMu.Lock()
+  defer writeMu.Unlock()
+  file := viper_.ConfigFileUsed()
+  if file == "" {
+    return nil
+  }
+  parsed := viper.New()
+  parsed.SetConfigFile(file)
+  if err := parsed.ReadInConfig(); err != nil {
+    return err
+  }
+  settings := parsed.AllSettings()
+  deleted := false
+  for _, key := range keys {
+    if deleteKey(settings, strings.Split(strings.ToLower(key), ".")) {
+      deleted = true
+    }
+  }
+  if !deleted {
+    return nil
+  }
+  v := viper.New()
+  v.SetConfigFile(file)
+  if err := v.MergeConfigMap(settings); err != nil {
+    return err
+  }
+  if err := write(v); err != nil {
+    return err
+  }
+  reloaded := viper.New()
+  reloaded.SetConfigFile(file)
+  reloaded.AutomaticEnv()
+  if err := reloaded.ReadInConfig(); err != nil {
+    return err
+  }
+  viper_ = reloaded
+  return nil
+}
+
+// deleteKey removes the nested key, and the tables it leaves empty.
+func deleteKey(settings map[string]interface{}, key []string) bool {
+  if len(key) == 1 {
+    _, ok := settings[key[0]]
+    delete(settings, key[0])
+    return ok
+  }
+  sub, ok := settings[key[0]].(map[string]interface{})
+  if !ok || !deleteKey(sub, key[1:]) {
+    return false
   }
+  if len(sub) == 0 {
+    delete(settings, key[0])
+  }
+  return true
+}
+
+func write(v *viper.Viper) error {
+  file := v.ConfigFileUsed()
+  tmp := path.Join(path.Dir(file), ".config-new.yaml")
+  if err := v.WriteConfigAs(tmp); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return os.Rename(tmp, file)
 }
 
 func InputAndCheck(prompt string, defaultValue string, validator func(string) bool) (string, error) {
@@ -121,11 +224,11 @@ func InputAndCheck(prompt string, defaultValue string, validator func(string) bo
 }
 
 func StdIOCmd(cmd string, args ...string) error {
-  c := exec.Command(cmd, args...)
-  c.Stdin = os.Stdin
-  c.Stdout = os.Stdout
-  c.Stderr = os.Stderr
-  return c.Run()
+  return currentRunner().Run(cmd, args...)
+}
+
+func OutputCmd(cmd string, args ...string) ([]byte, error) {
+  return currentRunner().Output("", cmd, args...)
 }
 
 func MakeText(script string, replacer map[string]string) (string, error) {
@@ -137,11 +240,17 @@ func MakeText(script string, replacer map[string]string) (string, error) {
   return content, nil
 }
 
+// GenerateAccessCode draws from crypto/rand, an access code is all it takes
+// to attach to a server.
 func GenerateAccessCode(n int) string {
   b := make([]byte, n)
-  strlen := len(passBytes)
+  max := big.NewInt(int64(len(passBytes)))
   for i := range b {
-    b[i] = passBytes[rand.Int63() % int64(strlen)]
+    j, err := rand.Int(rand.Reader, max)
+    if err != nil {
+      panic(err)
+    }
+    b[i] = passBytes[j.Int64()]
   }
   return string(b)
 }